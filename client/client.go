@@ -7,41 +7,105 @@ import (
 	"time"
 
 	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/extension"
 	"github.com/Squwid/squidtorrent/handshake"
 	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
 	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/utp"
 )
 
+// A Dialer makes connections to peers. The zero value dials TCP without encryption
+type Dialer struct {
+	Encryption mse.Mode // MSE mode of the connections
+
+	// UTP is the socket for uTP connections, peers that don't answer on it get TCP. Usually it's the one
+	// of the Listener, nil is TCP only
+	UTP *utp.Socket
+}
+
+// bitfieldTimeout is how long a peer we dial gets to send its bitfield after the handshake
+var bitfieldTimeout = 5 * time.Second
+
 // A Client is a TCP connection with a peer
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
+	HaveAll  bool // Peer we dialed sent Have All instead of a bitfield, Bitfield is empty since the number of pieces isn't known here
+	Fast     bool // Both sides support the fast extension (BEP 6)
+
+	// Extensions is the extension protocol state of the connection, nil if it is not in use
+	Extensions *extension.Conn
 
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+	remote   *handshake.Handshake // Handshake the peer sent
+	pending  []*message.Message   // Messages read while waiting for the bitfield
+	inbound  bool
 }
 
 // getBitfield grabs the bitfield from the connected peer. Handshake was already good, see what
-// pieces the peer has
-func getBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+// pieces the peer has. Extended messages are allowed to come before the bitfield, they are returned
+// so they can be read later. With the fast extension Have All or Have None can take the place of the bitfield
+func getBitfield(conn net.Conn, fast bool) (bf bitfield.Bitfield, haveAll bool, pending []*message.Message, err error) {
+	conn.SetDeadline(time.Now().Add(bitfieldTimeout))
 	defer conn.SetDeadline(time.Time{}) // If bitfield is good set connection to infinite
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		if msg == nil {
+			// Keep alive message, not cool for initial bitfield resp
+			return nil, false, nil, fmt.Errorf("expected bitfield but got nil")
+		}
+
+		switch {
+		case msg.ID == message.MsgExtended:
+			pending = append(pending, msg)
+			continue
+		case msg.ID == message.MsgHaveAll && fast:
+			return nil, true, pending, nil
+		case msg.ID == message.MsgHaveNone && fast:
+			return nil, false, pending, nil
+		case msg.ID != message.MsgBitfield:
+			return nil, false, nil, fmt.Errorf("expected messageID %v but got %v", message.MsgBitfield, msg.ID)
+		}
+		return msg.Payload, false, pending, nil
+	}
+}
+
+// connect dials a peer and does the encryption handshake. In Prefer mode peers that can't do
+// encryption get a second, plaintext connection
+func (d Dialer) connect(peer peers.Peer, infoHash [20]byte) (net.Conn, error) {
+	conn, err := d.dialPeer(peer)
+	if err != nil || d.Encryption == mse.Disable {
+		return conn, err
 	}
-	if msg == nil {
-		// Keep alive message, not cool for initial bitfield resp
-		return nil, fmt.Errorf("expected bitfield but got nil")
+
+	enc, err := mse.Initiate(conn, infoHash, d.Encryption, nil)
+	if err == nil {
+		return enc, nil
 	}
-	if msg.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("expected messageID %v but got %v", message.MsgBitfield, msg.ID)
+	conn.Close()
+	if d.Encryption == mse.Require {
+		return nil, err
 	}
+	// Peers without encryption usually hang up on it
+	return d.dialPeer(peer)
+}
 
-	return msg.Payload, nil
+// dialPeer connects to a peer over uTP, or TCP when that doesn't work
+func (d Dialer) dialPeer(peer peers.Peer) (net.Conn, error) {
+	if d.UTP != nil {
+		if conn, err := d.UTP.DialTimeout(peer.String(), 2*time.Second); err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialTimeout("tcp", peer.String(), 3*time.Second)
 }
 
 // completeHandshake completes a handshake with a connection with a peer, makes sure they have the file
@@ -51,6 +115,8 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	defer conn.SetDeadline(time.Time{}) // If connection is successful disable handshake timeout
 
 	req := handshake.New(infohash, peerID)
+	req.SetReserved(handshake.ReservedExtensions)
+	req.SetReserved(handshake.ReservedFast)
 	_, err := conn.Write(req.Serialize()) // Send handshake request through established connection
 	if err != nil {
 		return nil, err
@@ -68,10 +134,15 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-// New connects with a peer, completes a handshake and grabs the bitfield from the peer
+// New connects with a peer over TCP without encryption, completes a handshake and grabs the bitfield from the peer
 func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return Dialer{}.Dial(peer, peerID, infoHash)
+}
+
+// Dial connects with a peer, completes a handshake and grabs the bitfield from the peer
+func (d Dialer) Dial(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	// Initiate a TCP connection with the peer, pretty default timeout
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	conn, err := d.connect(peer, infoHash)
 	if err != nil {
 		return nil, err
 	}
@@ -87,14 +158,15 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	 * After sending handshake, expect back the same format, with infohash matching, otherwise conneciton can be :trashcan:
 	 */
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
 	// Get what parts of the file that the peer has
-	bf, err := getBitfield(conn)
+	fast := res.HasReserved(handshake.ReservedFast)
+	bf, haveAll, pending, err := getBitfield(conn, fast)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -104,38 +176,161 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 		Conn:     conn,
 		Choked:   true, // Choked is assumed true
 		Bitfield: bf,
+		HaveAll:  haveAll,
+		Fast:     fast,
 		peer:     peer,
 		infoHash: infoHash,
 		peerID:   peerID,
+		remote:   res,
+		pending:  pending,
 	}, nil
 }
 
+// Accept finishes an incoming connection whose handshake was already read. It replies with our handshake
+// and bitfield. The peer starts out with no pieces, its bitfield is read along with the rest of its messages
+// since peers with nothing can leave it out
+func Accept(conn net.Conn, remote *handshake.Handshake, peerID [20]byte, bf bitfield.Bitfield) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	res := handshake.New(remote.InfoHash, peerID)
+	res.SetReserved(handshake.ReservedExtensions)
+	res.SetReserved(handshake.ReservedFast)
+	fast := remote.HasReserved(handshake.ReservedFast)
+	_, err := conn.Write(res.Serialize())
+	if err == nil {
+		_, err = conn.Write(BitfieldMessage(bf, fast).Serialize())
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var peer peers.Peer
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return &Client{
+		Conn:     conn,
+		Choked:   true,
+		Bitfield: make(bitfield.Bitfield, len(bf)),
+		Fast:     fast,
+		peer:     peer,
+		infoHash: remote.InfoHash,
+		peerID:   peerID,
+		remote:   remote,
+		inbound:  true,
+	}, nil
+}
+
+// BitfieldMessage is the message that tells a peer which pieces we have. With the fast extension it's Have
+// None when there are no pieces
+func BitfieldMessage(bf bitfield.Bitfield, fast bool) *message.Message {
+	if fast && bytes.Count(bf, []byte{0}) == len(bf) {
+		return &message.Message{ID: message.MsgHaveNone}
+	}
+	return &message.Message{ID: message.MsgBitfield, Payload: bf}
+}
+
+// Peer is the address of the peer. For incoming connections the port is not the one the peer listens on
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// Inbound tells if the peer connected to us
+func (c *Client) Inbound() bool {
+	return c.inbound
+}
+
+// Encrypted tells if the connection is encrypted with MSE
+func (c *Client) Encrypted() bool {
+	_, ok := c.Conn.(*mse.Conn)
+	return ok
+}
+
+// UTP tells if the connection runs over uTP rather than TCP
+func (c *Client) UTP() bool {
+	_, ok := c.Conn.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// SupportsExtensions tells if the peer advertised the extension protocol in its handshake
+func (c *Client) SupportsExtensions() bool {
+	return c.remote != nil && c.remote.HasReserved(handshake.ReservedExtensions)
+}
+
 /* Client methods for sending/receiving messages */
 
-func (c Client) Read() (*message.Message, error) {
+func (c *Client) Read() (*message.Message, error) {
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg, nil
+	}
 	return message.Read(c.Conn)
 }
 
-func (c Client) SendUnchoked() error {
+func (c *Client) SendUnchoked() error {
 	msg := message.Message{ID: message.MsgUnchoke}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
-func (c Client) SendInterested() error {
+func (c *Client) SendChoked() error {
+	msg := message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
+func (c *Client) SendNotInterested() error {
+	msg := message.Message{ID: message.MsgNotInterested}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 func (c *Client) SendRequest(index, offset, length int) error {
 	req := message.FormatRequest(index, offset, length)
 	_, err := c.Conn.Write(req.Serialize())
 	return err
 }
 
+// SendCancel takes back a request, used in endgame once another peer sent the block
+func (c *Client) SendCancel(index, offset, length int) error {
+	msg := message.FormatCancel(index, offset, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendReject turns down a request of a peer with the fast extension
+func (c *Client) SendReject(index, offset, length int) error {
+	msg := message.FormatReject(index, offset, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendAllowedFast lets a peer with the fast extension request a piece while we choke it
+func (c *Client) SendAllowedFast(index int) error {
+	msg := message.FormatAllowedFast(index)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
+
+// SendExtended sends an extended message, id is the extended message id the peer asked for
+func (c *Client) SendExtended(id uint8, payload []byte) error {
+	msg := message.FormatExtended(id, payload)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBitfield(t *testing.T) {
+	tests := map[string]struct {
+		msgs    []*message.Message
+		fast    bool
+		bf      bitfield.Bitfield
+		haveAll bool
+		pending int
+		fails   bool
+	}{
+		"Bitfield": {
+			msgs: []*message.Message{{ID: message.MsgBitfield, Payload: []byte{0xf0}}},
+			bf:   bitfield.Bitfield{0xf0},
+		},
+		"Extended before the bitfield": {
+			msgs:    []*message.Message{message.FormatExtended(0, []byte("de")), {ID: message.MsgBitfield, Payload: []byte{0x01}}},
+			bf:      bitfield.Bitfield{0x01},
+			pending: 1,
+		},
+		"Have All": {
+			msgs:    []*message.Message{{ID: message.MsgHaveAll}},
+			fast:    true,
+			haveAll: true,
+		},
+		"Have None": {
+			msgs: []*message.Message{{ID: message.MsgHaveNone}},
+			fast: true,
+		},
+		"Have All without the fast extension": {
+			msgs:  []*message.Message{{ID: message.MsgHaveAll}},
+			fails: true,
+		},
+		"Something else": {
+			msgs:  []*message.Message{message.FormatHave(1)},
+			fast:  true,
+			fails: true,
+		},
+		"Keep alive": {
+			msgs:  []*message.Message{nil},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go func() {
+				for _, msg := range test.msgs {
+					remote.Write(msg.Serialize())
+				}
+			}()
+
+			bf, haveAll, pending, err := getBitfield(local, test.fast)
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.bf, bf)
+			assert.Equal(t, test.haveAll, haveAll)
+			assert.Len(t, pending, test.pending)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/Squwid/squidtorrent/utp"
+	"github.com/sirupsen/logrus"
+)
+
+// registration is a torrent that accepts incoming peers
+type registration struct {
+	peerID   [20]byte
+	bitfield func() bitfield.Bitfield // Pieces we have right now, sent to every new peer
+	conns    chan *Client
+	done     chan struct{}
+}
+
+// A Listener accepts incoming peer connections on a single port and hands them to the torrent
+// whose info hash is in the handshake, any number of torrents can share it. Peers connect over TCP
+// or uTP, the UDP socket of uTP is shared with the DHT
+type Listener struct {
+	l          net.Listener
+	utp        *utp.Socket
+	encryption mse.Mode
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*registration
+}
+
+// Listen starts accepting peers on the address, encryption is the MSE mode they have to go along with.
+// uTP uses the same port as TCP
+func Listen(addr string, encryption mse.Mode) (*Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	sock, err := utp.Listen("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	ln := &Listener{
+		l:          l,
+		utp:        sock,
+		encryption: encryption,
+		torrents:   map[[20]byte]*registration{},
+	}
+	go ln.serve(l)
+	go ln.serve(sock)
+	return ln, nil
+}
+
+// Addr is the address the listener accepts peers on
+func (ln *Listener) Addr() net.Addr {
+	return ln.l.Addr()
+}
+
+// Port is the port to announce to trackers
+func (ln *Listener) Port() uint16 {
+	if addr, ok := ln.l.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// UTP is the uTP socket, outgoing connections can use it too
+func (ln *Listener) UTP() *utp.Socket {
+	return ln.utp
+}
+
+// PacketConn gets the packets on the UDP port that are not uTP, for the DHT
+func (ln *Listener) PacketConn() net.PacketConn {
+	return ln.utp.PacketConn()
+}
+
+// Close stops accepting peers, uTP connections that are open get reset
+func (ln *Listener) Close() error {
+	err := ln.l.Close()
+	if uerr := ln.utp.Close(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Register starts accepting peers for a torrent. Connected peers come out of the returned channel
+// until the torrent is unregistered
+func (ln *Listener) Register(infoHash, peerID [20]byte, bf func() bitfield.Bitfield) (<-chan *Client, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if _, ok := ln.torrents[infoHash]; ok {
+		return nil, fmt.Errorf("torrent %x is already registered", infoHash)
+	}
+	r := &registration{
+		peerID:   peerID,
+		bitfield: bf,
+		conns:    make(chan *Client),
+		done:     make(chan struct{}),
+	}
+	ln.torrents[infoHash] = r
+	return r.conns, nil
+}
+
+// Alias lets peers connect to a registered torrent with another info hash, like the v2 info hash of a
+// hybrid torrent. Peers get our handshake back with the hash they used
+func (ln *Listener) Alias(alias, infoHash [20]byte) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	r, ok := ln.torrents[infoHash]
+	if !ok {
+		return fmt.Errorf("torrent %x is not registered", infoHash)
+	}
+	if _, ok := ln.torrents[alias]; ok {
+		return fmt.Errorf("torrent %x is already registered", alias)
+	}
+	ln.torrents[alias] = r
+	return nil
+}
+
+// Unregister stops accepting peers for a torrent and its aliases, new connections for it get closed
+func (ln *Listener) Unregister(infoHash [20]byte) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	r, ok := ln.torrents[infoHash]
+	if !ok {
+		return
+	}
+	close(r.done)
+	for hash, other := range ln.torrents {
+		if other == r {
+			delete(ln.torrents, hash)
+		}
+	}
+}
+
+func (ln *Listener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Usually out of file descriptors, back off for a bit
+			logrus.WithError(err).Warnf("Error accepting peer")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go ln.handle(conn)
+	}
+}
+
+// handle reads the handshake of a new connection and routes it by info hash
+func (ln *Listener) handle(conn net.Conn) {
+	l := logrus.WithField("Peer", conn.RemoteAddr().String())
+
+	ec, err := mse.Accept(conn, ln.encryption, ln.infoHashes)
+	if err != nil {
+		l.WithError(err).Debugf("Error with encryption handshake of incoming peer")
+		conn.Close()
+		return
+	}
+	conn = ec
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	hs, err := handshake.Read(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		l.WithError(err).Debugf("Error reading handshake of incoming peer")
+		conn.Close()
+		return
+	}
+
+	ln.mu.Lock()
+	r, ok := ln.torrents[hs.InfoHash]
+	ln.mu.Unlock()
+	if !ok {
+		l.Debugf("Incoming peer asked for unknown torrent %x", hs.InfoHash)
+		conn.Close()
+		return
+	}
+
+	c, err := Accept(conn, hs, r.peerID, r.bitfield())
+	if err != nil {
+		l.WithError(err).Debugf("Error accepting incoming peer")
+		conn.Close()
+		return
+	}
+
+	select {
+	case r.conns <- c:
+	case <-r.done:
+		conn.Close()
+	}
+}
+
+// infoHashes are the torrents that are registered, encrypted peers use one of them as the key
+func (ln *Listener) infoHashes() [][20]byte {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	hashes := make([][20]byte, 0, len(ln.torrents))
+	for infoHash := range ln.torrents {
+		hashes = append(hashes, infoHash)
+	}
+	return hashes
+}
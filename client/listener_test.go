@@ -0,0 +1,319 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/utp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dial connects to the listener and sends a handshake for the info hash
+func dial(t *testing.T, ln *Listener, infoHash [20]byte) net.Conn {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var peerID [20]byte
+	copy(peerID[:], "-FAKE01-leecherleech")
+	_, err = conn.Write(handshake.New(infoHash, peerID).Serialize())
+	require.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+
+	hashA, hashB := [20]byte{'a'}, [20]byte{'b'}
+	idA, idB := [20]byte{'A'}, [20]byte{'B'}
+	connsA, err := ln.Register(hashA, idA, func() bitfield.Bitfield { return bitfield.Bitfield{0xf0} })
+	require.Nil(t, err)
+	connsB, err := ln.Register(hashB, idB, func() bitfield.Bitfield { return bitfield.Bitfield{0x00, 0x00} })
+	require.Nil(t, err)
+	_, err = ln.Register(hashA, idA, nil)
+	assert.NotNil(t, err)
+
+	tests := map[string]struct {
+		infoHash [20]byte
+		peerID   [20]byte
+		ours     bitfield.Bitfield
+		theirs   bitfield.Bitfield
+		conns    <-chan *Client
+	}{
+		"torrent a": {infoHash: hashA, peerID: idA, ours: bitfield.Bitfield{0xf0}, theirs: bitfield.Bitfield{0x0f}, conns: connsA},
+		"torrent b": {infoHash: hashB, peerID: idB, ours: bitfield.Bitfield{0x00, 0x00}, theirs: bitfield.Bitfield{0x80, 0x01}, conns: connsB},
+	}
+
+	for name, test := range tests {
+		conn := dial(t, ln, test.infoHash)
+
+		hs, err := handshake.Read(conn)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.infoHash, hs.InfoHash, name)
+		assert.Equal(t, test.peerID, hs.PeerID, name)
+		assert.True(t, hs.HasReserved(handshake.ReservedExtensions), name)
+
+		msg, err := message.Read(conn)
+		require.Nil(t, err, name)
+		assert.Equal(t, &message.Message{ID: message.MsgBitfield, Payload: test.ours}, msg, name)
+
+		_, err = conn.Write((&message.Message{ID: message.MsgBitfield, Payload: test.theirs}).Serialize())
+		require.Nil(t, err, name)
+
+		// Their bitfield is left for the torrent to read
+		c := <-test.conns
+		assert.Equal(t, make(bitfield.Bitfield, len(test.ours)), c.Bitfield, name)
+		msg, err = c.Read()
+		require.Nil(t, err, name)
+		assert.Equal(t, &message.Message{ID: message.MsgBitfield, Payload: test.theirs}, msg, name)
+		assert.True(t, c.Inbound(), name)
+		assert.True(t, c.Choked, name)
+		assert.Equal(t, conn.LocalAddr().String(), c.Peer().String(), name)
+		c.Conn.Close()
+	}
+
+	// Unknown torrents get hung up on
+	conn := dial(t, ln, [20]byte{'c'})
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+
+	ln.Unregister(hashA)
+	conn = dial(t, ln, hashA)
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+}
+
+func TestListenerAlias(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+
+	hash, alias := [20]byte{'a'}, [20]byte{'v', '2'}
+	conns, err := ln.Register(hash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0xf0} })
+	require.Nil(t, err)
+	assert.NotNil(t, ln.Alias(alias, [20]byte{'b'}))
+	require.Nil(t, ln.Alias(alias, hash))
+	assert.NotNil(t, ln.Alias(alias, hash))
+
+	// Peers using the alias end up with the torrent, and get the hash they used back
+	conn := dial(t, ln, alias)
+	hs, err := handshake.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, alias, hs.InfoHash)
+	_, err = message.Read(conn)
+	require.Nil(t, err)
+	_, err = conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0}}).Serialize())
+	require.Nil(t, err)
+	c := <-conns
+	c.Conn.Close()
+
+	// The alias goes away with the torrent
+	ln.Unregister(hash)
+	conn = dial(t, ln, alias)
+	_, err = handshake.Read(conn)
+	assert.NotNil(t, err)
+	_, err = ln.Register(alias, [20]byte{'A'}, nil)
+	assert.Nil(t, err)
+}
+
+func TestAcceptWithoutBitfield(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+
+	infoHash := [20]byte{'a'}
+	conns, err := ln.Register(infoHash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0xff, 0x80} })
+	require.Nil(t, err)
+
+	conn := dial(t, ln, infoHash)
+	_, err = handshake.Read(conn)
+	require.Nil(t, err)
+	_, err = message.Read(conn)
+	require.Nil(t, err)
+
+	// The peer comes out right after the handshake, without waiting for a bitfield it may never send
+	var c *Client
+	select {
+	case c = <-conns:
+	case <-time.After(time.Second):
+		t.Fatal("peer should not have to send anything after the handshake")
+	}
+	assert.Equal(t, bitfield.Bitfield{0x00, 0x00}, c.Bitfield)
+
+	// A peer with nothing skips the bitfield and says it is interested straight away
+	_, err = conn.Write(message.FormatExtended(0, []byte("de")).Serialize())
+	require.Nil(t, err)
+	_, err = conn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+	require.Nil(t, err)
+
+	msg, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgExtended, msg.ID)
+	msg, err = c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgInterested, msg.ID)
+}
+
+func TestAcceptFast(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+
+	infoHash := [20]byte{'a'}
+	conns, err := ln.Register(infoHash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0x00, 0x00} })
+	require.Nil(t, err)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	hs := handshake.New(infoHash, [20]byte{'B'})
+	hs.SetReserved(handshake.ReservedFast)
+	_, err = conn.Write(hs.Serialize())
+	require.Nil(t, err)
+
+	// We have nothing so the bitfield is Have None, the seed sends Have All
+	res, err := handshake.Read(conn)
+	require.Nil(t, err)
+	assert.True(t, res.HasReserved(handshake.ReservedFast))
+	msg, err := message.Read(conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgHaveNone, msg.ID)
+	_, err = conn.Write((&message.Message{ID: message.MsgHaveAll}).Serialize())
+	require.Nil(t, err)
+
+	c := <-conns
+	assert.True(t, c.Fast)
+	msg, err = c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgHaveAll, msg.ID)
+}
+
+func TestEncryption(t *testing.T) {
+	tests := map[string]struct {
+		outbound, inbound mse.Mode
+		encrypted         bool
+		fails             bool
+	}{
+		"Both require":       {outbound: mse.Require, inbound: mse.Require, encrypted: true},
+		"Both prefer":        {outbound: mse.Prefer, inbound: mse.Prefer, encrypted: true},
+		"Prefer to disable":  {outbound: mse.Prefer, inbound: mse.Disable},
+		"Disable to prefer":  {outbound: mse.Disable, inbound: mse.Prefer},
+		"Require to disable": {outbound: mse.Require, inbound: mse.Disable, fails: true},
+		"Disable to require": {outbound: mse.Disable, inbound: mse.Require, fails: true},
+		"Both disable":       {outbound: mse.Disable, inbound: mse.Disable},
+		"Require to prefer":  {outbound: mse.Require, inbound: mse.Prefer, encrypted: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ln, err := Listen("127.0.0.1:0", test.inbound)
+			require.Nil(t, err)
+			defer ln.Close()
+			infoHash := [20]byte{'a'}
+			conns, err := ln.Register(infoHash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0xf0} })
+			require.Nil(t, err)
+
+			addr := ln.Addr().(*net.TCPAddr)
+			c, err := Dialer{Encryption: test.outbound}.Dial(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, [20]byte{'B'}, infoHash)
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			defer c.Conn.Close()
+			assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield)
+			require.Nil(t, c.Conn.SetDeadline(time.Now().Add(2*time.Second)))
+			_, err = c.Conn.Write(BitfieldMessage(bitfield.Bitfield{0x0f}, false).Serialize())
+			require.Nil(t, err)
+
+			inbound := <-conns
+			defer inbound.Conn.Close()
+			msg, err := inbound.Read()
+			require.Nil(t, err)
+			assert.Equal(t, BitfieldMessage(bitfield.Bitfield{0x0f}, false), msg)
+			_, ok := c.Conn.(*mse.Conn)
+			assert.Equal(t, test.encrypted, ok)
+			_, ok = inbound.Conn.(*mse.Conn)
+			assert.Equal(t, test.encrypted, ok)
+
+			// Messages go through either way
+			require.Nil(t, inbound.SendUnchoked())
+			msg, err = c.Read()
+			require.Nil(t, err)
+			assert.Equal(t, message.MsgUnchoke, msg.ID)
+		})
+	}
+}
+
+func TestUTP(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+	assert.Equal(t, ln.Port(), uint16(ln.UTP().Addr().(*net.UDPAddr).Port))
+	infoHash := [20]byte{'a'}
+	conns, err := ln.Register(infoHash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0xf0} })
+	require.Nil(t, err)
+
+	sock, err := utp.Listen("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer sock.Close()
+	dialer := Dialer{UTP: sock}
+	peer := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: ln.Port()}
+
+	// uTP goes first
+	c, err := dialer.Dial(peer, [20]byte{'B'}, infoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	_, ok := c.Conn.(*utp.Conn)
+	assert.True(t, ok)
+	_, err = c.Conn.Write(BitfieldMessage(bitfield.Bitfield{0x0f}, false).Serialize())
+	require.Nil(t, err)
+	inbound := <-conns
+	defer inbound.Conn.Close()
+	msg, err := inbound.Read()
+	require.Nil(t, err)
+	assert.Equal(t, BitfieldMessage(bitfield.Bitfield{0x0f}, false), msg)
+	assert.Equal(t, sock.Addr().String(), inbound.Peer().String())
+
+	// Peers that don't answer on uTP get TCP
+	ln.UTP().Close()
+	c, err = dialer.Dial(peer, [20]byte{'B'}, infoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	_, ok = c.Conn.(*net.TCPConn)
+	assert.True(t, ok)
+}
+
+func TestDualStack(t *testing.T) {
+	ln, err := Listen(":0", mse.Disable)
+	require.Nil(t, err)
+	defer ln.Close()
+	infoHash := [20]byte{'a'}
+	conns, err := ln.Register(infoHash, [20]byte{'A'}, func() bitfield.Bitfield { return bitfield.Bitfield{0xf0} })
+	require.Nil(t, err)
+
+	// IPv4 and IPv6 peers both get in on the one port
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		peer := peers.Peer{IP: net.ParseIP(host), Port: ln.Port()}
+		c, err := New(peer, [20]byte{'B'}, infoHash)
+		require.Nil(t, err, host)
+		defer c.Conn.Close()
+		_, err = c.Conn.Write(BitfieldMessage(bitfield.Bitfield{0x0f}, false).Serialize())
+		require.Nil(t, err, host)
+
+		inbound := <-conns
+		defer inbound.Conn.Close()
+		assert.Equal(t, c.Conn.LocalAddr().String(), inbound.Peer().String(), host)
+	}
+}
@@ -0,0 +1,696 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBootstrapNodes are well known routers used to join the network
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// queryTimeout is how long a node gets to answer a query. It's a var so tests can lower it
+var queryTimeout = 5 * time.Second
+
+const (
+	// alpha is the number of queries a lookup has in flight at once
+	alpha = 3
+
+	// tokenRotation is how often the token secret changes, tokens stay valid for two rotations
+	tokenRotation = 5 * time.Minute
+
+	// peerExpiry is how long announced peers are kept around
+	peerExpiry = 30 * time.Minute
+
+	// refreshInterval is how often the routing table gets checked for questionable nodes and stale buckets
+	refreshInterval = time.Minute
+
+	// maxValues is the most peers returned in a single get_peers response
+	maxValues = 50
+
+	maxPacketSize = 2048
+)
+
+var errClosed = errors.New("dht server closed")
+
+// Config configures a DHT server
+type Config struct {
+	Addr           string         // UDP address to listen on, e.g. ":6881"
+	Conn           net.PacketConn // Used instead of listening on Addr when set, like a socket shared with uTP
+	ID             ID             // Our node id, random when left empty
+	BootstrapNodes []string       // Nodes used to join the network, usually DefaultBootstrapNodes
+
+	// StateFile keeps the node id and the good nodes between runs. It is loaded on start and written on Close
+	StateFile string
+}
+
+// storedPeer is a peer that announced itself for an info hash
+type storedPeer struct {
+	peer  peers.Peer
+	added time.Time
+}
+
+// Server is a mainline DHT node. It answers queries from other nodes and finds peers for info hashes
+type Server struct {
+	id        ID
+	conn      net.PacketConn
+	table     *table
+	bootstrap []string
+	saved     []node // Nodes from the state file, tried before the bootstrap nodes
+	stateFile string
+
+	mu         sync.Mutex
+	txID       uint16
+	pending    map[string]chan *msg // Keyed by transaction id and address
+	secret     []byte
+	prevSecret []byte
+	store      map[ID]map[string]storedPeer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New starts a DHT server listening on the configured address. Bootstrap has to be called to join the network
+func New(cfg Config) (*Server, error) {
+	id := cfg.ID
+	var saved []node
+	if cfg.StateFile != "" {
+		// A broken state file only costs a slower bootstrap, it gets overwritten on Close
+		st, err := loadState(cfg.StateFile)
+		if err == nil {
+			saved, err = unmarshalNodes(st.Nodes)
+		}
+		if err == nil {
+			var saved6 []node
+			saved6, err = unmarshalNodes6(st.Nodes6)
+			saved = append(saved, saved6...)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("File", cfg.StateFile).Warnf("Ignoring dht state file")
+		} else if id == (ID{}) {
+			copy(id[:], st.ID)
+		}
+	}
+
+	if id == (ID{}) {
+		var err error
+		if id, err = RandomID(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn := cfg.Conn
+	if conn == nil {
+		var err error
+		if conn, err = net.ListenPacket("udp", cfg.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		id:        id,
+		conn:      conn,
+		table:     newTable(id),
+		bootstrap: cfg.BootstrapNodes,
+		saved:     saved,
+		stateFile: cfg.StateFile,
+		pending:   map[string]chan *msg{},
+		secret:    newSecret(),
+		store:     map[ID]map[string]storedPeer{},
+		done:      make(chan struct{}),
+	}
+	s.prevSecret = s.secret
+
+	go s.serve()
+	go s.maintain()
+	return s, nil
+}
+
+// ID is our node id
+func (s *Server) ID() ID {
+	return s.id
+}
+
+// Addr is the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes is the number of nodes in the routing table
+func (s *Server) Nodes() int {
+	return s.table.len()
+}
+
+// Close stops the server and saves the state file, running lookups end early
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stateFile != "" {
+			err = s.saveState()
+		}
+		close(s.done)
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// Bootstrap joins the network by looking up our own id. Nodes saved by the last run are asked first,
+// the bootstrap nodes only get used when none of those answer
+func (s *Server) Bootstrap() error {
+	if len(s.saved) > 0 {
+		s.lookup(s.id, methodFindNode, s.saved, nil)
+		if s.table.len() > 0 {
+			return nil
+		}
+	}
+
+	var seeds []node
+	for _, b := range s.bootstrap {
+		addr, err := net.ResolveUDPAddr("udp", b)
+		if err != nil {
+			logrus.WithError(err).WithField("Node", b).Debugf("Could not resolve bootstrap node")
+			continue
+		}
+		seeds = append(seeds, node{addr: addr})
+	}
+
+	s.lookup(s.id, methodFindNode, seeds, nil)
+	if s.table.len() == 0 {
+		return errors.New("could not reach any dht nodes")
+	}
+	return nil
+}
+
+// Ping pings a node and adds it to the routing table when it answers
+func (s *Server) Ping(addr *net.UDPAddr) (ID, error) {
+	r, err := s.query(addr, methodPing, &args{})
+	if err != nil {
+		return ID{}, err
+	}
+	var id ID
+	copy(id[:], r.ID)
+	return id, nil
+}
+
+// GetPeers looks up the peers of an info hash. Peers are sent on the returned channel as they are found,
+// it gets closed once the lookup is over
+func (s *Server) GetPeers(infoHash [20]byte) <-chan peers.Peer {
+	ch := make(chan peers.Peer)
+	go func() {
+		defer close(ch)
+		s.getPeers(infoHash, ch)
+	}()
+	return ch
+}
+
+// Announce looks up the peers of an info hash like GetPeers, then tells the closest nodes
+// that we are downloading it on the given port
+func (s *Server) Announce(infoHash [20]byte, port uint16) <-chan peers.Peer {
+	ch := make(chan peers.Peer)
+	go func() {
+		defer close(ch)
+		for _, n := range s.getPeers(infoHash, ch) {
+			go s.query(n.addr, methodAnnouncePeer, &args{
+				InfoHash: string(infoHash[:]),
+				Port:     int(port),
+				Token:    n.token,
+			})
+		}
+	}()
+	return ch
+}
+
+// tokenNode is a node that answered get_peers, along with the token needed to announce to it
+type tokenNode struct {
+	node
+	token string
+}
+
+// getPeers runs a get_peers lookup and sends every new peer on ch. It returns the closest nodes that gave a token
+func (s *Server) getPeers(infoHash [20]byte, ch chan<- peers.Peer) []tokenNode {
+	seen := map[string]bool{}
+	tokens := map[string]string{}
+
+	closest := s.lookup(ID(infoHash), methodGetPeers, nil, func(n node, r *returns) {
+		var found []peers.Peer
+		if r.Token != "" {
+			tokens[n.addr.String()] = r.Token
+		}
+		for _, v := range r.Values {
+			// Each value is one peer, the length tells which kind
+			unmarshal := peers.Unmarshal
+			if len(v) == net.IPv6len+2 {
+				unmarshal = peers.Unmarshal6
+			}
+			ps, err := unmarshal([]byte(v))
+			if err != nil {
+				continue
+			}
+			for _, p := range ps {
+				if !seen[p.String()] {
+					seen[p.String()] = true
+					found = append(found, p)
+				}
+			}
+		}
+
+		for _, p := range found {
+			select {
+			case ch <- p:
+			case <-s.done:
+				return
+			}
+		}
+	})
+
+	var ns []tokenNode
+	for _, n := range closest {
+		if token, ok := tokens[n.addr.String()]; ok {
+			ns = append(ns, tokenNode{n, token})
+		}
+	}
+	return ns
+}
+
+// candidate is a node a lookup knows about
+type candidate struct {
+	node
+	seed    bool // Bootstrap nodes have no known id, they get asked first
+	queried bool
+	failed  bool
+}
+
+type lookupResult struct {
+	c   *candidate
+	r   *returns
+	err error
+}
+
+// lookup walks towards the target by asking the closest nodes it knows about for closer ones, alpha at a time,
+// until the K closest nodes that answered have all been asked. It returns those nodes, closest first.
+// Nodes in start are used on top of the routing table, ones without an id are asked first.
+// handle gets called with every response, one at a time
+func (s *Server) lookup(target ID, method string, start []node, handle func(node, *returns)) []node {
+	seen := map[string]bool{}
+	var cands []*candidate
+	add := func(n node, seed bool) {
+		if seen[n.addr.String()] || n.id == s.id || n.addr.Port == 0 {
+			return
+		}
+		seen[n.addr.String()] = true
+		cands = append(cands, &candidate{node: n, seed: seed})
+	}
+	for _, n := range start {
+		add(n, n.id == ID{})
+	}
+	for _, n := range s.table.closest(target, K) {
+		add(n, false)
+	}
+
+	a := &args{Want: []string{want4, want6}}
+	if method == methodFindNode {
+		a.Target = string(target[:])
+	} else {
+		a.InfoHash = string(target[:])
+	}
+
+	results := make(chan lookupResult)
+	inflight := 0
+	for {
+		sort.SliceStable(cands, func(i, j int) bool {
+			if cands[i].seed != cands[j].seed {
+				return cands[i].seed
+			}
+			return closer(target, cands[i].id, cands[j].id)
+		})
+
+		// Ask the closest nodes that have not been asked yet
+		count := 0
+		for _, c := range cands {
+			if inflight >= alpha || count >= K {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			if !c.seed {
+				count++
+			}
+			if c.queried {
+				continue
+			}
+
+			c.queried = true
+			inflight++
+			go func(c *candidate) {
+				r, err := s.query(c.addr, method, a)
+				results <- lookupResult{c, r, err}
+			}(c)
+		}
+		if inflight == 0 {
+			break
+		}
+
+		res := <-results
+		inflight--
+		if res.err != nil {
+			res.c.failed = true
+			continue
+		}
+		copy(res.c.id[:], res.r.ID)
+		if handle != nil {
+			handle(res.c.node, res.r)
+		}
+
+		ns, err := unmarshalNodes(res.r.Nodes)
+		if err != nil {
+			continue
+		}
+		ns6, err := unmarshalNodes6(res.r.Nodes6)
+		if err != nil {
+			continue
+		}
+		for _, n := range append(ns, ns6...) {
+			add(n, false)
+		}
+	}
+
+	var closest []node
+	for _, c := range cands {
+		if len(closest) == K {
+			break
+		}
+		if c.queried && !c.failed && !c.seed {
+			closest = append(closest, c.node)
+		}
+	}
+	return closest
+}
+
+// query sends a query and waits for its response. Nodes that answer are added to the routing table
+func (s *Server) query(addr *net.UDPAddr, method string, a *args) (*returns, error) {
+	s.mu.Lock()
+	s.txID++
+	t := make([]byte, 2)
+	binary.BigEndian.PutUint16(t, s.txID)
+	key := string(t) + addr.String()
+	ch := make(chan *msg, 1)
+	s.pending[key] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	q := *a
+	q.ID = string(s.id[:])
+	if err := s.send(addr, &msg{T: string(t), Y: typeQuery, Q: method, A: &q, V: version}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-ch:
+		if m.Y == typeError {
+			return nil, m.parseError()
+		}
+		var id ID
+		copy(id[:], m.R.ID)
+		s.table.add(node{id: id, addr: addr})
+		return m.R, nil
+	case <-timer.C:
+		s.table.failed(addr.String())
+		return nil, errors.New("query timed out")
+	case <-s.done:
+		return nil, errClosed
+	}
+}
+
+func (s *Server) send(addr net.Addr, m *msg) error {
+	b, err := encodeMsg(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(b, addr)
+	return err
+}
+
+// serve reads packets until the server is closed
+func (s *Server) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithError(err).Debugf("Error reading from dht socket")
+			continue
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if m.Y == typeQuery {
+			s.handleQuery(addr, m)
+			continue
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[m.T+addr.String()]
+		s.mu.Unlock()
+		if ok {
+			select {
+			case ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+// handleQuery answers a query from another node
+func (s *Server) handleQuery(addr *net.UDPAddr, m *msg) {
+	var id ID
+	copy(id[:], m.A.ID)
+	r := &returns{ID: string(s.id[:])}
+
+	switch m.Q {
+	case methodPing:
+
+	case methodFindNode:
+		if len(m.A.Target) != len(ID{}) {
+			s.send(addr, errorMsg(m.T, errProtocol, "invalid target"))
+			return
+		}
+		var target ID
+		copy(target[:], m.A.Target)
+		s.closestNodes(r, target, addr, m.A.Want)
+
+	case methodGetPeers:
+		if len(m.A.InfoHash) != len(ID{}) {
+			s.send(addr, errorMsg(m.T, errProtocol, "invalid info_hash"))
+			return
+		}
+		var infoHash ID
+		copy(infoHash[:], m.A.InfoHash)
+		r.Token = s.token(addr.IP, s.currentSecret())
+		r.Values = s.peers(infoHash, addr.IP.To4() == nil)
+		s.closestNodes(r, infoHash, addr, m.A.Want)
+
+	case methodAnnouncePeer:
+		if len(m.A.InfoHash) != len(ID{}) {
+			s.send(addr, errorMsg(m.T, errProtocol, "invalid info_hash"))
+			return
+		}
+		if !s.validToken(addr.IP, m.A.Token) {
+			s.send(addr, errorMsg(m.T, errProtocol, "bad token"))
+			return
+		}
+
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			s.send(addr, errorMsg(m.T, errProtocol, "invalid port"))
+			return
+		}
+		var infoHash ID
+		copy(infoHash[:], m.A.InfoHash)
+		s.addPeer(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+
+	default:
+		s.send(addr, errorMsg(m.T, errMethodUnknown, "method unknown"))
+		return
+	}
+
+	s.table.add(node{id: id, addr: addr})
+	s.send(addr, &msg{T: m.T, Y: typeResponse, R: r, V: version})
+}
+
+// maintain rotates the token secret and refreshes the routing table until the server is closed
+func (s *Server) maintain() {
+	rotate := time.NewTicker(tokenRotation)
+	defer rotate.Stop()
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-rotate.C:
+			s.mu.Lock()
+			s.prevSecret, s.secret = s.secret, newSecret()
+			s.mu.Unlock()
+		case <-refresh.C:
+			s.refresh()
+		}
+	}
+}
+
+// refresh pings nodes we have not heard from in a while, looks up a random id in every stale bucket,
+// and forgets expired peers
+func (s *Server) refresh() {
+	for _, n := range s.table.questionable() {
+		go s.query(n.addr, methodPing, &args{})
+	}
+	for _, i := range s.table.stale() {
+		go s.lookup(s.table.randomID(i), methodFindNode, nil, nil)
+	}
+	if s.table.len() == 0 && len(s.bootstrap) > 0 {
+		go s.Bootstrap()
+	}
+
+	s.mu.Lock()
+	for infoHash, ps := range s.store {
+		for addr, p := range ps {
+			if time.Since(p.added) > peerExpiry {
+				delete(ps, addr)
+			}
+		}
+		if len(ps) == 0 {
+			delete(s.store, infoHash)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// closestNodes fills in the nodes closest to the target. Nodes of the address families in want are sent,
+// without want it's the family the query came from
+func (s *Server) closestNodes(r *returns, target ID, addr *net.UDPAddr, want []string) {
+	if len(want) == 0 {
+		want = []string{want4}
+		if addr.IP.To4() == nil {
+			want = []string{want6}
+		}
+	}
+
+	// The table has both kinds mixed together
+	var ns, ns6 []node
+	for _, n := range s.table.closest(target, s.table.len()) {
+		if n.addr.IP.To4() != nil {
+			ns = append(ns, n)
+		} else {
+			ns6 = append(ns6, n)
+		}
+	}
+	if len(ns) > K {
+		ns = ns[:K]
+	}
+	if len(ns6) > K {
+		ns6 = ns6[:K]
+	}
+
+	for _, w := range want {
+		switch w {
+		case want4:
+			r.Nodes = marshalNodes(ns)
+		case want6:
+			r.Nodes6 = marshalNodes6(ns6)
+		}
+	}
+}
+
+func (s *Server) addPeer(infoHash ID, p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store[infoHash] == nil {
+		s.store[infoHash] = map[string]storedPeer{}
+	}
+	s.store[infoHash][p.String()] = storedPeer{peer: p, added: time.Now()}
+}
+
+// peers returns the stored peers of an info hash as compact values, IPv4 or IPv6 ones
+func (s *Server) peers(infoHash ID, ipv6 bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var values []string
+	for _, p := range s.store[infoHash] {
+		if len(values) == maxValues {
+			break
+		}
+		compact, compact6 := peers.Marshal([]peers.Peer{p.peer})
+		if ipv6 {
+			compact = compact6
+		}
+		if len(compact) > 0 {
+			values = append(values, string(compact))
+		}
+	}
+	return values
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return secret
+}
+
+func (s *Server) currentSecret() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secret
+}
+
+// token is what a node with the ip has to send back to announce to us
+func (s *Server) token(ip net.IP, secret []byte) string {
+	h := sha1.New()
+	h.Write(ip.To16())
+	h.Write(secret)
+	return string(h.Sum(nil)[:8])
+}
+
+// validToken checks a token against the current and the previous secret
+func (s *Server) validToken(ip net.IP, token string) bool {
+	s.mu.Lock()
+	secret, prev := s.secret, s.prevSecret
+	s.mu.Unlock()
+	return token == s.token(ip, secret) || token == s.token(ip, prev)
+}
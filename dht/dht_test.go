@@ -0,0 +1,228 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/utp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNetwork starts n nodes on loopback that all bootstrap off the first one
+func testNetwork(t *testing.T, n int) []*Server {
+	return testNetworkOn(t, "127.0.0.1:0", n)
+}
+
+// testNetworkOn is testNetwork with servers listening on addr
+func testNetworkOn(t *testing.T, addr string, n int) []*Server {
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		cfg := Config{Addr: addr}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{servers[0].Addr().String()}
+		}
+		s, err := New(cfg)
+		require.Nil(t, err)
+		t.Cleanup(func() { s.Close() })
+		servers = append(servers, s)
+	}
+
+	for _, s := range servers[1:] {
+		require.Nil(t, s.Bootstrap())
+	}
+	return servers
+}
+
+func collect(ch <-chan peers.Peer) []string {
+	var found []string
+	for p := range ch {
+		found = append(found, p.String())
+	}
+	return found
+}
+
+func TestBootstrap(t *testing.T) {
+	servers := testNetwork(t, 10)
+
+	// The first node learns about everyone through their queries, the rest through lookups
+	assert.Equal(t, 9, servers[0].Nodes())
+	for _, s := range servers[1:] {
+		assert.Greater(t, s.Nodes(), 1)
+	}
+
+	lonely, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer lonely.Close()
+	assert.NotNil(t, lonely.Bootstrap())
+}
+
+func TestPing(t *testing.T) {
+	servers := testNetwork(t, 2)
+
+	id, err := servers[1].Ping(servers[0].Addr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	assert.Equal(t, servers[0].ID(), id)
+
+	defer func(timeout time.Duration) { queryTimeout = timeout }(queryTimeout)
+	queryTimeout = 100 * time.Millisecond
+
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer dead.Close()
+	_, err = servers[0].Ping(dead.LocalAddr().(*net.UDPAddr))
+	assert.NotNil(t, err)
+}
+
+func TestSharedSocket(t *testing.T) {
+	servers := testNetwork(t, 1)
+
+	// The DHT gets the packets that aren't uTP
+	sock, err := utp.Listen("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer sock.Close()
+	s, err := New(Config{Conn: sock.PacketConn()})
+	require.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, sock.Addr(), s.Addr())
+
+	id, err := servers[0].Ping(s.Addr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	assert.Equal(t, s.ID(), id)
+	id, err = s.Ping(servers[0].Addr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	assert.Equal(t, servers[0].ID(), id)
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	servers := testNetwork(t, 12)
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+
+	assert.Empty(t, collect(servers[5].GetPeers(infoHash)))
+
+	assert.Empty(t, collect(servers[3].Announce(infoHash, 6881)))
+	collect(servers[4].Announce(infoHash, 6882))
+
+	// Announces are fired off once the lookup is done, give them a moment to land
+	assert.Eventually(t, func() bool {
+		return len(collect(servers[9].GetPeers(infoHash))) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"127.0.0.1:6881", "127.0.0.1:6882"}, collect(servers[9].GetPeers(infoHash)))
+
+	// Announcing again finds the other peer
+	assert.Contains(t, collect(servers[3].Announce(infoHash, 6881)), "127.0.0.1:6882")
+}
+
+func TestIPv6(t *testing.T) {
+	servers := testNetworkOn(t, "[::1]:0", 8)
+	infoHash := [20]byte{0xca, 0xfe}
+
+	collect(servers[2].Announce(infoHash, 6881))
+	assert.Eventually(t, func() bool {
+		return len(collect(servers[6].GetPeers(infoHash))) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"[::1]:6881"}, collect(servers[6].GetPeers(infoHash)))
+
+	// The IPv6 nodes only go out to queries that want them
+	conn, err := net.ListenPacket("udp", "[::1]:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	tests := map[string]struct {
+		want   []string
+		nodes6 bool
+	}{
+		"Family of the query": {nodes6: true},
+		"Only n4":             {want: []string{want4}},
+		"Both":                {want: []string{want4, want6}, nodes6: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := encodeMsg(&msg{T: "tt", Y: typeQuery, Q: methodFindNode,
+				A: &args{ID: string(make([]byte, 20)), Target: string(infoHash[:]), Want: test.want}})
+			require.Nil(t, err)
+			_, err = conn.WriteTo(b, servers[0].Addr())
+			require.Nil(t, err)
+
+			buf := make([]byte, maxPacketSize)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			require.Nil(t, err)
+			m, err := decodeMsg(buf[:n])
+			require.Nil(t, err)
+
+			// Every node in the table is IPv6, so n4 comes back empty
+			assert.Empty(t, m.R.Nodes)
+			ns, err := unmarshalNodes6(m.R.Nodes6)
+			require.Nil(t, err)
+			assert.Equal(t, test.nodes6, len(ns) > 0)
+		})
+	}
+}
+
+func TestHandleQuery(t *testing.T) {
+	servers := testNetwork(t, 1)
+	s := servers[0]
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	id := string(make([]byte, 20))
+	infoHash := "aaaaaaaaaaaaaaaaaaaa"
+
+	roundTrip := func(q string, a *args) *msg {
+		b, err := encodeMsg(&msg{T: "tt", Y: typeQuery, Q: q, A: a})
+		require.Nil(t, err)
+		_, err = conn.WriteTo(b, s.Addr())
+		require.Nil(t, err)
+
+		buf := make([]byte, maxPacketSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		m, err := decodeMsg(buf[:n])
+		require.Nil(t, err)
+		assert.Equal(t, "tt", m.T)
+		return m
+	}
+
+	m := roundTrip(methodPing, &args{ID: id})
+	assert.Equal(t, string(s.id[:]), m.R.ID)
+
+	m = roundTrip("vote", &args{ID: id})
+	assert.Equal(t, errMethodUnknown, m.parseError().Code)
+
+	m = roundTrip(methodFindNode, &args{ID: id, Target: "short"})
+	assert.Equal(t, errProtocol, m.parseError().Code)
+
+	m = roundTrip(methodAnnouncePeer, &args{ID: id, InfoHash: infoHash, Port: 1, Token: "made up"})
+	assert.Equal(t, Error{Code: errProtocol, Message: "bad token"}, m.parseError())
+
+	// A real token works, and implied_port uses the port the query came from
+	m = roundTrip(methodGetPeers, &args{ID: id, InfoHash: infoHash})
+	assert.Empty(t, m.R.Values)
+	token := m.R.Token
+
+	m = roundTrip(methodAnnouncePeer, &args{ID: id, InfoHash: infoHash, Port: 1, ImpliedPort: 1, Token: token})
+	assert.Equal(t, typeResponse, m.Y)
+
+	m = roundTrip(methodGetPeers, &args{ID: id, InfoHash: infoHash})
+	require.Len(t, m.R.Values, 1)
+	ps, err := peers.Unmarshal([]byte(m.R.Values[0]))
+	require.Nil(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), ps[0].String())
+
+	// Tokens survive one rotation but not two
+	s.mu.Lock()
+	s.prevSecret, s.secret = s.secret, newSecret()
+	s.mu.Unlock()
+	m = roundTrip(methodAnnouncePeer, &args{ID: id, InfoHash: infoHash, Port: 2, Token: token})
+	assert.Equal(t, typeResponse, m.Y)
+
+	s.mu.Lock()
+	s.prevSecret, s.secret = s.secret, newSecret()
+	s.mu.Unlock()
+	m = roundTrip(methodAnnouncePeer, &args{ID: id, InfoHash: infoHash, Port: 3, Token: token})
+	assert.Equal(t, typeError, m.Y)
+}
@@ -0,0 +1,246 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+
+	"github.com/zeebo/bencode"
+)
+
+// https://www.bittorrent.org/beps/bep_0005.html
+
+// KRPC message types
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// Query methods
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// version is sent with every message, two bytes of client id and two of version
+const version = "SQ\x00\x01"
+
+// compactNodeLen is the size of a node in a nodes string, 20 byte id followed by a compact address.
+// IPv6 nodes go in nodes6 (BEP 32)
+const (
+	compactNodeLen  = 26
+	compactNode6Len = 38
+)
+
+// Address families for the want argument
+const (
+	want4 = "n4"
+	want6 = "n6"
+)
+
+// msg is a single KRPC message, queries fill in A, responses R and errors E
+type msg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *args         `bencode:"a,omitempty"`
+	R *returns      `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"` // [code, message]
+	V string        `bencode:"v,omitempty"`
+}
+
+// args are the arguments of every query type combined
+type args struct {
+	ID          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"` // Address families of the nodes to send back
+}
+
+// returns are the values of every response type combined
+type returns struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	Values []string `bencode:"values,omitempty"` // Compact peers, one per string
+}
+
+// Error is an error response sent by a remote node
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("krpc error %v: %v", e.Code, e.Message)
+}
+
+func encodeMsg(m *msg) ([]byte, error) {
+	return bencode.EncodeBytes(m)
+}
+
+func decodeMsg(b []byte) (*msg, error) {
+	var m msg
+	if err := bencode.DecodeBytes(b, &m); err != nil {
+		return nil, err
+	}
+	if m.T == "" {
+		return nil, fmt.Errorf("message has no transaction id")
+	}
+
+	switch m.Y {
+	case typeQuery:
+		if m.A == nil || len(m.A.ID) != len(ID{}) {
+			return nil, fmt.Errorf("query has no valid node id")
+		}
+	case typeResponse:
+		if m.R == nil || len(m.R.ID) != len(ID{}) {
+			return nil, fmt.Errorf("response has no valid node id")
+		}
+	case typeError:
+	default:
+		return nil, fmt.Errorf("unknown message type %q", m.Y)
+	}
+	return &m, nil
+}
+
+// errorMsg builds the error response to a query
+func errorMsg(t string, code int, message string) *msg {
+	return &msg{T: t, Y: typeError, E: []interface{}{code, message}, V: version}
+}
+
+// parseError converts the e list of an error response
+func (m *msg) parseError() Error {
+	e := Error{Code: errGeneric, Message: "malformed error"}
+	if len(m.E) != 2 {
+		return e
+	}
+	if code, ok := m.E[0].(int64); ok {
+		e.Code = int(code)
+	}
+	if message, ok := m.E[1].(string); ok {
+		e.Message = message
+	}
+	return e
+}
+
+// ID is a node id. Info hashes live in the same 160 bit space
+type ID [20]byte
+
+// RandomID generates a random node id
+func RandomID() (ID, error) {
+	var id ID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// closer is true when a is closer to the target than b
+func closer(target, a, b ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix is the number of leading bits two ids share
+func commonPrefix(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// node is a remote node in the network
+type node struct {
+	id   ID
+	addr *net.UDPAddr
+}
+
+// marshalNodes encodes nodes in the compact node info format, IPv6 nodes are skipped
+func marshalNodes(ns []node) string {
+	return marshalCompactNodes(ns, net.IPv4len)
+}
+
+// marshalNodes6 encodes the IPv6 nodes for nodes6
+func marshalNodes6(ns []node) string {
+	return marshalCompactNodes(ns, net.IPv6len)
+}
+
+func marshalCompactNodes(ns []node, ipLen int) string {
+	b := make([]byte, 0, len(ns)*compactNode6Len)
+	for _, n := range ns {
+		ip := n.addr.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = n.addr.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		b = append(b, n.id[:]...)
+		b = append(b, ip...)
+		b = append(b, byte(n.addr.Port>>8), byte(n.addr.Port))
+	}
+	return string(b)
+}
+
+// unmarshalNodes decodes a compact node info string
+func unmarshalNodes(s string) ([]node, error) {
+	return unmarshalCompactNodes(s, net.IPv4len)
+}
+
+// unmarshalNodes6 decodes a nodes6 string
+func unmarshalNodes6(s string) ([]node, error) {
+	return unmarshalCompactNodes(s, net.IPv6len)
+}
+
+func unmarshalCompactNodes(s string, ipLen int) ([]node, error) {
+	size := compactNodeLen
+	if ipLen == net.IPv6len {
+		size = compactNode6Len
+	}
+	if len(s)%size != 0 {
+		return nil, fmt.Errorf("received malformed nodes")
+	}
+
+	ns := make([]node, 0, len(s)/size)
+	for i := 0; i < len(s); i += size {
+		var n node
+		copy(n.id[:], s[i:i+20])
+		n.addr = &net.UDPAddr{
+			IP:   net.IP([]byte(s[i+20 : i+20+ipLen])),
+			Port: int(binary.BigEndian.Uint16([]byte(s[i+20+ipLen : i+size]))),
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
@@ -0,0 +1,142 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMsg(t *testing.T) {
+	id := "abcdefghij0123456789"
+
+	tests := map[string]struct {
+		input  string
+		output *msg
+		fails  bool
+	}{
+		"ping query": {
+			input:  "d1:ad2:id20:" + id + "e1:q4:ping1:t2:aa1:y1:qe",
+			output: &msg{T: "aa", Y: typeQuery, Q: methodPing, A: &args{ID: id}},
+		},
+		"get_peers response": {
+			input: "d1:rd2:id20:" + id + "5:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+			output: &msg{T: "aa", Y: typeResponse, R: &returns{
+				ID:     id,
+				Token:  "aoeusnth",
+				Values: []string{"axje.u", "idhtnm"},
+			}},
+		},
+		"error": {
+			input:  "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+			output: &msg{T: "aa", Y: typeError, E: []interface{}{int64(201), "A Generic Error Ocurred"}},
+		},
+		"query without id": {
+			input: "d1:ade1:q4:ping1:t2:aa1:y1:qe",
+			fails: true,
+		},
+		"response with short id": {
+			input: "d1:rd2:id3:abce1:t2:aa1:y1:re",
+			fails: true,
+		},
+		"no transaction id": {
+			input: "d1:ad2:id20:" + id + "e1:q4:ping1:y1:qe",
+			fails: true,
+		},
+		"unknown type": {
+			input: "d1:t2:aa1:y1:xe",
+			fails: true,
+		},
+		"not bencode": {
+			input: "nope",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := decodeMsg([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestEncodeMsg(t *testing.T) {
+	b, err := encodeMsg(&msg{T: "aa", Y: typeQuery, Q: methodFindNode, A: &args{ID: "abcdefghij0123456789", Target: "mnopqrstuvwxyz123456"}})
+	require.Nil(t, err)
+	assert.Equal(t, "d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe", string(b))
+
+	m, err := decodeMsg(b)
+	require.Nil(t, err)
+	assert.Equal(t, "mnopqrstuvwxyz123456", m.A.Target)
+}
+
+func TestParseError(t *testing.T) {
+	m := errorMsg("aa", errProtocol, "bad token")
+	b, err := encodeMsg(m)
+	require.Nil(t, err)
+
+	decoded, err := decodeMsg(b)
+	require.Nil(t, err)
+	assert.Equal(t, Error{Code: errProtocol, Message: "bad token"}, decoded.parseError())
+	assert.Equal(t, Error{Code: errGeneric, Message: "malformed error"}, (&msg{E: []interface{}{"x"}}).parseError())
+}
+
+func TestNodes(t *testing.T) {
+	ns := []node{
+		{id: ID{1}, addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+		{id: ID{2}, addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6882}}, // Only in nodes6
+		{id: ID{3}, addr: &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1}},
+	}
+
+	s := marshalNodes(ns)
+	assert.Len(t, s, 2*compactNodeLen)
+
+	decoded, err := unmarshalNodes(s)
+	require.Nil(t, err)
+	require.Len(t, decoded, 2)
+	assert.Equal(t, ID{1}, decoded[0].id)
+	assert.Equal(t, "127.0.0.1:6881", decoded[0].addr.String())
+	assert.Equal(t, ID{3}, decoded[1].id)
+	assert.Equal(t, "10.0.0.1:1", decoded[1].addr.String())
+
+	_, err = unmarshalNodes(s[:30])
+	assert.NotNil(t, err)
+
+	// IPv6 nodes go in nodes6
+	s = marshalNodes6(ns)
+	assert.Len(t, s, compactNode6Len)
+	decoded, err = unmarshalNodes6(s)
+	require.Nil(t, err)
+	require.Len(t, decoded, 1)
+	assert.Equal(t, ID{2}, decoded[0].id)
+	assert.Equal(t, "[::1]:6882", decoded[0].addr.String())
+
+	_, err = unmarshalNodes6(s[:30])
+	assert.NotNil(t, err)
+}
+
+func TestDistance(t *testing.T) {
+	tests := map[string]struct {
+		a, b   ID
+		prefix int
+	}{
+		"same":        {a: ID{0xff}, b: ID{0xff}, prefix: 160},
+		"first bit":   {a: ID{0x80}, b: ID{0x00}, prefix: 0},
+		"fourth bit":  {a: ID{0xf0}, b: ID{0xe0}, prefix: 3},
+		"second byte": {a: ID{0x01, 0x01}, b: ID{0x01, 0x00}, prefix: 15},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.prefix, commonPrefix(test.a, test.b), name)
+	}
+
+	target := ID{0x10}
+	assert.True(t, closer(target, ID{0x11}, ID{0x20}))
+	assert.False(t, closer(target, ID{0x20}, ID{0x11}))
+	assert.False(t, closer(target, ID{0x11}, ID{0x11}))
+}
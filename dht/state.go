@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/bencode"
+)
+
+// state is saved between runs so a restart can rejoin the network through the nodes it already knew
+type state struct {
+	ID     string `bencode:"id"`
+	Nodes  string `bencode:"nodes"` // Compact node info of the good nodes in the routing table
+	Nodes6 string `bencode:"nodes6,omitempty"`
+}
+
+// loadState reads a state file, a file that does not exist yet gives an empty state
+func loadState(path string) (*state, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &state{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st state
+	if err := bencode.DecodeBytes(b, &st); err != nil {
+		return nil, err
+	}
+	if st.ID != "" && len(st.ID) != len(ID{}) {
+		return nil, errors.New("state file has an invalid node id")
+	}
+	return &st, nil
+}
+
+// saveState writes our id and the good nodes to the state file. It goes through a temp file
+// so a crash while writing never leaves a broken state behind
+func (s *Server) saveState() error {
+	good := s.table.good()
+	b, err := bencode.EncodeBytes(state{
+		ID:     string(s.id[:]),
+		Nodes:  marshalNodes(good),
+		Nodes6: marshalNodes6(good),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.stateFile), 0755); err != nil {
+		return err
+	}
+	tmp := s.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.stateFile)
+}
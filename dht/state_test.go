@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState(t *testing.T) {
+	servers := testNetwork(t, 5)
+	path := filepath.Join(t.TempDir(), "nested", "dht.dat")
+
+	s, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{servers[0].Addr().String()}, StateFile: path})
+	require.Nil(t, err)
+	require.Nil(t, s.Bootstrap())
+	nodes := s.Nodes()
+	require.Nil(t, s.Close())
+
+	st, err := loadState(path)
+	require.Nil(t, err)
+	assert.Equal(t, string(s.id[:]), st.ID)
+	assert.Len(t, st.Nodes, nodes*compactNodeLen)
+
+	// Coming back with no bootstrap nodes works off the saved ones, with the same id
+	restarted, err := New(Config{Addr: "127.0.0.1:0", StateFile: path})
+	require.Nil(t, err)
+	defer restarted.Close()
+	assert.Equal(t, s.ID(), restarted.ID())
+	assert.Nil(t, restarted.Bootstrap())
+	assert.Greater(t, restarted.Nodes(), 0)
+}
+
+func TestStateFallback(t *testing.T) {
+	defer func(timeout time.Duration) { queryTimeout = timeout }(queryTimeout)
+	queryTimeout = 100 * time.Millisecond
+
+	servers := testNetwork(t, 2)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	// Every saved node is gone, so the bootstrap nodes get used
+	dead, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	dead.Close()
+
+	s, err := New(Config{Addr: "127.0.0.1:0", StateFile: path})
+	require.Nil(t, err)
+	s.table.add(testNode(dead.ID(), dead.Addr().(*net.UDPAddr).Port))
+	require.Nil(t, s.Close())
+
+	s, err = New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{servers[0].Addr().String()}, StateFile: path})
+	require.Nil(t, err)
+	defer s.Close()
+	require.Len(t, s.saved, 1)
+	assert.Nil(t, s.Bootstrap())
+	assert.Equal(t, 2, s.Nodes())
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+
+	st, err := loadState(filepath.Join(dir, "missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, &state{}, st)
+
+	bad := filepath.Join(dir, "bad")
+	require.Nil(t, ioutil.WriteFile(bad, []byte("d2:id3:abce"), 0644))
+	_, err = loadState(bad)
+	assert.NotNil(t, err)
+
+	// Broken files are ignored and replaced on close
+	s, err := New(Config{Addr: "127.0.0.1:0", StateFile: bad})
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	st, err = loadState(bad)
+	assert.Nil(t, err)
+	assert.Equal(t, string(s.id[:]), st.ID)
+}
@@ -0,0 +1,220 @@
+package dht
+
+import (
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the number of nodes in a bucket, and how many of the closest nodes a lookup settles on
+	K = 8
+
+	numBuckets = 160
+
+	// goodTimeout is how long a node stays good after we last heard from it
+	goodTimeout = 15 * time.Minute
+
+	// maxFailures is how many queries in a row a node can fail before it gets dropped
+	maxFailures = 2
+)
+
+// entry is a node in the routing table
+type entry struct {
+	node
+	lastSeen time.Time
+	failures int
+}
+
+type bucket struct {
+	entries     []*entry // Least recently seen first
+	lastChanged time.Time
+}
+
+// table is a Kademlia routing table. Bucket i holds the nodes that share exactly i leading bits with our id,
+// which keeps many nodes close to us and few far away
+type table struct {
+	self ID
+
+	mu      sync.Mutex
+	buckets [numBuckets]bucket
+}
+
+func newTable(self ID) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].lastChanged = now
+	}
+	return t
+}
+
+func (t *table) bucketIndex(id ID) int {
+	i := commonPrefix(t.self, id)
+	if i >= numBuckets {
+		i = numBuckets - 1
+	}
+	return i
+}
+
+// add records that we heard from a node. New nodes only get in when their bucket has room,
+// nodes already in the table move to the back of their bucket
+func (t *table) add(n node) bool {
+	if n.id == t.self || n.addr == nil || n.addr.Port == 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[t.bucketIndex(n.id)]
+	for i, e := range b.entries {
+		if e.id != n.id {
+			continue
+		}
+		// Someone else claiming a known id from another address is ignored
+		if !e.addr.IP.Equal(n.addr.IP) || e.addr.Port != n.addr.Port {
+			return false
+		}
+		e.lastSeen = time.Now()
+		e.failures = 0
+		b.entries = append(append(b.entries[:i], b.entries[i+1:]...), e)
+		b.lastChanged = e.lastSeen
+		return true
+	}
+
+	if len(b.entries) >= K {
+		return false
+	}
+	b.entries = append(b.entries, &entry{node: n, lastSeen: time.Now()})
+	b.lastChanged = time.Now()
+	return true
+}
+
+// failed records a query to the address that went unanswered, the node is dropped after too many
+func (t *table) failed(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for bi := range t.buckets {
+		b := &t.buckets[bi]
+		for i, e := range b.entries {
+			if e.addr.String() != addr {
+				continue
+			}
+			e.failures++
+			if e.failures >= maxFailures {
+				b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes closest to the target, closest first
+func (t *table) closest(target ID, n int) []node {
+	ns := t.nodes()
+	sort.Slice(ns, func(i, j int) bool {
+		return closer(target, ns[i].id, ns[j].id)
+	})
+	if len(ns) > n {
+		ns = ns[:n]
+	}
+	return ns
+}
+
+// nodes returns every node in the table
+func (t *table) nodes() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ns []node
+	for _, b := range t.buckets {
+		for _, e := range b.entries {
+			ns = append(ns, e.node)
+		}
+	}
+	return ns
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.entries)
+	}
+	return n
+}
+
+// good returns the nodes that answered recently and have not failed since
+func (t *table) good() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ns []node
+	for _, b := range t.buckets {
+		for _, e := range b.entries {
+			if e.failures == 0 && time.Since(e.lastSeen) <= goodTimeout {
+				ns = append(ns, e.node)
+			}
+		}
+	}
+	return ns
+}
+
+// questionable returns the nodes we have not heard from in a while, they need to be pinged
+func (t *table) questionable() []node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ns []node
+	for _, b := range t.buckets {
+		for _, e := range b.entries {
+			if time.Since(e.lastSeen) > goodTimeout {
+				ns = append(ns, e.node)
+			}
+		}
+	}
+	return ns
+}
+
+// stale returns the buckets that have not changed in a while, up to the deepest bucket in use.
+// They count as changed from here on, since the caller is about to refresh them
+func (t *table) stale() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deepest := -1
+	for i, b := range t.buckets {
+		if len(b.entries) > 0 {
+			deepest = i
+		}
+	}
+
+	var stale []int
+	for i := 0; i <= deepest; i++ {
+		if time.Since(t.buckets[i].lastChanged) > goodTimeout {
+			stale = append(stale, i)
+			t.buckets[i].lastChanged = time.Now()
+		}
+	}
+	return stale
+}
+
+// randomID returns a random id that falls into bucket i
+func (t *table) randomID(i int) ID {
+	var id ID
+	rand.Read(id[:])
+
+	// Copy the shared prefix, then flip the bit after it
+	for b := 0; b < i; b++ {
+		mask := byte(0x80 >> (b % 8))
+		id[b/8] = id[b/8]&^mask | t.self[b/8]&mask
+	}
+	mask := byte(0x80 >> (i % 8))
+	id[i/8] = id[i/8]&^mask | ^t.self[i/8]&mask
+	return id
+}
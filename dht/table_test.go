@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNode(id ID, port int) node {
+	return node{id: id, addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port}}
+}
+
+func TestTableAdd(t *testing.T) {
+	tb := newTable(ID{})
+
+	// Every id with the first bit set lands in bucket 0
+	for i := 0; i < K; i++ {
+		assert.True(t, tb.add(testNode(ID{0x80, byte(i)}, 1000+i)))
+	}
+	assert.False(t, tb.add(testNode(ID{0x80, 0xff}, 2000)), "bucket is full")
+	assert.True(t, tb.add(testNode(ID{0x40}, 2001)), "other buckets have room")
+
+	assert.False(t, tb.add(testNode(ID{}, 2002)), "our own id")
+	assert.False(t, tb.add(testNode(ID{0x20}, 0)), "no port")
+	assert.False(t, tb.add(testNode(ID{0x80, 0}, 3000)), "known id from another address")
+	assert.Equal(t, K+1, tb.len())
+
+	// Seeing a node again moves it to the back of its bucket
+	assert.True(t, tb.add(testNode(ID{0x80, 0}, 1000)))
+	b := tb.buckets[0].entries
+	assert.Equal(t, ID{0x80, 0}, b[len(b)-1].id)
+}
+
+func TestTableFailed(t *testing.T) {
+	tb := newTable(ID{})
+	tb.add(testNode(ID{0x80}, 1000))
+
+	tb.failed("127.0.0.1:1000")
+	assert.Equal(t, 1, tb.len())
+	tb.add(testNode(ID{0x80}, 1000)) // Answering resets the count
+	tb.failed("127.0.0.1:1000")
+	assert.Equal(t, 1, tb.len())
+	tb.failed("127.0.0.1:1000")
+	assert.Equal(t, 0, tb.len())
+}
+
+func TestTableClosest(t *testing.T) {
+	tb := newTable(ID{})
+	for i := 1; i <= 20; i++ {
+		tb.add(testNode(ID{byte(i)}, 1000+i))
+	}
+
+	closest := tb.closest(ID{0x07}, 3)
+	assert.Equal(t, []ID{{0x07}, {0x06}, {0x05}}, []ID{closest[0].id, closest[1].id, closest[2].id})
+	assert.Len(t, tb.closest(ID{}, 100), 20)
+}
+
+func TestTableRefresh(t *testing.T) {
+	tb := newTable(ID{0xaa})
+	tb.add(testNode(ID{0x2a}, 1000)) // Bucket 0
+	tb.add(testNode(ID{0xab}, 1001)) // Bucket 7
+
+	assert.Empty(t, tb.stale())
+	assert.Empty(t, tb.questionable())
+
+	old := time.Now().Add(-2 * goodTimeout)
+	for i := range tb.buckets {
+		tb.buckets[i].lastChanged = old
+	}
+	tb.buckets[0].entries[0].lastSeen = old
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, tb.stale())
+	assert.Empty(t, tb.stale(), "buckets being refreshed are not stale anymore")
+	assert.Len(t, tb.questionable(), 1)
+
+	for _, i := range []int{0, 5, 17, 159} {
+		assert.Equal(t, i, tb.bucketIndex(tb.randomID(i)), i)
+	}
+}
@@ -0,0 +1,261 @@
+package extension
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/zeebo/bencode"
+)
+
+// https://www.bittorrent.org/beps/bep_0010.html
+
+// HandshakeID is the extended message id of the extended handshake, every other id is negotiated in it
+const HandshakeID uint8 = 0
+
+// DefaultVersion is sent as the client name and version in the extended handshake
+const DefaultVersion = "squidtorrent 0.1"
+
+// Handshake is the first extended message that is sent after the BitTorrent handshake
+type Handshake struct {
+	M            map[string]int `bencode:"m"`                       // Extension names to the ids the sender wants them on, 0 disables
+	V            string         `bencode:"v,omitempty"`             // Client name and version
+	P            int            `bencode:"p,omitempty"`             // Port the sender listens on
+	Reqq         int            `bencode:"reqq,omitempty"`          // Number of outstanding requests the sender allows
+	YourIP       string         `bencode:"yourip,omitempty"`        // Compact address the sender sees the receiver as
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // Size of the info dictionary (BEP 9)
+}
+
+// Message bencodes the handshake into an extended message
+func (h Handshake) Message() (*message.Message, error) {
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+
+	payload, err := bencode.EncodeBytes(h)
+	if err != nil {
+		return nil, err
+	}
+	return message.FormatExtended(HandshakeID, payload), nil
+}
+
+// YourIPAddr is the address the sender sees us as, nil if it was not sent or is malformed
+func (h Handshake) YourIPAddr() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(h.YourIP)
+}
+
+// ParseHandshake decodes the payload of an extended handshake
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	var h Handshake
+	if err := bencode.DecodeBytes(payload, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// A Handler implements a single extension
+type Handler interface {
+	// Name is what the extension is called in the m dictionary, like ut_metadata
+	Name() string
+
+	// HandleMessage is called with the payload of every message the peer sends to the extension
+	HandleMessage(c *Conn, payload []byte) error
+}
+
+// HandshakeExtender is implemented by handlers that add their own keys to our extended handshake
+type HandshakeExtender interface {
+	ExtendHandshake(h *Handshake)
+}
+
+// HandshakeHandler is implemented by handlers that need to know when a peer's extended handshake arrives
+type HandshakeHandler interface {
+	HandleHandshake(c *Conn) error
+}
+
+// A Registry holds the extensions we support. Every handler is given an extended message id by the
+// order it was registered in, starting at 1
+type Registry struct {
+	Version string // Sent as v, defaults to DefaultVersion
+	Port    uint16 // Sent as p when not 0
+	Reqq    int    // Sent as reqq when not 0
+
+	handlers []Handler
+}
+
+// NewRegistry creates a registry for the handlers
+func NewRegistry(handlers ...Handler) *Registry {
+	r := &Registry{Version: DefaultVersion}
+	for _, h := range handlers {
+		r.Register(h)
+	}
+	return r
+}
+
+// Register adds an extension, it has to be done before any connections are made
+func (r *Registry) Register(h Handler) {
+	r.handlers = append(r.handlers, h)
+}
+
+// handler finds the handler for one of our extended message ids
+func (r *Registry) handler(id uint8) Handler {
+	if id == HandshakeID || int(id) > len(r.handlers) {
+		return nil
+	}
+	return r.handlers[id-1]
+}
+
+// Handshake builds our extended handshake
+func (r *Registry) Handshake() Handshake {
+	h := Handshake{
+		M:    map[string]int{},
+		V:    r.Version,
+		P:    int(r.Port),
+		Reqq: r.Reqq,
+	}
+	for i, handler := range r.handlers {
+		h.M[handler.Name()] = i + 1
+		if ext, ok := handler.(HandshakeExtender); ok {
+			ext.ExtendHandshake(&h)
+		}
+	}
+	return h
+}
+
+// Conn is the extension protocol state of a single peer connection
+type Conn struct {
+	Conn     net.Conn
+	registry *Registry
+
+	mu     sync.Mutex
+	remote *Handshake // nil until the peer's handshake arrives
+}
+
+// NewConn starts tracking the extensions of a peer connection
+func (r *Registry) NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, registry: r}
+}
+
+// SendHandshake sends our extended handshake to the peer
+func (c *Conn) SendHandshake() error {
+	h := c.registry.Handshake()
+	var ip net.IP
+	switch addr := c.Conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP // uTP
+	}
+	if ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		h.YourIP = string(ip)
+	}
+
+	msg, err := h.Message()
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// Remote is the peer's extended handshake, nil if it has not been received
+func (c *Conn) Remote() *Handshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// Supports tells if the peer has the extension enabled
+func (c *Conn) Supports(name string) bool {
+	_, ok := c.remoteID(name)
+	return ok
+}
+
+func (c *Conn) remoteID(name string) (uint8, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.remote == nil {
+		return 0, false
+	}
+	id, ok := c.remote.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0, false
+	}
+	return uint8(id), true
+}
+
+// Send sends a message to an extension of the peer, using the id the peer asked for
+func (c *Conn) Send(name string, payload []byte) error {
+	id, ok := c.remoteID(name)
+	if !ok {
+		return fmt.Errorf("peer does not support %v", name)
+	}
+	_, err := c.Conn.Write(message.FormatExtended(id, payload).Serialize())
+	return err
+}
+
+// Handle dispatches an extended message to its handler. Messages for extensions we never
+// registered are ignored
+func (c *Conn) Handle(msg *message.Message) error {
+	id, payload, err := msg.ParseExtended()
+	if err != nil {
+		return err
+	}
+
+	if id == HandshakeID {
+		return c.handleHandshake(payload)
+	}
+	if h := c.registry.handler(id); h != nil {
+		return h.HandleMessage(c, payload)
+	}
+	return nil
+}
+
+// handleHandshake records the peer's handshake. A peer can send more than one, later ones only
+// change the extensions they mention and an id of 0 turns an extension off
+func (c *Conn) handleHandshake(payload []byte) error {
+	h, err := ParseHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.remote != nil {
+		m := c.remote.M
+		for name, id := range h.M {
+			if id == 0 {
+				delete(m, name)
+			} else {
+				m[name] = id
+			}
+		}
+		h.M = m
+	} else {
+		for name, id := range h.M {
+			if id == 0 {
+				delete(h.M, name)
+			}
+		}
+	}
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+	c.remote = h
+	c.mu.Unlock()
+
+	for _, handler := range c.registry.handlers {
+		if hh, ok := handler.(HandshakeHandler); ok {
+			if err := hh.HandleHandshake(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package extension
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a handler that keeps every payload it is sent
+type recorder struct {
+	name       string
+	payloads   [][]byte
+	handshakes int
+}
+
+func (r *recorder) Name() string {
+	return r.name
+}
+
+func (r *recorder) HandleMessage(c *Conn, payload []byte) error {
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+func (r *recorder) HandleHandshake(c *Conn) error {
+	r.handshakes++
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	h := Handshake{
+		M:            map[string]int{"ut_metadata": 1, "ut_pex": 2},
+		V:            "squidtorrent 0.1",
+		P:            6881,
+		Reqq:         250,
+		YourIP:       string([]byte{10, 0, 0, 1}),
+		MetadataSize: 31235,
+	}
+	msg, err := h.Message()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgExtended, msg.ID)
+	assert.Equal(t, HandshakeID, msg.Payload[0])
+	assert.Equal(t, "d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v16:squidtorrent 0.16:yourip4:\x0a\x00\x00\x01e", string(msg.Payload[1:]))
+
+	parsed, err := ParseHandshake(msg.Payload[1:])
+	require.Nil(t, err)
+	assert.Equal(t, &h, parsed)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, parsed.YourIPAddr())
+
+	_, err = ParseHandshake([]byte("not bencode"))
+	assert.NotNil(t, err)
+}
+
+func TestRegistryHandshake(t *testing.T) {
+	r := NewRegistry(&recorder{name: "a"}, &recorder{name: "b"})
+	r.Port = 6881
+	r.Reqq = 100
+
+	assert.Equal(t, Handshake{
+		M:    map[string]int{"a": 1, "b": 2},
+		V:    DefaultVersion,
+		P:    6881,
+		Reqq: 100,
+	}, r.Handshake())
+}
+
+func TestConnHandle(t *testing.T) {
+	a, b := &recorder{name: "a"}, &recorder{name: "b"}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := NewRegistry(a, b).NewConn(local)
+
+	assert.False(t, c.Supports("a"))
+	assert.NotNil(t, c.Send("a", nil))
+
+	hs, err := Handshake{M: map[string]int{"a": 5, "c": 6}}.Message()
+	require.Nil(t, err)
+	require.Nil(t, c.Handle(hs))
+	assert.True(t, c.Supports("a"))
+	assert.False(t, c.Supports("b"))
+	assert.Equal(t, 1, a.handshakes)
+
+	// Messages go to the handler by our ids, unknown ids are dropped
+	require.Nil(t, c.Handle(message.FormatExtended(2, []byte("to b"))))
+	require.Nil(t, c.Handle(message.FormatExtended(9, []byte("to nobody"))))
+	assert.Nil(t, a.payloads)
+	assert.Equal(t, [][]byte{[]byte("to b")}, b.payloads)
+
+	// Sending uses the peer's ids
+	go c.Send("a", []byte("hi"))
+	msg, err := message.Read(remote)
+	require.Nil(t, err)
+	assert.Equal(t, message.FormatExtended(5, []byte("hi")), msg)
+
+	// Later handshakes only update what they mention
+	hs, err = Handshake{M: map[string]int{"a": 0, "b": 7}}.Message()
+	require.Nil(t, err)
+	require.Nil(t, c.Handle(hs))
+	assert.False(t, c.Supports("a"))
+	assert.True(t, c.Supports("b"))
+	assert.True(t, c.Supports("c"))
+	assert.Equal(t, 2, a.handshakes)
+}
+
+func TestSendHandshakeYourIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		NewRegistry().NewConn(conn).SendHandshake()
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	msg, err := message.Read(conn)
+	require.Nil(t, err)
+	_, payload, err := msg.ParseExtended()
+	require.Nil(t, err)
+	h, err := ParseHandshake(payload)
+	require.Nil(t, err)
+	assert.Equal(t, net.IP{127, 0, 0, 1}, h.YourIPAddr())
+	assert.Equal(t, DefaultVersion, h.V)
+}
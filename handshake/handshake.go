@@ -5,9 +5,16 @@ import (
 	"io"
 )
 
+// Bits of the reserved bytes, counted from the right, that advertise protocol extensions
+const (
+	ReservedExtensions = 20 // Extension protocol, BEP 10
+	ReservedFast       = 2  // Fast extension, BEP 6. It's reserved[7] & 0x04
+)
+
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // Extensions supported by the peer
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -28,13 +35,23 @@ func (hs Handshake) Serialize() []byte {
 	// i is current index
 	i := 1
 	i += copy(buf[i:], []byte(hs.Pstr))
-	i += copy(buf[i:], make([]byte, 8)) // 8 empty bytes, until extensions!
-	i += copy(buf[i:], hs.InfoHash[:])  // Requested file hash
-	i += copy(buf[i:], hs.PeerID[:])    // squidtorrent's peer id
+	i += copy(buf[i:], hs.Reserved[:]) // Supported extensions
+	i += copy(buf[i:], hs.InfoHash[:]) // Requested file hash
+	i += copy(buf[i:], hs.PeerID[:])   // squidtorrent's peer id
 
 	return buf
 }
 
+// SetReserved sets a reserved bit to advertise an extension
+func (hs *Handshake) SetReserved(bit int) {
+	hs.Reserved[7-bit/8] |= 1 << uint(bit%8)
+}
+
+// HasReserved tells if a reserved bit is set
+func (hs Handshake) HasReserved(bit int) bool {
+	return hs.Reserved[7-bit/8]&(1<<uint(bit%8)) != 0
+}
+
 // Read parses an incoming handshake, rather than serializing one
 func Read(r io.Reader) (*Handshake, error) {
 	protocolLength := make([]byte, 1) // First byte is length of protocol
@@ -54,13 +71,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	copy(peerID[:], handshakeBuf[pstrLen+8+20:])
 
 	return &Handshake{
 		Pstr:     string(handshakeBuf[0:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
@@ -91,3 +91,20 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestReserved(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	assert.False(t, h.HasReserved(ReservedExtensions))
+
+	h.SetReserved(ReservedExtensions)
+	assert.True(t, h.HasReserved(ReservedExtensions))
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}, h.Reserved)
+	h.SetReserved(ReservedFast)
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}, h.Reserved)
+
+	// Reserved bytes survive a round trip
+	parsed, err := Read(bytes.NewReader(h.Serialize()))
+	assert.Nil(t, err)
+	assert.True(t, parsed.HasReserved(ReservedExtensions))
+	assert.True(t, parsed.HasReserved(ReservedFast))
+}
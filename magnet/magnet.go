@@ -1,24 +1,366 @@
 package magnet
 
 import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
 	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/torrentfile"
+	"github.com/sirupsen/logrus"
+)
+
+// https://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+
+const (
+	btihPrefix = "urn:btih:" // v1 infohash, hex or base32
+	btmhPrefix = "urn:btmh:" // v2 infohash as a multihash
+
+	// sha256Multihash is the multihash prefix of a sha2-256 hash, the only kind a v2 torrent uses
+	sha256Multihash = "1220"
+
+	// maxFileIndex and maxSelectOnly keep a select only list from expanding into something silly, the
+	// second one counts every index of every range
+	maxFileIndex  = 1 << 20
+	maxSelectOnly = 1 << 16
+
+	// unknownLeft is announced while the length is unknown, trackers take a left of 0 for a seed and
+	// don't bother handing it other seeds
+	unknownLeft = 1
 )
 
 type Magnet struct {
-	InfoHash [20]byte
-	Name     string
-	Trackers [][]string
-	Peers    []peers.Peer
+	InfoHash   [20]byte // Zero for v2 only magnets
+	InfoHashV2 [32]byte // Zero for v1 only magnets
+	Name       string
+	Length     int64      // Exact length of the torrent, 0 if unknown
+	Trackers   [][]string // Each tr is its own tier, tried in the order they are given
+	Peers      []string   // x.pe addresses as host:port, host names get resolved once we connect
+	WebSeeds   []string
+	SelectOnly []int // Indexes of the files to download (BEP 53), empty means all of them
 }
 
 // New parses a magnet url and returns a magnet object
-// func New(s string) (*Magnet, error) {
-// 	uri, err := url.Parse(s)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	if uri.Scheme != "magnet" {
-// 		return nil, fmt.Errorf("expected scheme 'magnet' but got %v", uri.Scheme)
-// 	}
-// }
+func New(s string) (*Magnet, error) {
+	uri, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected scheme 'magnet' but got %v", uri.Scheme)
+	}
+
+	params, err := url.ParseQuery(uri.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Magnet
+	var v1, v2 bool
+	for _, xt := range params["xt"] {
+		switch {
+		case strings.HasPrefix(xt, btihPrefix):
+			if m.InfoHash, err = parseBTIH(strings.TrimPrefix(xt, btihPrefix)); err != nil {
+				return nil, err
+			}
+			v1 = true
+		case strings.HasPrefix(xt, btmhPrefix):
+			if m.InfoHashV2, err = parseBTMH(strings.TrimPrefix(xt, btmhPrefix)); err != nil {
+				return nil, err
+			}
+			v2 = true
+		}
+	}
+	if !v1 && !v2 {
+		return nil, fmt.Errorf("magnet has no urn:btih or urn:btmh exact topic")
+	}
+
+	m.Name = params.Get("dn")
+
+	if xl := params.Get("xl"); xl != "" {
+		if m.Length, err = strconv.ParseInt(xl, 10, 64); err != nil || m.Length < 0 {
+			return nil, fmt.Errorf("invalid exact length %q", xl)
+		}
+	}
+
+	for _, tr := range params["tr"] {
+		m.Trackers = append(m.Trackers, []string{tr})
+	}
+
+	for _, pe := range params["x.pe"] {
+		if _, _, err := parsePeer(pe); err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, pe)
+	}
+
+	m.WebSeeds = params["ws"]
+
+	if so := params.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+
+	return &m, nil
+}
+
+// FromTorrent creates a magnet that points to a torrent file
+func FromTorrent(tf *torrentfile.TorrentFile) *Magnet {
+	m := &Magnet{
+		InfoHash: tf.Info.InfoHash,
+		Name:     tf.Info.Name,
+		Length:   tf.Info.Length,
+		WebSeeds: tf.URLList,
+	}
+	if tf.Info.IsV2() {
+		m.InfoHashV2 = tf.Info.InfoHashV2
+		if !tf.Info.IsHybrid() {
+			m.InfoHash = [20]byte{}
+		}
+	}
+	for _, tier := range tf.AnnounceList {
+		m.Trackers = append(m.Trackers, append([]string(nil), tier...))
+	}
+	return m
+}
+
+// TorrentFile resolves the magnet into a torrent file, the info dictionary is fetched from the peers
+// in the magnet and any that the trackers or the DHT hand out. d can be nil to skip the DHT
+func (m Magnet) TorrentFile(d *dht.Server, dialer client.Dialer) (*torrentfile.TorrentFile, error) {
+	if m.InfoHash == [20]byte{} {
+		return nil, fmt.Errorf("v2 only magnets are not supported")
+	}
+
+	tf := &torrentfile.TorrentFile{
+		Info:         torrentfile.TorrentInfo{InfoHash: m.InfoHash, Name: m.Name, Length: m.Length},
+		AnnounceList: m.Trackers,
+		URLList:      m.WebSeeds,
+		DHT:          d,
+		Dialer:       dialer,
+	}
+
+	peerID, err := torrentfile.NewPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []peers.Peer
+	for _, pe := range m.Peers {
+		p, err := resolvePeer(pe)
+		if err != nil {
+			logrus.WithError(err).Warnf("Skipping magnet peer")
+			continue
+		}
+		ps = append(ps, p)
+	}
+	if len(m.Trackers) > 0 {
+		left := m.Length
+		if left == 0 {
+			left = unknownLeft
+		}
+		// Just a regular announce for peers, started and stopped are up to the download
+		a := torrentfile.NewAnnouncer(tf)
+		resp, err := a.Announce(torrentfile.AnnounceRequest{
+			PeerID: peerID,
+			Port:   torrentfile.Port,
+			Left:   left,
+		})
+		a.Close()
+		if err != nil && len(ps) == 0 && d == nil {
+			return nil, err
+		}
+		if err == nil {
+			ps = append(ps, resp.Peers...)
+		}
+	}
+	if d != nil {
+		for p := range d.GetPeers(m.InfoHash) {
+			ps = append(ps, p)
+		}
+	}
+
+	info, err := torrentfile.FetchInfo(dialer, m.InfoHash, ps)
+	if err != nil {
+		return nil, err
+	}
+	tf.Info = *info
+	return tf, nil
+}
+
+// String formats the magnet as a magnet url, with the exact topic first
+func (m Magnet) String() string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	// Exact topics are left unescaped since every client expects 'urn:btih:' as is
+	if m.InfoHash != [20]byte{} {
+		params = append(params, "xt="+btihPrefix+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.InfoHashV2 != [32]byte{} {
+		params = append(params, "xt="+btmhPrefix+sha256Multihash+hex.EncodeToString(m.InfoHashV2[:]))
+	}
+	if m.Name != "" {
+		add("dn", m.Name)
+	}
+	if m.Length > 0 {
+		add("xl", strconv.FormatInt(m.Length, 10))
+	}
+	for _, tier := range m.Trackers {
+		for _, tr := range tier {
+			add("tr", tr)
+		}
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+	for _, p := range m.Peers {
+		add("x.pe", p)
+	}
+	if len(m.SelectOnly) > 0 {
+		add("so", formatSelectOnly(m.SelectOnly))
+	}
+
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// parseBTIH parses a v1 infohash, either 40 hex characters or 32 base32 characters
+func parseBTIH(s string) ([20]byte, error) {
+	var hash [20]byte
+
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("infohash %q must be 40 hex or 32 base32 characters", s)
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid infohash %q: %w", s, err)
+	}
+
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// parseBTMH parses a v2 infohash, a hex encoded sha2-256 multihash
+func parseBTMH(s string) ([32]byte, error) {
+	var hash [32]byte
+
+	if !strings.HasPrefix(s, sha256Multihash) {
+		return hash, fmt.Errorf("v2 infohash %q is not a sha2-256 multihash", s)
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, sha256Multihash))
+	if err != nil {
+		return hash, fmt.Errorf("invalid v2 infohash %q: %w", s, err)
+	}
+	if len(b) != len(hash) {
+		return hash, fmt.Errorf("v2 infohash %q must be 32 bytes but is %v", s, len(b))
+	}
+
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// parsePeer splits a x.pe address into its host and port, host names are left alone
+func parsePeer(s string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid peer address %q: %w", s, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port in peer address %q", s)
+	}
+	return host, uint16(port), nil
+}
+
+// resolvePeer turns a x.pe address into a peer, looking up the host name if it is one
+func resolvePeer(s string) (peers.Peer, error) {
+	host, port, err := parsePeer(s)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return peers.Peer{}, fmt.Errorf("resolve peer address %q: %w", s, err)
+		}
+		ip = addr.IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return peers.Peer{IP: ip, Port: port}, nil
+}
+
+// parseSelectOnly expands a BEP 53 file list like '0,2,4-6' into the file indexes
+func parseSelectOnly(s string) ([]int, error) {
+	seen := map[int]bool{}
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 || first > maxFileIndex {
+			return nil, fmt.Errorf("invalid file index %q in select only", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first || last > maxFileIndex {
+				return nil, fmt.Errorf("invalid file range %q in select only", part)
+			}
+		}
+		if total += last - first + 1; total > maxSelectOnly {
+			return nil, fmt.Errorf("select only has more than %v file indexes", maxSelectOnly)
+		}
+
+		for i := first; i <= last; i++ {
+			seen[i] = true
+		}
+	}
+
+	indexes := make([]int, 0, len(seen))
+	for i := range seen {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// formatSelectOnly collapses file indexes back into ranges
+func formatSelectOnly(indexes []int) string {
+	sorted := append([]int(nil), indexes...)
+	sort.Ints(sorted)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,252 @@
+package magnet
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testInfoHash = [20]byte{0x2d, 0x06, 0x6c, 0x94, 0x48, 0x0a, 0xdc, 0xf5, 0x2b, 0xfd, 0x11, 0x85, 0xa7, 0x5e, 0xb4, 0xdd, 0xc1, 0x77, 0x76, 0x73}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *Magnet
+		fails  bool
+	}{
+		"hex infohash": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&dn=ubuntu.iso&xl=599785472",
+			output: &Magnet{
+				InfoHash: testInfoHash,
+				Name:     "ubuntu.iso",
+				Length:   599785472,
+			},
+		},
+		"base32 infohash": {
+			input:  "magnet:?xt=urn:btih:FUDGZFCIBLOPKK75CGC2OXVU3XAXO5TT",
+			output: &Magnet{InfoHash: testInfoHash},
+		},
+		"lowercase base32 infohash": {
+			input:  "magnet:?xt=urn:btih:fudgzfciblopkk75cgc2oxvu3xaxo5tt",
+			output: &Magnet{InfoHash: testInfoHash},
+		},
+		"hybrid": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e",
+			output: &Magnet{
+				InfoHash:   testInfoHash,
+				InfoHashV2: [32]byte{0xca, 0xf1, 0xe1, 0xc3, 0x0e, 0x81, 0xcb, 0x36, 0x1b, 0x9e, 0xe1, 0x67, 0xc4, 0xaa, 0x64, 0x22, 0x8a, 0x7f, 0xa4, 0xfa, 0x9f, 0x61, 0x05, 0x23, 0x2b, 0x28, 0xad, 0x09, 0x9f, 0x3a, 0x30, 0x2e},
+			},
+		},
+		"trackers peers and web seeds": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673" +
+				"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.com%3A80" +
+				"&x.pe=10.0.0.1:6881&x.pe=[::1]:6882" +
+				"&ws=http%3A%2F%2Fseed.example.com%2F",
+			output: &Magnet{
+				InfoHash: testInfoHash,
+				Trackers: [][]string{
+					{"http://tracker.example.com/announce"},
+					{"udp://tracker.example.com:80"},
+				},
+				Peers:    []string{"10.0.0.1:6881", "[::1]:6882"},
+				WebSeeds: []string{"http://seed.example.com/"},
+			},
+		},
+		"peer host names are not looked up": {
+			input:  "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&x.pe=peer.invalid:6881",
+			output: &Magnet{InfoHash: testInfoHash, Peers: []string{"peer.invalid:6881"}},
+		},
+		"select only": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&so=0,2,4-6,5",
+			output: &Magnet{
+				InfoHash:   testInfoHash,
+				SelectOnly: []int{0, 2, 4, 5, 6},
+			},
+		},
+		"wrong scheme": {
+			input: "http://example.com/?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673",
+			fails: true,
+		},
+		"no exact topic": {
+			input: "magnet:?dn=ubuntu.iso",
+			fails: true,
+		},
+		"infohash too short": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd",
+			fails: true,
+		},
+		"infohash not hex": {
+			input: "magnet:?xt=urn:btih:zz066c94480adcf52bfd1185a75eb4ddc1777673",
+			fails: true,
+		},
+		"v2 not sha256": {
+			input: "magnet:?xt=urn:btmh:1114caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa",
+			fails: true,
+		},
+		"bad exact length": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&xl=-5",
+			fails: true,
+		},
+		"bad peer": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&x.pe=10.0.0.1",
+			fails: true,
+		},
+		"select only range too big": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&so=0-70000",
+			fails: true,
+		},
+		"select only ranges too big together": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&so=0-40000,0-40000",
+			fails: true,
+		},
+		"backwards select only range": {
+			input: "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&so=6-4",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := New(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestString(t *testing.T) {
+	m := Magnet{
+		InfoHash: testInfoHash,
+		Name:     "ubuntu 14.04.iso",
+		Length:   10,
+		Trackers: [][]string{
+			{"http://tracker.example.com/announce", "udp://tracker.example.com:80"},
+		},
+		Peers:      []string{"10.0.0.1:6881"},
+		WebSeeds:   []string{"http://seed.example.com/"},
+		SelectOnly: []int{0, 2, 3, 4, 7},
+	}
+	expected := "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&dn=ubuntu+14.04.iso&xl=10" +
+		"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.com%3A80" +
+		"&ws=http%3A%2F%2Fseed.example.com%2F&x.pe=10.0.0.1%3A6881&so=0%2C2-4%2C7"
+	assert.Equal(t, expected, m.String())
+
+	// Parsing it again gives back the same magnet, apart from trackers getting their own tiers
+	parsed, err := New(m.String())
+	require.Nil(t, err)
+	m.Trackers = [][]string{{"http://tracker.example.com/announce"}, {"udp://tracker.example.com:80"}}
+	assert.Equal(t, &m, parsed)
+}
+
+func TestResolvePeer(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output peers.Peer
+		fails  bool
+	}{
+		"IPv4":           {input: "10.0.0.1:6881", output: peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}},
+		"IPv6":           {input: "[::1]:6882", output: peers.Peer{IP: net.ParseIP("::1"), Port: 6882}},
+		"Host not found": {input: "peer.invalid:6881", fails: true},
+		"No port":        {input: "10.0.0.1", fails: true},
+	}
+
+	for name, test := range tests {
+		p, err := resolvePeer(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, p, name)
+	}
+}
+
+func TestFromTorrent(t *testing.T) {
+	tf, err := torrentfile.Open("../torrentfile/data_test/ubuntu-14.04.1-server-amd64.iso.torrent")
+	require.Nil(t, err)
+
+	m := FromTorrent(tf)
+	assert.Equal(t, "magnet:?xt=urn:btih:2d066c94480adcf52bfd1185a75eb4ddc1777673&dn=ubuntu-14.04.1-server-amd64.iso&xl=599785472"+
+		"&tr=http%3A%2F%2Ftorrent.ubuntu.com%3A6969%2Fannounce&tr=http%3A%2F%2Fipv6.torrent.ubuntu.com%3A6969%2Fannounce", m.String())
+}
+
+func TestFromTorrentV2(t *testing.T) {
+	v2Hash := [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22}
+	var truncated [20]byte
+	copy(truncated[:], v2Hash[:])
+
+	type testCase struct {
+		info       torrentfile.TorrentInfo
+		infoHash   [20]byte
+		infoHashV2 [32]byte
+	}
+
+	tcs := map[string]testCase{
+		"Hybrid has both": {
+			info: torrentfile.TorrentInfo{
+				InfoHash:    testInfoHash,
+				InfoHashV2:  v2Hash,
+				MetaVersion: 2,
+				BencodeInfo: torrentfile.BencodeInfo{Pieces: make([]byte, 20)},
+			},
+			infoHash:   testInfoHash,
+			infoHashV2: v2Hash,
+		},
+		"V2 only has no v1 infohash": {
+			info:       torrentfile.TorrentInfo{InfoHash: truncated, InfoHashV2: v2Hash, MetaVersion: 2},
+			infoHashV2: v2Hash,
+		},
+		"V1 only": {
+			info:     torrentfile.TorrentInfo{InfoHash: testInfoHash},
+			infoHash: testInfoHash,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			m := FromTorrent(&torrentfile.TorrentFile{Info: tc.info})
+			assert.Equal(t, tc.infoHash, m.InfoHash)
+			assert.Equal(t, tc.infoHashV2, m.InfoHashV2)
+		})
+	}
+}
+
+func TestTorrentFileLeft(t *testing.T) {
+	type testCase struct {
+		length int64
+		left   string
+	}
+
+	tcs := map[string]testCase{
+		"Exact length":   {length: 1000, left: "1000"},
+		"Unknown length": {left: "1"},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			var left, event string
+			tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				left = r.URL.Query().Get("left")
+				event = r.URL.Query().Get("event")
+				w.Write([]byte("d8:intervali900e5:peers0:e"))
+			}))
+			defer tracker.Close()
+
+			// Nobody has the metadata, only the announce matters
+			m := Magnet{InfoHash: testInfoHash, Length: tc.length, Trackers: [][]string{{tracker.URL}}}
+			_, err := m.TorrentFile(nil, client.Dialer{})
+			assert.NotNil(t, err)
+			assert.Equal(t, tc.left, left)
+			assert.Empty(t, event, "nothing was started, so there is nothing to stop")
+		})
+	}
+}
@@ -1,12 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
+	"github.com/Squwid/squidtorrent/magnet"
+	"github.com/Squwid/squidtorrent/mse"
 	"github.com/Squwid/squidtorrent/torrentfile"
+	"github.com/Squwid/squidtorrent/util"
 	"github.com/sirupsen/logrus"
 )
 
+const usage = `Usage:
+  %[1]v download [-e disable|prefer|require] [-seed=false] <torrent file | magnet link> <output directory>
+  %[1]v scrape <torrent file>
+  %[1]v verify [-json] <torrent file> <directory>
+  %[1]v create [-a trackers]... [-w web seed]... [-o output] [-l piece length] [-c comment] [-private] <file | directory>
+`
+
 func main() {
 	logger := logrus.New()
 	// viewer.SetConfiguration(viewer.WithAddr("192.168.1.191:18066"))
@@ -16,16 +38,256 @@ func main() {
 	// logger.Infof("Metrics: http://192.168.1.191:18066/debug/statsview")
 	// time.Sleep(5 * time.Second)
 
-	inPath := os.Args[1]
-	// outPath := os.Args[2]
+	if len(os.Args) < 3 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
 
-	_, err := torrentfile.Open(inPath)
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "download":
+		err = download(args)
+	case "scrape":
+		err = scrape(args)
+	case "verify":
+		err = verify(args)
+	case "create":
+		err = create(args)
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
 	if err != nil {
-		logger.WithError(err).Errorf("Error opening torrent file")
+		logger.WithError(err).Fatalf("Error running %v", os.Args[1])
 	}
+}
 
-	// err = tf.DownloadToFile(outPath)
-	// if err != nil {
-	// 	logger.WithError(err).Errorf("Error downloading torrent file")
-	// }
+func download(args []string) error {
+	dialer := client.Dialer{Encryption: mse.Prefer}
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.Func("e", "encryption of peer connections: disable, prefer or require (default prefer)", func(s string) error {
+		mode, err := mse.ParseMode(s)
+		dialer.Encryption = mode
+		return err
+	})
+	seed := fs.Bool("seed", true, "keep seeding once the download is done")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected a torrent file and an output directory")
+	}
+	args = fs.Args()
+
+	// Interrupting stops the download cleanly so the resume data and the DHT nodes get saved, a second
+	// interrupt kills it right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// Not being able to listen only means peers can't connect to us, we dial over TCP only and the DHT gets its
+	// own socket
+	l, err := client.Listen(fmt.Sprintf(":%v", torrentfile.Port), dialer.Encryption)
+	if err != nil {
+		logrus.WithError(err).Warnf("Error listening for peers")
+	} else {
+		defer l.Close()
+		dialer.UTP = l.UTP()
+	}
+
+	d := startDHT(l)
+	if d != nil {
+		defer d.Close()
+	}
+
+	tf, err := openTorrent(args[0], d, dialer)
+	if err != nil {
+		return err
+	}
+	tf.DHT = d
+	tf.Listener = l
+	tf.Dialer = dialer
+	tf.Seed = *seed
+	if dir, err := os.UserCacheDir(); err == nil {
+		tf.ResumeDir = filepath.Join(dir, "squidtorrent", "resume")
+	}
+	err = tf.DownloadToFile(ctx, args[1])
+	if errors.Is(err, context.Canceled) {
+		logrus.Infof("Download stopped")
+		return nil
+	}
+	return err
+}
+
+// startDHT joins the DHT, downloads carry on with only trackers when that does not work. It shares the
+// UDP socket of the listener when there is one. The routing table is kept in the user cache directory so
+// restarts do not bootstrap from scratch
+func startDHT(l *client.Listener) *dht.Server {
+	cfg := dht.Config{
+		Addr:           fmt.Sprintf(":%v", torrentfile.Port),
+		BootstrapNodes: dht.DefaultBootstrapNodes,
+	}
+	if l != nil {
+		cfg.Conn = l.PacketConn()
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		cfg.StateFile = filepath.Join(dir, "squidtorrent", "dht.dat")
+	}
+
+	d, err := dht.New(cfg)
+	if err != nil {
+		logrus.WithError(err).Warnf("Error starting DHT")
+		return nil
+	}
+	if err := d.Bootstrap(); err != nil {
+		logrus.WithError(err).Warnf("Error bootstrapping DHT")
+	}
+	return d
+}
+
+// openTorrent opens a torrent file, or fetches the metadata of a magnet link
+func openTorrent(s string, d *dht.Server, dialer client.Dialer) (*torrentfile.TorrentFile, error) {
+	if !strings.HasPrefix(s, "magnet:") {
+		return torrentfile.Open(s)
+	}
+
+	m, err := magnet.New(s)
+	if err != nil {
+		return nil, err
+	}
+	return m.TorrentFile(d, dialer)
+}
+
+// scrape prints the swarm stats of a torrent from every tracker
+func scrape(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a torrent file")
+	}
+
+	tf, err := torrentfile.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v (%v)\n", tf.Info.Name, hex.EncodeToString(tf.Info.InfoHash[:]))
+	for _, tier := range tf.AnnounceList {
+		for _, tracker := range tier {
+			results, err := torrentfile.Scrape(tracker, tf.Info.InfoHash)
+			if err != nil {
+				fmt.Printf("  %v: %v\n", tracker, err)
+				continue
+			}
+			res, ok := results[tf.Info.InfoHash]
+			if !ok {
+				fmt.Printf("  %v: torrent is not registered\n", tracker)
+				continue
+			}
+			fmt.Printf("  %v: %v seeders, %v leechers, %v completed\n", tracker, res.Seeders, res.Leechers, res.Completed)
+		}
+	}
+	return nil
+}
+
+// verify checks the files of a torrent in a directory, it fails unless every piece is good
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the result as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected a torrent file and a directory")
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	res, err := tf.Info.Verify(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%v (%v)\n", tf.Info.Name, hex.EncodeToString(tf.Info.InfoHash[:]))
+		fmt.Printf("  %v good, %v bad, %v missing of %v pieces\n", len(res.Good), len(res.Bad), len(res.Missing), tf.Info.NumPieces)
+		for _, bad := range res.Bad {
+			fmt.Printf("  piece %v is bad: %v\n", bad.Index, strings.Join(bad.Files, ", "))
+		}
+		if len(res.Missing) > 0 {
+			fmt.Printf("  missing pieces: %v\n", pieceRanges(res.Missing))
+		}
+	}
+
+	if !res.Complete() {
+		return fmt.Errorf("%v bad and %v missing pieces", len(res.Bad), len(res.Missing))
+	}
+	return nil
+}
+
+// pieceRanges formats sorted piece indexes, runs of pieces become a range like 3-7
+func pieceRanges(indexes []int) string {
+	var parts []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%v-%v", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// create makes a torrent file out of a file or directory
+func create(args []string) error {
+	var b torrentfile.Builder
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.Func("a", "tier of comma separated trackers, can be repeated", func(s string) error {
+		b.AnnounceList = append(b.AnnounceList, strings.Split(s, ","))
+		return nil
+	})
+	fs.Func("w", "web seed url, can be repeated", func(s string) error {
+		b.URLList = append(b.URLList, s)
+		return nil
+	})
+	output := fs.String("o", "", "output file, defaults to the name of the torrent with .torrent")
+	pieceLength := fs.Uint("l", 0, "piece length in bytes, picked from the size when not set")
+	fs.StringVar(&b.Comment, "c", "", "comment")
+	fs.StringVar(&b.Name, "n", "", "name of the torrent, defaults to the name of the file or directory")
+	fs.BoolVar(&b.Private, "private", false, "only use the trackers to find peers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a file or directory")
+	}
+	b.PieceLength = uint32(*pieceLength)
+
+	tf, err := b.Build(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = tf.Info.Name + ".torrent"
+	}
+	if err := tf.WriteFile(*output); err != nil {
+		return err
+	}
+	fmt.Printf("%v (%v), %v pieces of %v\n", *output, hex.EncodeToString(tf.Info.InfoHash[:]), tf.Info.NumPieces,
+		util.FormatBytes(int(tf.Info.BencodeInfo.PieceLength)))
+	return nil
 }
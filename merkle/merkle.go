@@ -0,0 +1,99 @@
+// Package merkle builds and checks the SHA-256 merkle trees of BitTorrent v2 files (BEP 52)
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// BlockSize is the size of the data each leaf hash covers, the last block of a file can be shorter
+const BlockSize = 16384
+
+// Hash is a node of a merkle tree
+type Hash = [32]byte
+
+// BlockHashes hashes data in blocks, these are the leaves of the tree of a file
+func BlockHashes(data []byte) []Hash {
+	hashes := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// PadHash is the hash of a node in layer above the leaves whose leaves are all padding. Padding leaves are
+// zero hashes
+func PadHash(layer int) Hash {
+	var h Hash
+	for i := 0; i < layer; i++ {
+		h = pair(h, h)
+	}
+	return h
+}
+
+// Width is the number of leaves of a tree with n leaves that are not padding, the next power of two
+func Width(n int) int {
+	width := 1
+	for width < n {
+		width *= 2
+	}
+	return width
+}
+
+// Root gets the root of a tree with hashes as its bottom layer, padded to width with pad
+func Root(hashes []Hash, width int, pad Hash) Hash {
+	layer := hashes
+	for ; width > 1; width /= 2 {
+		layer, pad = next(layer, pad)
+	}
+	if len(layer) == 0 {
+		return pad
+	}
+	return layer[0]
+}
+
+// Proof gets the uncle hashes needed to get from the subtree of hashes[index:index+length] up to the root.
+// length has to be a power of two and index a multiple of it
+func Proof(hashes []Hash, width int, pad Hash, index, length int) []Hash {
+	layer := hashes
+	for ; length > 1; length /= 2 {
+		layer, pad = next(layer, pad)
+		width /= 2
+		index /= 2
+	}
+
+	var proof []Hash
+	for ; width > 1; width /= 2 {
+		uncle := pad
+		if i := index ^ 1; i < len(layer) {
+			uncle = layer[i]
+		}
+		proof = append(proof, uncle)
+		layer, pad = next(layer, pad)
+		index /= 2
+	}
+	return proof
+}
+
+// next hashes a layer into the one above it
+func next(layer []Hash, pad Hash) ([]Hash, Hash) {
+	up := make([]Hash, (len(layer)+1)/2)
+	for i := range up {
+		right := pad
+		if 2*i+1 < len(layer) {
+			right = layer[2*i+1]
+		}
+		up[i] = pair(layer[2*i], right)
+	}
+	return up, pair(pad, pad)
+}
+
+func pair(left, right Hash) Hash {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
@@ -0,0 +1,108 @@
+package merkle
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomHashes(t *testing.T, n int) []Hash {
+	hashes := make([]Hash, n)
+	for i := range hashes {
+		_, err := rand.Read(hashes[i][:])
+		require.Nil(t, err)
+	}
+	return hashes
+}
+
+func TestRoot(t *testing.T) {
+	h := randomHashes(t, 3)
+	var zero Hash
+
+	// Tree of 3 leaves padded to 4 with zero hashes
+	want := pair(pair(h[0], h[1]), pair(h[2], zero))
+	assert.Equal(t, want, Root(h, 4, zero))
+
+	// Wider than it needs to be, whole subtrees are padding
+	assert.Equal(t, pair(want, PadHash(2)), Root(h, 8, zero))
+
+	assert.Equal(t, h[0], Root(h[:1], 1, zero))
+	assert.Equal(t, PadHash(2), Root(nil, 4, zero))
+	assert.Equal(t, Hash(sha256.Sum256(make([]byte, 64))), PadHash(1))
+}
+
+func TestBlockHashes(t *testing.T) {
+	data := make([]byte, 2*BlockSize+10)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+
+	hashes := BlockHashes(data)
+	require.Len(t, hashes, 3)
+	assert.Equal(t, Hash(sha256.Sum256(data[BlockSize:2*BlockSize])), hashes[1])
+	assert.Equal(t, Hash(sha256.Sum256(data[2*BlockSize:])), hashes[2])
+	assert.Empty(t, BlockHashes(nil))
+}
+
+func TestWidth(t *testing.T) {
+	tests := map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 5: 8, 8: 8, 1000: 1024}
+	for n, width := range tests {
+		assert.Equal(t, width, Width(n), "width of %v", n)
+	}
+}
+
+// verify folds hashes, starting at index in their layer, up to the root with the uncles in proof
+func verify(root Hash, hashes []Hash, index int, proof []Hash) bool {
+	h := Root(hashes, len(hashes), Hash{})
+	index /= len(hashes)
+	for _, uncle := range proof {
+		if index%2 == 0 {
+			h = pair(h, uncle)
+		} else {
+			h = pair(uncle, h)
+		}
+		index /= 2
+	}
+	return index == 0 && h == root
+}
+
+func TestProof(t *testing.T) {
+	type testCase struct {
+		leaves int
+		index  int
+		length int
+	}
+
+	tcs := map[string]testCase{
+		"First leaf":          {leaves: 5, index: 0, length: 1},
+		"Last leaf":           {leaves: 5, index: 4, length: 1},
+		"Pair of leaves":      {leaves: 7, index: 2, length: 2},
+		"Half of the tree":    {leaves: 13, index: 8, length: 8},
+		"Every leaf":          {leaves: 8, index: 0, length: 8},
+		"Leaves with padding": {leaves: 6, index: 4, length: 4},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			leaves := randomHashes(t, tc.leaves)
+			width := Width(tc.leaves)
+			root := Root(leaves, width, Hash{})
+
+			hashes := make([]Hash, tc.length)
+			copy(hashes, leaves[tc.index:])
+			proof := Proof(leaves, width, Hash{}, tc.index, tc.length)
+			assert.True(t, verify(root, hashes, tc.index, proof))
+
+			// Anything changed breaks the proof
+			bad := append([]Hash(nil), hashes...)
+			bad[0][0]++
+			assert.False(t, verify(root, bad, tc.index, proof))
+			if len(proof) > 0 {
+				assert.False(t, verify(root, hashes, tc.index, proof[:len(proof)-1]))
+				assert.False(t, verify(root, hashes, tc.index+tc.length, proof))
+			}
+		})
+	}
+}
@@ -8,6 +8,15 @@ import (
 
 // A message contains a 4 byte length, 1 byte id, and an optional payload
 
+const (
+	// MaxLength is the longest message that is read, the length comes from the peer so it can't be
+	// trusted with an allocation. Bitfields of huge torrents and extended messages are the big ones
+	MaxLength = 4 << 20
+
+	// maxPieceLength fits a 16KiB block after the index and offset, nobody asks for more than that
+	maxPieceLength = 1 + 8 + 16384
+)
+
 // The messageID describes what message that is being received
 type messageID uint8
 
@@ -38,8 +47,48 @@ const (
 
 	// MsgCancel cancels a request
 	MsgCancel
+
+	// MsgSuggest tells the receiver a piece would be good to download, like one that is in the cache (BEP 6)
+	MsgSuggest messageID = 13
+
+	// MsgHaveAll replaces the bitfield of a peer that has every piece
+	MsgHaveAll messageID = 14
+
+	// MsgHaveNone replaces the bitfield of a peer that has no pieces
+	MsgHaveNone messageID = 15
+
+	// MsgReject turns down a request instead of ignoring it
+	MsgReject messageID = 16
+
+	// MsgAllowedFast lets the receiver request a piece while it is choked
+	MsgAllowedFast messageID = 17
+
+	// MsgExtended carries an extension protocol message (BEP 10)
+	MsgExtended messageID = 20
+
+	// MsgHashRequest asks for hashes of the merkle tree of a file (BEP 52)
+	MsgHashRequest messageID = 21
+
+	// MsgHashes delivers the hashes of a hash request along with their proof
+	MsgHashes messageID = 22
+
+	// MsgHashReject turns down a hash request
+	MsgHashReject messageID = 23
 )
 
+// HashRequest asks for Length hashes of the layer BaseLayer above the leaves of a file tree, starting at
+// Index. ProofLayers is how many layers of uncle hashes to send along so the hashes can be checked
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+// hashRequestLength is the payload length of a hash request, the hashes message starts the same way
+const hashRequestLength = 32 + 4*4
+
 // Message stores the ID and payload of a message
 type Message struct {
 	ID      messageID
@@ -55,6 +104,22 @@ func FormatRequest(index, offset, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatCancel creates a cancel message for a request that was sent earlier
+func FormatCancel(index, offset, length int) *Message {
+	msg := FormatRequest(index, offset, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+// FormatPiece creates a piece message carrying a block
+func FormatPiece(index, offset int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
 // FormatHave creates a have message
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -62,6 +127,65 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatSuggest creates a suggest piece message
+func FormatSuggest(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgSuggest
+	return msg
+}
+
+// FormatAllowedFast creates an allowed fast message
+func FormatAllowedFast(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgAllowedFast
+	return msg
+}
+
+// FormatReject creates a reject request message for a request the sender won't serve
+func FormatReject(index, offset, length int) *Message {
+	msg := FormatRequest(index, offset, length)
+	msg.ID = MsgReject
+	return msg
+}
+
+// FormatExtended creates an extended message, id is the extended message id the receiver asked for
+func FormatExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// FormatHashRequest creates a hash request message
+func FormatHashRequest(r HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.bytes()}
+}
+
+// FormatHashes creates a hashes message answering a hash request, hashes are the requested hashes followed
+// by the uncle hashes of the proof
+func FormatHashes(r HashRequest, hashes [][32]byte) *Message {
+	payload := r.bytes()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// FormatHashReject creates a hash reject message for a request we can't answer
+func FormatHashReject(r HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.bytes()}
+}
+
+func (r HashRequest) bytes() []byte {
+	payload := make([]byte, hashRequestLength)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
 // Serializes a message to a byte slice
 // <length prefix><message ID><payload>
 // Interprets `nil` as a keep-alive message
@@ -103,9 +227,24 @@ func (m Message) ParsePiece(index int, buf []byte) (int, error) {
 	return len(data), nil
 }
 
+// ParseRequest parses a request, cancel or reject message, they share the same payload
+func (m Message) ParseRequest() (index, offset, length int, err error) {
+	if m.ID != MsgRequest && m.ID != MsgCancel && m.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("expected MsgRequest (%v), MsgCancel (%v) or MsgReject (%v), but got %v", MsgRequest, MsgCancel, MsgReject, m.ID)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length of 12 got %v", len(m.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	offset = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, offset, length, nil
+}
+
+// ParseHave parses a have, suggest piece or allowed fast message, they all carry just a piece index
 func (m Message) ParseHave() (int, error) {
-	if m.ID != MsgHave {
-		return 0, fmt.Errorf("expected MsgHave (%v), but got %v", MsgHave, m.ID)
+	if m.ID != MsgHave && m.ID != MsgSuggest && m.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("expected MsgHave (%v), MsgSuggest (%v) or MsgAllowedFast (%v), but got %v", MsgHave, MsgSuggest, MsgAllowedFast, m.ID)
 	}
 	if len(m.Payload) != 4 {
 		return 0, fmt.Errorf("expected payload length of 4 got %v", len(m.Payload))
@@ -113,6 +252,55 @@ func (m Message) ParseHave() (int, error) {
 	return int(binary.BigEndian.Uint32(m.Payload)), nil
 }
 
+// ParseHashRequest parses a hash request or a hash reject message, they share the same payload
+func (m Message) ParseHashRequest() (HashRequest, error) {
+	if m.ID != MsgHashRequest && m.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("expected MsgHashRequest (%v) or MsgHashReject (%v), but got %v", MsgHashRequest, MsgHashReject, m.ID)
+	}
+	if len(m.Payload) != hashRequestLength {
+		return HashRequest{}, fmt.Errorf("expected payload length of %v got %v", hashRequestLength, len(m.Payload))
+	}
+	return parseHashRequest(m.Payload), nil
+}
+
+// ParseHashes parses a hashes message into the request it answers and the hashes, which are the requested
+// hashes followed by the uncle hashes of the proof
+func (m Message) ParseHashes() (HashRequest, [][32]byte, error) {
+	if m.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("expected MsgHashes (%v), but got %v", MsgHashes, m.ID)
+	}
+	if len(m.Payload) < hashRequestLength || (len(m.Payload)-hashRequestLength)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("invalid hashes payload length %v", len(m.Payload))
+	}
+
+	hashes := make([][32]byte, (len(m.Payload)-hashRequestLength)/32)
+	for i := range hashes {
+		copy(hashes[i][:], m.Payload[hashRequestLength+32*i:])
+	}
+	return parseHashRequest(m.Payload), hashes, nil
+}
+
+func parseHashRequest(payload []byte) HashRequest {
+	var r HashRequest
+	copy(r.PiecesRoot[:], payload[0:32])
+	r.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	r.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	r.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return r
+}
+
+// ParseExtended splits an extended message into its extended message id and payload
+func (m Message) ParseExtended() (uint8, []byte, error) {
+	if m.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected MsgExtended (%v), but got %v", MsgExtended, m.ID)
+	}
+	if len(m.Payload) < 1 {
+		return 0, nil, fmt.Errorf("payload too short")
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
+
 // Read parses a message, Returns nil on keep-alive messages
 func Read(r io.Reader) (*Message, error) {
 	lengthBuf := make([]byte, 4)
@@ -126,11 +314,18 @@ func Read(r io.Reader) (*Message, error) {
 		return nil, nil
 	}
 
+	if lengthPayload > MaxLength {
+		return nil, fmt.Errorf("message length %v is over the limit of %v", lengthPayload, MaxLength)
+	}
+
 	// Parse out 1 byte message id
 	msgIDBuf := make([]byte, 1)
 	if _, err := io.ReadFull(r, msgIDBuf); err != nil {
 		return nil, err
 	}
+	if messageID(msgIDBuf[0]) == MsgPiece && lengthPayload > maxPieceLength {
+		return nil, fmt.Errorf("piece message length %v is over the limit of %v", lengthPayload, maxPieceLength)
+	}
 
 	// Parse payload
 	msgBuf := make([]byte, lengthPayload-1)
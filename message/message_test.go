@@ -30,6 +30,110 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte{0xaa, 0xbb})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0xaa, 0xbb, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestHashRequest(t *testing.T) {
+	r := HashRequest{PiecesRoot: [32]byte{1, 2, 3}, BaseLayer: 2, Index: 8, Length: 4, ProofLayers: 3}
+	hashes := [][32]byte{{1}, {2}, {3}}
+
+	msg := FormatHashRequest(r)
+	assert.Equal(t, MsgHashRequest, msg.ID)
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 8, 0, 0, 0, 4, 0, 0, 0, 3}, msg.Payload[32:])
+	got, err := msg.ParseHashRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, r, got)
+
+	got, err = FormatHashReject(r).ParseHashRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, r, got)
+
+	got, gotHashes, err := FormatHashes(r, hashes).ParseHashes()
+	assert.Nil(t, err)
+	assert.Equal(t, r, got)
+	assert.Equal(t, hashes, gotHashes)
+
+	_, err = FormatHashes(r, hashes).ParseHashRequest()
+	assert.NotNil(t, err)
+	_, err = (&Message{ID: MsgHashRequest, Payload: msg.Payload[:47]}).ParseHashRequest()
+	assert.NotNil(t, err)
+	_, _, err = (&Message{ID: MsgHashes, Payload: append(msg.Payload, 1)}).ParseHashes()
+	assert.NotNil(t, err)
+	_, _, err = msg.ParseHashes()
+	assert.NotNil(t, err)
+}
+
+func TestFormatExtended(t *testing.T) {
+	msg := FormatExtended(3, []byte("de"))
+	expected := &Message{
+		ID:      MsgExtended,
+		Payload: []byte{0x03, 'd', 'e'},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseExtended(t *testing.T) {
+	tests := map[string]struct {
+		input   *Message
+		id      uint8
+		payload []byte
+		fails   bool
+	}{
+		"parse valid message": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0x01, 'd', 'e'}},
+			id:      1,
+			payload: []byte{'d', 'e'},
+		},
+		"handshake without payload": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0x00}},
+			id:      0,
+			payload: []byte{},
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0x01, 'd', 'e'}},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgExtended, Payload: []byte{}},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		id, payload, err := test.input.ParseExtended()
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.id, id)
+		assert.Equal(t, test.payload, payload)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -150,6 +254,14 @@ func TestParseHave(t *testing.T) {
 			output: 4,
 			fails:  false,
 		},
+		"parse suggest": {
+			input:  FormatSuggest(300),
+			output: 300,
+		},
+		"parse allowed fast": {
+			input:  FormatAllowedFast(12),
+			output: 12,
+		},
 		"wrong message type": {
 			input:  &Message{ID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x04}},
 			output: 0,
@@ -178,6 +290,59 @@ func TestParseHave(t *testing.T) {
 	}
 }
 
+func TestParseRequest(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		offset int
+		length int
+		fails  bool
+	}{
+		"parse valid request": {
+			input:  FormatRequest(4, 567, 4321),
+			index:  4,
+			offset: 567,
+			length: 4321,
+		},
+		"parse valid cancel": {
+			input:  FormatCancel(1, 2, 3),
+			index:  1,
+			offset: 2,
+			length: 3,
+		},
+		"parse valid reject": {
+			input:  FormatReject(7, 16384, 100),
+			index:  7,
+			offset: 16384,
+			length: 100,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: make([]byte, 12)},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgRequest, Payload: make([]byte, 11)},
+			fails: true,
+		},
+		"payload too long": {
+			input: &Message{ID: MsgRequest, Payload: make([]byte, 13)},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, offset, length, err := test.input.ParseRequest()
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.offset, offset, name)
+		assert.Equal(t, test.length, length, name)
+	}
+}
+
 func TestSerialize(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -225,6 +390,16 @@ func TestRead(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"length over the limit": {
+			input:  []byte{0xff, 0xff, 0xff, 0xff, 5},
+			output: nil,
+			fails:  true,
+		},
+		"piece bigger than a block": {
+			input:  []byte{0, 0x01, 0, 0, 7},
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -254,6 +429,10 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgHaveAll, nil}, "HaveAll [0]"},
+		{&Message{MsgReject, []byte{1, 2, 3}}, "Reject [3]"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended [3]"},
+		{&Message{MsgHashes, []byte{1, 2, 3}}, "Hashes [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
@@ -286,6 +465,24 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -0,0 +1,291 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/extension"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+)
+
+// https://www.bittorrent.org/beps/bep_0009.html
+
+const (
+	// Name is the name of the extension in the extended handshake
+	Name = "ut_metadata"
+
+	// BlockSize is the size of every metadata piece except for the last one
+	BlockSize = 16384
+
+	// MaxSize is the largest info dictionary a peer can make us download
+	MaxSize = 8 << 20
+)
+
+// Types of ut_metadata messages
+const (
+	msgRequest = iota
+	msgData
+	msgReject
+)
+
+var errRejected = errors.New("peer rejected metadata request")
+
+type bencodeMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// parseMsg splits a ut_metadata message into its dictionary and the piece data that follows it
+func parseMsg(payload []byte) (*bencodeMsg, []byte, error) {
+	var m bencodeMsg
+	dec := bencode.NewDecoder(bytes.NewReader(payload))
+	if err := dec.Decode(&m); err != nil {
+		return nil, nil, err
+	}
+	return &m, payload[dec.BytesParsed():], nil
+}
+
+func formatMsg(m bencodeMsg, data []byte) ([]byte, error) {
+	payload, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, data...), nil
+}
+
+// numPieces is the number of metadata pieces an info dictionary is split into
+func numPieces(size int) int {
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// Fetch downloads the info dictionary of a torrent from the peers. Every peer is asked at the same
+// time and the first info dictionary that matches the infohash is returned
+func Fetch(d client.Dialer, ps []peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	type result struct {
+		raw []byte
+		err error
+	}
+	// Closed once we are done, the peers still going hang up
+	done := make(chan struct{})
+	defer close(done)
+
+	results := make(chan result, len(ps))
+	for _, peer := range ps {
+		go func(peer peers.Peer) {
+			raw, err := fetchFrom(d, peer, peerID, infoHash, done)
+			results <- result{raw, err}
+		}(peer)
+	}
+
+	var lastErr error
+	for range ps {
+		res := <-results
+		if res.err == nil {
+			return res.raw, nil
+		}
+		lastErr = res.err
+	}
+	return nil, fmt.Errorf("no peer could send metadata: %w", lastErr)
+}
+
+func fetchFrom(d client.Dialer, peer peers.Peer, peerID, infoHash [20]byte, done <-chan struct{}) ([]byte, error) {
+	l := logrus.WithField("Peer", peer.IP)
+
+	c, err := d.Dial(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	// Another peer sending the metadata first closes the connection, which gets the reads below out
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			c.Conn.Close()
+		case <-finished:
+		}
+	}()
+
+	if !c.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	// Peer gets a minute to send everything over, it is only a few pieces
+	c.Conn.SetDeadline(time.Now().Add(1 * time.Minute))
+
+	f := &fetcher{infoHash: infoHash}
+	c.Extensions = extension.NewRegistry(f).NewConn(c.Conn)
+	if err := c.Extensions.SendHandshake(); err != nil {
+		return nil, err
+	}
+
+	for !f.done() {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		if err := c.Extensions.Handle(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	l.Debugf("Fetched %v bytes of metadata", len(f.buf))
+	return f.buf, nil
+}
+
+// fetcher is the ut_metadata handler while downloading metadata from a single peer
+type fetcher struct {
+	infoHash  [20]byte
+	buf       []byte
+	received  []bool
+	remaining int
+	verified  bool
+}
+
+func (f *fetcher) Name() string {
+	return Name
+}
+
+func (f *fetcher) done() bool {
+	return f.verified
+}
+
+// HandleHandshake requests every piece as soon as the size is known, metadata is small enough for that
+func (f *fetcher) HandleHandshake(c *extension.Conn) error {
+	if f.buf != nil {
+		return nil
+	}
+	if !c.Supports(Name) {
+		return fmt.Errorf("peer does not support %v", Name)
+	}
+
+	size := c.Remote().MetadataSize
+	if size <= 0 || size > MaxSize {
+		return fmt.Errorf("invalid metadata size %v", size)
+	}
+
+	f.buf = make([]byte, size)
+	f.received = make([]bool, numPieces(size))
+	f.remaining = len(f.received)
+	for i := range f.received {
+		payload, err := formatMsg(bencodeMsg{MsgType: msgRequest, Piece: i}, nil)
+		if err != nil {
+			return err
+		}
+		if err := c.Send(Name, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fetcher) HandleMessage(c *extension.Conn, payload []byte) error {
+	m, data, err := parseMsg(payload)
+	if err != nil {
+		return err
+	}
+
+	switch m.MsgType {
+	case msgReject:
+		return errRejected
+	case msgData:
+		if f.buf == nil {
+			return fmt.Errorf("got metadata before the extended handshake")
+		}
+		if err := copyPiece(f.buf, m.Piece, data); err != nil {
+			return err
+		}
+		if !f.received[m.Piece] {
+			f.received[m.Piece] = true
+			f.remaining--
+		}
+	}
+
+	if f.remaining == 0 && f.buf != nil {
+		if hash := sha1.Sum(f.buf); !bytes.Equal(hash[:], f.infoHash[:]) {
+			return fmt.Errorf("metadata hash %x does not match infohash %x", hash, f.infoHash)
+		}
+		f.verified = true
+	}
+	return nil
+}
+
+// copyPiece puts a metadata piece in place, every piece has to be exactly BlockSize except the last
+func copyPiece(buf []byte, piece int, data []byte) error {
+	if piece < 0 || piece >= numPieces(len(buf)) {
+		return fmt.Errorf("metadata piece %v out of range", piece)
+	}
+	begin := piece * BlockSize
+	end := begin + BlockSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	if len(data) != end-begin {
+		return fmt.Errorf("metadata piece %v has %v bytes, expected %v", piece, len(data), end-begin)
+	}
+	copy(buf[begin:end], data)
+	return nil
+}
+
+// A Server answers ut_metadata requests of peers with an info dictionary we already have
+type Server struct {
+	raw []byte
+}
+
+// NewServer creates a server for a raw bencoded info dictionary
+func NewServer(raw []byte) *Server {
+	return &Server{raw: raw}
+}
+
+func (s *Server) Name() string {
+	return Name
+}
+
+// ExtendHandshake lets peers know how large the metadata is
+func (s *Server) ExtendHandshake(h *extension.Handshake) {
+	h.MetadataSize = len(s.raw)
+}
+
+// HandleMessage answers a ut_metadata request. Requests for pieces that do not exist get rejected
+func (s *Server) HandleMessage(c *extension.Conn, payload []byte) error {
+	m, _, err := parseMsg(payload)
+	if err != nil {
+		return err
+	}
+	if m.MsgType != msgRequest || !c.Supports(Name) {
+		return nil
+	}
+
+	var reply []byte
+	if m.Piece < 0 || m.Piece >= numPieces(len(s.raw)) {
+		reply, err = formatMsg(bencodeMsg{MsgType: msgReject, Piece: m.Piece}, nil)
+	} else {
+		begin := m.Piece * BlockSize
+		end := begin + BlockSize
+		if end > len(s.raw) {
+			end = len(s.raw)
+		}
+		reply, err = formatMsg(bencodeMsg{MsgType: msgData, Piece: m.Piece, TotalSize: len(s.raw)}, s.raw[begin:end])
+	}
+	if err != nil {
+		return err
+	}
+	return c.Send(Name, reply)
+}
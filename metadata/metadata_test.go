@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/extension"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePeer serves raw as its metadata for infoHash with a Server
+func fakePeer(t *testing.T, infoHash [20]byte, raw []byte) peers.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakePeer(conn, infoHash, raw)
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveFakePeer(conn net.Conn, infoHash [20]byte, raw []byte) {
+	defer conn.Close()
+
+	if _, err := handshake.Read(conn); err != nil {
+		return
+	}
+	hs := handshake.New(infoHash, [20]byte{1})
+	hs.SetReserved(handshake.ReservedExtensions)
+	conn.Write(hs.Serialize())
+
+	// Extended handshake goes out before the bitfield, the client has to hold on to it. A dummy
+	// extension in front makes ut_metadata land on a different id than the client's
+	ext := extension.NewRegistry(dummy{}, NewServer(raw)).NewConn(conn)
+	if err := ext.SendHandshake(); err != nil {
+		return
+	}
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0}}).Serialize())
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		if err := ext.Handle(msg); err != nil {
+			return
+		}
+	}
+}
+
+type dummy struct{}
+
+func (dummy) Name() string                                { return "dummy" }
+func (dummy) HandleMessage(*extension.Conn, []byte) error { return nil }
+
+func randomMetadata(t *testing.T, size int) []byte {
+	raw := make([]byte, size)
+	_, err := rand.Read(raw)
+	require.Nil(t, err)
+	return raw
+}
+
+func TestFetch(t *testing.T) {
+	raw := randomMetadata(t, 2*BlockSize+100)
+	infoHash := sha1.Sum(raw)
+
+	// Dead peer does not stop the fetch from the working one
+	dead := fakePeer(t, infoHash, raw)
+	dead.Port = 1
+
+	got, err := Fetch(client.Dialer{}, []peers.Peer{dead, fakePeer(t, infoHash, raw)}, [20]byte{2}, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, raw, got)
+}
+
+func TestFetchClosesOthers(t *testing.T) {
+	raw := randomMetadata(t, 100)
+	infoHash := sha1.Sum(raw)
+
+	// The slow peer gets through the handshakes and then never sends anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handshake.Read(conn)
+		hs := handshake.New(infoHash, [20]byte{3})
+		hs.SetReserved(handshake.ReservedExtensions)
+		conn.Write(hs.Serialize())
+		conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0}}).Serialize())
+		for {
+			if _, err := message.Read(conn); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	slow := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	got, err := Fetch(client.Dialer{}, []peers.Peer{slow, fakePeer(t, infoHash, raw)}, [20]byte{2}, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, raw, got)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow peer was never hung up on")
+	}
+}
+
+func TestFetchWrongHash(t *testing.T) {
+	raw := randomMetadata(t, 100)
+	infoHash := sha1.Sum([]byte("something else"))
+
+	_, err := Fetch(client.Dialer{}, []peers.Peer{fakePeer(t, infoHash, raw)}, [20]byte{2}, infoHash)
+	assert.NotNil(t, err)
+}
+
+func TestServerHandle(t *testing.T) {
+	raw := randomMetadata(t, BlockSize+10)
+	s := NewServer(raw)
+
+	tests := map[string]struct {
+		request  bencodeMsg
+		response bencodeMsg
+		data     []byte
+	}{
+		"first piece": {
+			request:  bencodeMsg{MsgType: msgRequest, Piece: 0},
+			response: bencodeMsg{MsgType: msgData, Piece: 0, TotalSize: len(raw)},
+			data:     raw[:BlockSize],
+		},
+		"last piece is short": {
+			request:  bencodeMsg{MsgType: msgRequest, Piece: 1},
+			response: bencodeMsg{MsgType: msgData, Piece: 1, TotalSize: len(raw)},
+			data:     raw[BlockSize:],
+		},
+		"piece out of range": {
+			request:  bencodeMsg{MsgType: msgRequest, Piece: 2},
+			response: bencodeMsg{MsgType: msgReject, Piece: 2},
+			data:     []byte{},
+		},
+	}
+
+	for name, test := range tests {
+		local, remote := net.Pipe()
+		c := extension.NewRegistry(s).NewConn(local)
+
+		// Peer wants ut_metadata messages on id 7
+		hs, err := extension.Handshake{M: map[string]int{Name: 7}}.Message()
+		require.Nil(t, err)
+		require.Nil(t, c.Handle(hs), name)
+
+		payload, err := formatMsg(test.request, nil)
+		require.Nil(t, err)
+		go c.Handle(message.FormatExtended(1, payload))
+
+		msg, err := message.Read(remote)
+		require.Nil(t, err, name)
+		id, reply, err := msg.ParseExtended()
+		require.Nil(t, err, name)
+		assert.Equal(t, uint8(7), id, name)
+
+		m, data, err := parseMsg(reply)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.response, *m, name)
+		assert.Equal(t, test.data, data, name)
+
+		local.Close()
+		remote.Close()
+	}
+}
@@ -0,0 +1,375 @@
+// Package mse is Message Stream Encryption, also known as Protocol Encryption. It's a Diffie-Hellman key
+// exchange in front of the BitTorrent handshake, after which the connection is RC4 encrypted or, when both
+// sides agree to it, left as plaintext
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mode is what kind of connections are allowed
+type Mode int
+
+const (
+	Disable Mode = iota // Plaintext connections only
+	Prefer              // Encrypt when the other side can, plaintext otherwise
+	Require             // Encrypted connections only
+)
+
+// String is the name of the mode as it's given on the command line
+func (m Mode) String() string {
+	switch m {
+	case Disable:
+		return "disable"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// ParseMode parses the name of a mode
+func ParseMode(s string) (Mode, error) {
+	for _, m := range []Mode{Disable, Prefer, Require} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encryption mode %q, use disable, prefer or require", s)
+}
+
+const (
+	keyLength = 96  // Bytes of a public key and the shared secret
+	maxPad    = 512 // Padding after the public keys is random and at most this long
+	discard   = 1024
+
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	vc = make([]byte, 8) // Verification constant
+
+	// btPrefix is how a plaintext connection starts, the pstr of the BitTorrent handshake
+	btPrefix = append([]byte{19}, "BitTorrent protocol"...)
+
+	ErrPlaintext   = errors.New("peer does not encrypt the connection")
+	ErrEncrypted   = errors.New("peer tried to encrypt the connection")
+	errNoSync      = errors.New("could not find the start of the encrypted handshake")
+	errUnknownSKey = errors.New("peer asked for an unknown torrent")
+)
+
+// Initiate encrypts an outgoing connection to a peer for the torrent with skey, the info hash. In Prefer
+// mode the peer gets to pick plaintext. ia is the initial payload, sent along with the handshake, it can be
+// empty. The returned connection is used in place of conn
+func Initiate(conn net.Conn, skey [20]byte, mode Mode, ia []byte) (net.Conn, error) {
+	provide := uint32(cryptoRC4)
+	switch mode {
+	case Disable:
+		return conn, nil
+	case Prefer:
+		provide |= cryptoPlaintext
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Public keys go both ways
+	priv, pub, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(pub, randomPad()...)); err != nil {
+		return nil, err
+	}
+	theirs := make([]byte, keyLength)
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return nil, err
+	}
+	s := secret(priv, theirs)
+	enc := newCipher("keyA", s, skey[:])
+	dec := newCipher("keyB", s, skey[:])
+
+	// Which torrent we want, and the crypto methods we can do
+	msg := hash([]byte("req1"), s)
+	msg = append(msg, xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s))...)
+	plain := make([]byte, len(vc)+8+len(ia)) // No PadC
+	binary.BigEndian.PutUint32(plain[len(vc):], provide)
+	binary.BigEndian.PutUint16(plain[len(vc)+6:], uint16(len(ia)))
+	copy(plain[len(vc)+8:], ia)
+	enc.XORKeyStream(plain, plain)
+	if _, err := conn.Write(append(msg, plain...)); err != nil {
+		return nil, err
+	}
+
+	// The answer starts with the encrypted VC, somewhere after the padding of the peer
+	want := make([]byte, len(vc))
+	dec.XORKeyStream(want, vc)
+	if err := findMarker(conn, want, maxPad); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 6)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(answer, answer)
+	selected := binary.BigEndian.Uint32(answer)
+	padD := int(binary.BigEndian.Uint16(answer[4:]))
+	if padD > maxPad {
+		return nil, fmt.Errorf("padding of %v bytes is too long", padD)
+	}
+	pad := make([]byte, padD)
+	if _, err := io.ReadFull(conn, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	switch {
+	case selected == cryptoRC4:
+		return &Conn{Conn: conn, r: dec, w: enc}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return conn, nil
+	}
+	return nil, fmt.Errorf("peer selected crypto method %#x, we provided %#x", selected, provide)
+}
+
+// Accept reads the start of an incoming connection. A plaintext BitTorrent handshake is let through unless
+// mode is Require, anything else has to be the encrypted handshake for one of skeys. The returned
+// connection is used in place of conn, the BitTorrent handshake is read from it like any other
+func Accept(conn net.Conn, mode Mode, skeys func() [][20]byte) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	start := make([]byte, len(btPrefix))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, btPrefix) {
+		if mode == Require {
+			return nil, ErrPlaintext
+		}
+		return &prefixConn{Conn: conn, prefix: start}, nil
+	}
+	if mode == Disable {
+		return nil, ErrEncrypted
+	}
+
+	// Public keys go both ways, the start was part of the key of the peer
+	theirs := append(start, make([]byte, keyLength-len(start))...)
+	if _, err := io.ReadFull(conn, theirs[len(start):]); err != nil {
+		return nil, err
+	}
+	priv, pub, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(pub, randomPad()...)); err != nil {
+		return nil, err
+	}
+	s := secret(priv, theirs)
+
+	// After the padding of the peer comes the hash of the secret, then which torrent it wants
+	if err := findMarker(conn, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, err
+	}
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return nil, err
+	}
+	req2 := xor(req, hash([]byte("req3"), s))
+	var skey []byte
+	for _, k := range skeys() {
+		if bytes.Equal(req2, hash([]byte("req2"), k[:])) {
+			skey = append([]byte(nil), k[:]...)
+			break
+		}
+	}
+	if skey == nil {
+		return nil, errUnknownSKey
+	}
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	offer := make([]byte, len(vc)+6)
+	if _, err := io.ReadFull(conn, offer); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(offer, offer)
+	if !bytes.Equal(offer[:len(vc)], vc) {
+		return nil, fmt.Errorf("bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(offer[len(vc):])
+	padC := int(binary.BigEndian.Uint16(offer[len(vc)+4:]))
+	if padC > maxPad {
+		return nil, fmt.Errorf("padding of %v bytes is too long", padC)
+	}
+	rest := make([]byte, padC+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padC:]))
+	if _, err := io.ReadFull(conn, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && mode != Require:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("peer provided crypto methods %#x, none of them work for us", provide)
+	}
+
+	answer := make([]byte, len(vc)+6) // No PadD
+	binary.BigEndian.PutUint32(answer[len(vc):], selected)
+	enc.XORKeyStream(answer, answer)
+	if _, err := conn.Write(answer); err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &prefixConn{Conn: conn, prefix: ia}, nil
+	}
+	return &Conn{Conn: conn, r: dec, w: enc, buf: ia}, nil
+}
+
+// Conn is an RC4 encrypted connection
+type Conn struct {
+	net.Conn
+
+	rmu sync.Mutex
+	r   *rc4.Cipher
+	buf []byte // Initial payload, already decrypted
+
+	wmu sync.Mutex
+	w   *rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	c.r.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// Write encrypts b, writes from different goroutines are fine
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, len(b))
+	c.w.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// prefixConn is a connection with some bytes already read, they get read again first
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// newKey makes a private key and its public key
+func newKey() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(b)
+	return priv, pad(new(big.Int).Exp(generator, priv, prime)), nil
+}
+
+// secret is the secret shared with the peer whose public key is theirs
+func secret(priv *big.Int, theirs []byte) []byte {
+	return pad(new(big.Int).Exp(new(big.Int).SetBytes(theirs), priv, prime))
+}
+
+// pad gets the big endian bytes of n, left padded to keyLength
+func pad(n *big.Int) []byte {
+	b := make([]byte, keyLength)
+	return n.FillBytes(b)
+}
+
+func randomPad() []byte {
+	n, _ := rand.Int(rand.Reader, big.NewInt(maxPad+1))
+	b := make([]byte, n.Int64())
+	rand.Read(b)
+	return b
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// newCipher is the RC4 stream for one direction, the first 1024 bytes of it are thrown away
+func newCipher(key string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(key), s, skey))
+	buf := make([]byte, discard)
+	c.XORKeyStream(buf, buf)
+	return c
+}
+
+// findMarker reads until it has read marker, which has to come within max bytes. It reads a byte at a time so
+// nothing after the marker gets read
+func findMarker(r io.Reader, marker []byte, max int) error {
+	window := make([]byte, 0, max+len(marker))
+	b := make([]byte, 1)
+	for len(window) < max+len(marker) {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return errNoSync
+}
@@ -0,0 +1,154 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pair connects over loopback, the initiator side does the encryption handshake with initiate and the
+// accepting side with accept
+func pair(t *testing.T, initiate func(net.Conn) (net.Conn, error), accept func(net.Conn) (net.Conn, error)) (a, b net.Conn, errA, errB error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- result{nil, err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		c, err := accept(conn)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- result{c, err}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	a, errA = initiate(conn)
+	if errA != nil {
+		conn.Close()
+	}
+	res := <-accepted
+	return a, res.conn, errA, res.err
+}
+
+func TestHandshake(t *testing.T) {
+	skey := [20]byte{'s'}
+	skeys := func() [][20]byte { return [][20]byte{{'x'}, skey} }
+
+	tests := map[string]struct {
+		initiator, responder Mode
+		encrypted            bool
+		fails                bool
+	}{
+		"Require both":         {initiator: Require, responder: Require, encrypted: true},
+		"Prefer both":          {initiator: Prefer, responder: Prefer, encrypted: true},
+		"Prefer to require":    {initiator: Prefer, responder: Require, encrypted: true},
+		"Require to prefer":    {initiator: Require, responder: Prefer, encrypted: true},
+		"Plaintext to prefer":  {initiator: Disable, responder: Prefer},
+		"Plaintext to disable": {initiator: Disable, responder: Disable},
+		"Plaintext to require": {initiator: Disable, responder: Require, fails: true},
+		"Encrypted to disable": {initiator: Prefer, responder: Disable, fails: true},
+		"Required to disable":  {initiator: Require, responder: Disable, fails: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b, errA, errB := pair(t,
+				func(conn net.Conn) (net.Conn, error) {
+					c, err := Initiate(conn, skey, test.initiator, nil)
+					if err == nil && test.initiator == Disable {
+						// Plaintext peers start with the BitTorrent handshake
+						_, err = c.Write(btPrefix)
+					}
+					return c, err
+				},
+				func(conn net.Conn) (net.Conn, error) { return Accept(conn, test.responder, skeys) },
+			)
+			if test.fails {
+				assert.True(t, errA != nil || errB != nil)
+				return
+			}
+			require.Nil(t, errA)
+			require.Nil(t, errB)
+			_, ok := a.(*Conn)
+			assert.Equal(t, test.encrypted, ok)
+			_, ok = b.(*Conn)
+			assert.Equal(t, test.encrypted, ok)
+
+			if test.initiator == Disable {
+				got := make([]byte, len(btPrefix))
+				_, err := io.ReadFull(b, got)
+				require.Nil(t, err)
+				assert.Equal(t, btPrefix, got)
+			}
+
+			// Both ways work once the handshake is done
+			_, err := a.Write([]byte("hello"))
+			require.Nil(t, err)
+			got := make([]byte, 5)
+			_, err = io.ReadFull(b, got)
+			require.Nil(t, err)
+			assert.Equal(t, "hello", string(got))
+
+			_, err = b.Write([]byte("there"))
+			require.Nil(t, err)
+			_, err = io.ReadFull(a, got)
+			require.Nil(t, err)
+			assert.Equal(t, "there", string(got))
+		})
+	}
+}
+
+func TestInitialPayload(t *testing.T) {
+	skey := [20]byte{'s'}
+	a, b, errA, errB := pair(t,
+		func(conn net.Conn) (net.Conn, error) { return Initiate(conn, skey, Require, []byte("first")) },
+		func(conn net.Conn) (net.Conn, error) {
+			return Accept(conn, Prefer, func() [][20]byte { return [][20]byte{skey} })
+		},
+	)
+	require.Nil(t, errA)
+	require.Nil(t, errB)
+
+	_, err := a.Write([]byte(" second"))
+	require.Nil(t, err)
+	got := make([]byte, len("first second"))
+	_, err = io.ReadFull(b, got)
+	require.Nil(t, err)
+	assert.Equal(t, "first second", string(got))
+}
+
+func TestUnknownSKey(t *testing.T) {
+	_, _, _, err := pair(t,
+		func(conn net.Conn) (net.Conn, error) { return Initiate(conn, [20]byte{'a'}, Require, nil) },
+		func(conn net.Conn) (net.Conn, error) {
+			return Accept(conn, Require, func() [][20]byte { return [][20]byte{{'b'}} })
+		},
+	)
+	assert.Equal(t, errUnknownSKey, err)
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{Disable, Prefer, Require} {
+		got, err := ParseMode(m.String())
+		assert.Nil(t, err)
+		assert.Equal(t, m, got)
+	}
+	_, err := ParseMode("sometimes")
+	assert.NotNil(t, err)
+}
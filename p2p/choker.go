@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/sirupsen/logrus"
+)
+
+// ChokeInterval is how often the choker picks the peers that get unchoked
+var ChokeInterval = 10 * time.Second
+
+const (
+	// OptimisticInterval is how often the optimistic unchoke moves to another peer
+	OptimisticInterval = 30 * time.Second
+
+	// DefaultUnchokeSlots is the number of peers unchoked for their rate when Torrent.UnchokeSlots is 0
+	DefaultUnchokeSlots = 4
+
+	// newPeerTime is how long a peer counts as new, new peers are three times as likely to be picked
+	// for the optimistic unchoke so they get a first piece to trade with
+	newPeerTime = time.Minute
+)
+
+// ChokeEvent is a single decision of the choker
+type ChokeEvent struct {
+	Peer       peers.Peer
+	Choked     bool
+	Optimistic bool    // Unchoked for the optimistic slot rather than its rate
+	Rate       float64 // Bytes per second the peer was ranked by
+}
+
+// choker unchokes the interested peers with the best rates, plus one optimistic unchoke that
+// rotates so that new peers get a chance to show what they can do
+type choker struct {
+	slots  int
+	events chan<- ChokeEvent
+	l      *logrus.Entry
+
+	optimistic *peerConn
+	lastRotate time.Time
+	lastRound  time.Time
+	counted    map[*peerConn]int64 // Bytes each peer was at last round
+}
+
+func newChoker(slots int, events chan<- ChokeEvent, l *logrus.Entry) *choker {
+	if slots <= 0 {
+		slots = DefaultUnchokeSlots
+	}
+	return &choker{
+		slots:     slots,
+		events:    events,
+		l:         l,
+		lastRound: time.Now(),
+		counted:   map[*peerConn]int64{},
+	}
+}
+
+// rechoke runs a round of the choker. Peers are ranked by how fast they send to us,
+// or by how fast we send to them when seeding since then nobody sends us anything
+func (ch *choker) rechoke(conns []*peerConn, seeding bool) {
+	now := time.Now()
+	elapsed := now.Sub(ch.lastRound).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	ch.lastRound = now
+
+	rates := map[*peerConn]float64{}
+	counted := map[*peerConn]int64{}
+	var interested []*peerConn
+	for _, p := range conns {
+		bytes := atomic.LoadInt64(&p.downloadedFrom)
+		if seeding {
+			bytes = atomic.LoadInt64(&p.uploadedTo)
+		}
+		rates[p] = float64(bytes-ch.counted[p]) / elapsed
+		counted[p] = bytes
+
+		if p.isInterested() {
+			interested = append(interested, p)
+		}
+	}
+	ch.counted = counted
+
+	// Ties go to the peers that already have a regular slot, so they don't get choked for nothing
+	regular := func(p *peerConn) bool { return !p.isChoking() && p != ch.optimistic }
+	sort.SliceStable(interested, func(i, j int) bool {
+		a, b := interested[i], interested[j]
+		if rates[a] != rates[b] {
+			return rates[a] > rates[b]
+		}
+		return regular(a) && !regular(b)
+	})
+	unchoke := map[*peerConn]bool{}
+	for i := 0; i < len(interested) && i < ch.slots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	// The optimistic unchoke stays put unless it is time to move it, or its peer left or got a regular slot
+	was := ch.optimistic
+	if _, ok := rates[ch.optimistic]; !ok || unchoke[ch.optimistic] || !ch.optimistic.isInterested() ||
+		now.Sub(ch.lastRotate) >= OptimisticInterval {
+		ch.optimistic = pickOptimistic(interested, unchoke, now)
+		ch.lastRotate = now
+	}
+
+	for _, p := range conns {
+		switch {
+		case unchoke[p]:
+			ch.set(p, false, false, p == was, rates[p])
+		case p == ch.optimistic:
+			ch.set(p, false, true, p == was, rates[p])
+		default:
+			ch.set(p, true, false, p == was, rates[p])
+		}
+	}
+}
+
+// pickOptimistic picks a random interested peer that did not get a regular slot
+func pickOptimistic(interested []*peerConn, unchoked map[*peerConn]bool, now time.Time) *peerConn {
+	var pool []*peerConn
+	for _, p := range interested {
+		if unchoked[p] {
+			continue
+		}
+		pool = append(pool, p)
+		if now.Sub(p.connected) < newPeerTime {
+			pool = append(pool, p, p)
+		}
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[rand.Intn(len(pool))]
+}
+
+// set chokes or unchokes a peer, decisions that change anything go out as events. An unchoked peer moving
+// between the optimistic slot and a regular one counts as a change too
+func (ch *choker) set(p *peerConn, choke, optimistic, wasOptimistic bool, rate float64) {
+	if p.isChoking() == choke {
+		if choke || optimistic == wasOptimistic {
+			return
+		}
+	} else {
+		var err error
+		if choke {
+			err = p.choke()
+		} else {
+			err = p.unchoke()
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	event := ChokeEvent{Peer: p.Peer(), Choked: choke, Optimistic: optimistic, Rate: rate}
+	ch.l.WithField("Peer", event.Peer.IP).Debugf("Choker decision: %+v", event)
+	if ch.events != nil {
+		select {
+		case ch.events <- event:
+		default:
+		}
+	}
+}
+
+// runChoker runs the choker every interval, or right away when a peer becomes interested
+// while there are slots free, until stop is closed
+func (t *Torrent) runChoker(stop <-chan struct{}, interval time.Duration, l *logrus.Entry) {
+	ch := newChoker(t.UnchokeSlots, t.ChokeEvents, l)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-t.rechoke:
+			if t.unchoked() >= ch.slots {
+				continue
+			}
+		}
+		ch.rechoke(t.peerConns(), t.complete())
+	}
+}
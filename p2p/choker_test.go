@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// chokerPeer is a peer whose side of the pipe is thrown away, downloaded and uploaded are the bytes
+// counted since the last round
+type chokerPeer struct {
+	interested bool
+	downloaded int64
+	uploaded   int64
+}
+
+func chokerConns(t *testing.T, tor *Torrent, ps []chokerPeer) []*peerConn {
+	var conns []*peerConn
+	for _, cp := range ps {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			local.Close()
+			remote.Close()
+		})
+		go io.Copy(ioutil.Discard, remote)
+
+		p := newPeerConn(tor, &client.Client{Conn: local, Choked: true}, logrus.NewEntry(logrus.StandardLogger()))
+		p.connected = time.Now().Add(-time.Hour)
+		p.interested = cp.interested
+		p.downloadedFrom = cp.downloaded
+		p.uploadedTo = cp.uploaded
+		conns = append(conns, p)
+	}
+	return conns
+}
+
+func TestRechoke(t *testing.T) {
+	type testCase struct {
+		slots    int
+		seeding  bool
+		peers    []chokerPeer
+		unchoked []int // Peers that must get a regular slot
+		choked   []int // Peers that can't even get the optimistic slot
+	}
+
+	tcs := map[string]testCase{
+		"Fastest peers get the slots": {
+			peers: []chokerPeer{
+				{true, 100, 0}, {true, 500, 0}, {true, 300, 0}, {true, 400, 0},
+				{true, 200, 0}, {true, 0, 0},
+			},
+			unchoked: []int{1, 2, 3, 4},
+		},
+		"Peers that aren't interested stay choked": {
+			peers: []chokerPeer{
+				{false, 1000, 0}, {true, 10, 0}, {false, 500, 0},
+			},
+			unchoked: []int{1},
+			choked:   []int{0, 2},
+		},
+		"Seeding ranks by upload": {
+			seeding: true,
+			peers: []chokerPeer{
+				{true, 1000, 0}, {true, 0, 50}, {true, 0, 10},
+			},
+			slots:    1,
+			unchoked: []int{1},
+		},
+		"Custom slots": {
+			slots: 2,
+			peers: []chokerPeer{
+				{true, 1, 0}, {true, 3, 0}, {true, 2, 0}, {false, 0, 0},
+			},
+			unchoked: []int{1, 2},
+			choked:   []int{3},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			tor, _ := testSeed(t, 32768, 32768)
+			conns := chokerConns(t, tor, tc.peers)
+			ch := newChoker(tc.slots, nil, logrus.NewEntry(logrus.StandardLogger()))
+			ch.rechoke(conns, tc.seeding)
+
+			for _, i := range tc.unchoked {
+				assert.False(t, conns[i].isChoking(), "peer %v should be unchoked", i)
+				assert.NotEqual(t, conns[i], ch.optimistic, "peer %v got a regular slot", i)
+			}
+			for _, i := range tc.choked {
+				assert.True(t, conns[i].isChoking(), "peer %v should be choked", i)
+			}
+
+			// Whoever is left over and interested is a candidate for the optimistic unchoke
+			slots := tc.slots
+			if slots == 0 {
+				slots = DefaultUnchokeSlots
+			}
+			unchoked := 0
+			for _, p := range conns {
+				if !p.isChoking() {
+					unchoked++
+				}
+			}
+			if ch.optimistic != nil {
+				assert.False(t, ch.optimistic.isChoking())
+				assert.True(t, ch.optimistic.isInterested())
+				assert.Equal(t, len(tc.unchoked)+1, unchoked)
+			} else {
+				assert.Equal(t, len(tc.unchoked), unchoked)
+			}
+			assert.LessOrEqual(t, unchoked, slots+1)
+		})
+	}
+}
+
+func TestChokeEvents(t *testing.T) {
+	tor, _ := testSeed(t, 32768, 32768)
+	conns := chokerConns(t, tor, []chokerPeer{{true, 100, 0}, {true, 50, 0}})
+	events := make(chan ChokeEvent, 10)
+	ch := newChoker(1, events, logrus.NewEntry(logrus.StandardLogger()))
+
+	ch.rechoke(conns, false)
+	assert.Len(t, events, 2)
+	first, second := <-events, <-events
+	assert.False(t, first.Choked)
+	assert.False(t, first.Optimistic)
+	assert.False(t, second.Choked)
+	assert.True(t, second.Optimistic)
+
+	// Nothing changed so nothing gets sent
+	ch.rechoke(conns, false)
+	assert.Len(t, events, 0)
+
+	// The optimistic peer leaves, it can't be replaced since nobody else is left over
+	ch.rechoke(conns[:1], false)
+	assert.Len(t, events, 0)
+	assert.Nil(t, ch.optimistic)
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	tor, _ := testSeed(t, 32768, 32768)
+	conns := chokerConns(t, tor, []chokerPeer{{true, 100, 0}, {true, 0, 0}, {true, 0, 0}, {true, 0, 0}})
+	ch := newChoker(1, nil, logrus.NewEntry(logrus.StandardLogger()))
+
+	ch.rechoke(conns, false)
+	optimistic := ch.optimistic
+	assert.NotNil(t, optimistic)
+	assert.NotEqual(t, conns[0], optimistic)
+
+	// Stays put until the interval is up
+	ch.rechoke(conns, false)
+	assert.Equal(t, optimistic, ch.optimistic)
+
+	// Once it's up only the new optimistic peer and the regular slot are unchoked
+	ch.lastRotate = time.Now().Add(-OptimisticInterval)
+	ch.rechoke(conns, false)
+	unchoked := 0
+	for _, p := range conns {
+		if !p.isChoking() {
+			unchoked++
+		}
+	}
+	assert.Equal(t, 2, unchoked)
+	assert.False(t, ch.optimistic.isChoking())
+}
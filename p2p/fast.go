@@ -0,0 +1,41 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// AllowedFastPieces is the number of pieces peers with the fast extension can request from us while choked
+const AllowedFastPieces = 10
+
+// allowedFastSet is the canonical set of k allowed fast pieces of a peer (BEP 6). It's worked out from the
+// /24 of the peer's address, so peers can't get more by opening more connections. There's no set for IPv6
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip = ip.To4()
+	if ip == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []int
+	seen := map[int]bool{}
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
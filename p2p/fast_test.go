@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	// Examples from BEP 6
+	tests := map[string]struct {
+		ip        string
+		numPieces int
+		k         int
+		want      []int
+		anyOrder  bool
+	}{
+		"Seven pieces": {ip: "80.4.4.200", numPieces: 1313, k: 7, want: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		"Nine pieces":  {ip: "80.4.4.200", numPieces: 1313, k: 9, want: []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		"Same /24":     {ip: "80.4.4.1", numPieces: 1313, k: 7, want: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		"Few pieces":   {ip: "80.4.4.200", numPieces: 3, k: 10, want: []int{0, 1, 2}, anyOrder: true},
+		"IPv6":         {ip: "::1", numPieces: 1313, k: 7},
+	}
+
+	for name, test := range tests {
+		got := allowedFastSet(net.ParseIP(test.ip), infoHash, test.numPieces, test.k)
+		if test.anyOrder {
+			assert.ElementsMatch(t, test.want, got, name)
+			continue
+		}
+		assert.Equal(t, test.want, got, name)
+	}
+}
+
+func TestFastRequests(t *testing.T) {
+	tor, data := testSeed(t, 16384, 3*16384, 2)
+	p, conn := fakeLeecher(t, tor)
+	p.Fast = true
+	p.allowing[1] = true
+
+	// Choking rejects the queued requests except for the allowed fast ones. Nothing poked the upload side so
+	// the requests stay queued
+	p.mu.Lock()
+	p.choking = false
+	p.requests = []blockRequest{{0, 0, 10}, {1, 10, 10}, {0, 10, 10}}
+	p.mu.Unlock()
+	go p.choke()
+	assert.Equal(t, message.MsgChoke, read(t, conn).ID)
+	assert.Equal(t, message.FormatReject(0, 0, 10), read(t, conn))
+	assert.Equal(t, message.FormatReject(0, 10, 10), read(t, conn))
+
+	// Cancelled requests get rejected too, every request gets an answer
+	send(t, conn, message.FormatCancel(1, 10, 10))
+	assert.Equal(t, message.FormatReject(1, 10, 10), read(t, conn))
+	p.mu.Lock()
+	assert.Empty(t, p.requests)
+	p.mu.Unlock()
+
+	// Choked requests and ones we can't serve get rejected, allowed fast pieces get served while choked
+	send(t, conn, message.FormatRequest(0, 0, 10))
+	assert.Equal(t, message.FormatReject(0, 0, 10), read(t, conn))
+	send(t, conn, message.FormatRequest(2, 0, 10))
+	assert.Equal(t, message.FormatReject(2, 0, 10), read(t, conn))
+	send(t, conn, message.FormatRequest(1, 0, 10))
+	assert.Equal(t, message.FormatPiece(1, 0, data[16384:16394]), read(t, conn))
+}
+
+func TestAllowedFast(t *testing.T) {
+	tor, _ := testSeed(t, 16384, 2*16384, 0, 1)
+	tor.picker = newPicker(tor, tor.bitfield)
+	p, conn := fakeLeecher(t, tor)
+	p.Fast = true
+	p.Bitfield = bitfield.Bitfield{0xc0}
+
+	// While choked only the allowed fast pieces get picked
+	assert.Equal(t, bitfield.Bitfield{0xc0}, p.pickable())
+	send(t, conn, message.FormatAllowedFast(1), nil)
+	assert.Equal(t, bitfield.Bitfield{0x40}, p.pickable())
+	assert.True(t, p.canRequest(1))
+	assert.False(t, p.canRequest(0))
+
+	pw, _ := tor.picker.pick(p.pickable())
+	require.NotNil(t, pw)
+	require.Equal(t, 1, pw.index)
+	_, _, ok := tor.picker.nextRequest(pw, p)
+	require.True(t, ok)
+
+	// A reject lets the block be requested again, and when choked the piece is no longer allowed fast
+	send(t, conn, message.FormatReject(1, 0, 16384), nil)
+	assert.Equal(t, 0, tor.picker.backlog(pw, p))
+	assert.False(t, p.canRequest(1))
+}
+
+func TestHaveAll(t *testing.T) {
+	tor := &Torrent{PieceHashes: make([][20]byte, 10)}
+	p := newPeerConn(tor, &client.Client{HaveAll: true}, nil)
+	assert.Equal(t, bitfield.Bitfield{0xff, 0xc0}, p.Bitfield)
+
+	// Have None leaves an empty bitfield, it still needs room for Haves
+	p = newPeerConn(tor, &client.Client{}, nil)
+	assert.Equal(t, bitfield.Bitfield{0, 0}, p.Bitfield)
+}
@@ -2,13 +2,24 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Squwid/squidtorrent/bitfield"
 	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
+	"github.com/Squwid/squidtorrent/extension"
 	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/metadata"
 	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/pex"
+	"github.com/Squwid/squidtorrent/storage"
 	"github.com/Squwid/squidtorrent/util"
 	"github.com/sirupsen/logrus"
 )
@@ -21,15 +32,52 @@ const MaxBlockSize = 16384
 // TODO: Tweak this for better download speeds
 const MaxBacklog = 5
 
+var errPieceDone = errors.New("piece was finished by another peer")
+
 // Torrent contains data to download a torrent from a list of peers
 type Torrent struct {
 	Peers       []peers.Peer
 	PeerID      [20]byte   // This client identifier
 	InfoHash    [20]byte   // File that we need, seeder must have entire file to download
+	InfoHashV2  [20]byte   // Optional, the truncated v2 infohash of a hybrid torrent. Peers can connect with it too
 	PieceHashes [][20]byte // Hash of each individual file piece (usually more than 16KB)
 	PieceLength int
 	Length      int
 	Name        string
+	Private     bool                // Private torrents only use peers from their trackers, no PEX or DHT
+	Metadata    []byte              // Raw info dictionary, served to peers that fetch it from us (BEP 9)
+	Extensions  []extension.Handler // Extension protocol handlers on top of the built in ones
+	DHT         *dht.Server         // Optional, finds more peers and announces us on Port
+	Listener    *client.Listener    // Optional, accepts peers that connect to us
+	Dialer      client.Dialer       // How we connect to peers
+	Port        uint16
+	Storage     storage.Storage                   // Where pieces are kept, in memory when nil
+	Have        bitfield.Bitfield                 // Pieces that are already in Storage, they do not get downloaded again
+	OnPiece     func(index int)                   // Optional, called once a piece is verified and written to Storage
+	OnComplete  func()                            // Optional, called once the last missing piece is written
+	Seed        bool                              // Keep serving peers once every piece is there, until the download is stopped
+	CheckPiece  func(index int, buf []byte) error // Optional, checked after the SHA-1 hash, like the merkle trees of hybrid torrents
+
+	// Hashes answers the hash requests of v2 peers (BEP 52), requests get rejected without it
+	Hashes func(r message.HashRequest) ([][32]byte, error)
+
+	UnchokeSlots int               // Peers unchoked for their rate, defaults to DefaultUnchokeSlots
+	ChokeEvents  chan<- ChokeEvent // Optional, gets every choke and unchoke for debugging. Events are dropped when it is full
+
+	downloaded int64 // Verified bytes downloaded, accessed atomically
+	uploaded   int64 // Bytes sent to peers, accessed atomically
+	mu         sync.Mutex
+	bitfield   bitfield.Bitfield // Pieces we have
+	storage    storage.Storage   // Only pieces in bitfield are valid
+	conns      map[*peerConn]struct{}
+	extensions *extension.Registry
+	pex        *pex.Handler  // nil for private torrents
+	rechoke    chan struct{} // Poked when a peer gets interested, the choker may have a slot for it
+	picker     *picker
+
+	initOnce sync.Once
+	newPeers chan []peers.Peer // Peers found while downloading
+	done     chan struct{}     // Closed once Download returns
 }
 
 /*
@@ -37,11 +85,19 @@ type Torrent struct {
 	A block is what gets requested and is MaxBlockSize
 */
 
-// pieceWork is what gets sent to the worker to receive a part of the torrent
+// pieceWork is a piece handed out by the picker to the workers downloading it
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+
+	// Guarded by the picker, more than one peer downloads a piece in endgame mode
+	buf      []byte        // Blocks downloaded so far, kept when every peer fails partway through the piece
+	blocks   []bool        // Which blocks of buf are downloaded
+	requests [][]*peerConn // Peers with an outstanding request for each block
+	peers    int           // Peers downloading the piece
+	complete bool          // Every block is downloaded
+	done     chan struct{} // Closed once complete
 }
 
 // pieceResult is the result of a piece that is sent through the result channel from the worker
@@ -50,144 +106,194 @@ type pieceResult struct {
 	buf   []byte
 }
 
-// pieceProgress tracks the progress of getting different blocks and combining them to a piece
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
-func (t *Torrent) startDownloader(peer peers.Peer, workChan chan *pieceWork, resultsChan chan *pieceResult, l *logrus.Entry) {
+func (t *Torrent) startDownloader(peer peers.Peer, resultsChan chan *pieceResult, l *logrus.Entry) {
 	if l == nil {
 		l = &logrus.Entry{}
 	}
 	l = l.WithField("Peer", peer.IP)
+	if peer.ID != ([20]byte{}) {
+		// Trackers sending dictionaries tell us the peer id, the start of it names the client
+		l = l.WithField("PeerID", fmt.Sprintf("%q", peer.ID[:8]))
+	}
 
 	// Create peer connection
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+	c, err := t.Dialer.Dial(peer, t.PeerID, t.InfoHash)
 	if err != nil {
 		l.WithError(err).Errorf("Could not establish connection with peer")
 		return
 	}
-	defer c.Conn.Close()
 	l.Debugf("Successfully completed handshake")
+	t.runDownloader(c, resultsChan, l)
+}
 
-	if err := c.SendUnchoked(); err != nil {
-		l.WithError(err).Errorf("Error sending unchoked to peer")
-		return
+// runDownloader downloads pieces from a connected peer until there is no work left or the peer fails
+func (t *Torrent) runDownloader(c *client.Client, resultsChan chan *pieceResult, l *logrus.Entry) {
+	defer c.Conn.Close()
+
+	// Peers start out choked, the choker decides when they get to download from us
+	p := newPeerConn(t, c, l)
+	if !c.Inbound() {
+		if err := p.sendBitfield(); err != nil {
+			l.WithError(err).Errorf("Error sending bitfield to peer")
+			return
+		}
 	}
 
-	if err := c.SendInterested(); err != nil {
-		l.WithError(err).Errorf("Error sending interested to peer")
-		return
+	if c.SupportsExtensions() {
+		c.Extensions = t.extensions.NewConn(c.Conn)
+		if err := c.Extensions.SendHandshake(); err != nil {
+			l.WithError(err).Errorf("Error sending extended handshake to peer")
+			return
+		}
+
+		// Incoming peers get the others too, they are just not passed on since we don't know their port
+		if t.pex != nil {
+			t.pex.AddConn(c.Extensions, c.Peer(), p.pexFlags())
+			defer t.pex.DropConn(c.Extensions, c.Peer())
+		}
 	}
 
-	// Read from workQueue when possible
-	for pw := range workChan {
-		// Peer doenst have piece, stick back on chan
-		if !c.Bitfield.HasPiece(pw.index) {
-			workChan <- pw
+	if c.Fast {
+		if err := p.sendAllowedFast(); err != nil {
+			l.WithError(err).Errorf("Error sending allowed fast pieces to peer")
+			return
+		}
+	}
+
+	t.addConn(p)
+	defer t.dropConn(p)
+	go p.run()
+
+	// Seeds have nothing to get from other peers
+	if !t.complete() {
+		if err := c.SendInterested(); err != nil {
+			l.WithError(err).Errorf("Error sending interested to peer")
+			return
+		}
+	}
+
+	p.countPieces()
+	defer p.uncountPieces()
+
+	for {
+		pw, changed := t.picker.pick(p.pickable())
+		if pw == nil {
+			// Wait for the peer to get a piece we need, or for a piece to be put back
+			select {
+			case <-changed:
+			case <-p.wake:
+			case <-p.done:
+				return
+			case <-t.done:
+				return
+			}
 			continue
 		}
 
-		buf, err := downloadPiece(c, pw)
+		buf, err := downloadPiece(p, pw)
+		t.picker.release(pw, p)
+		if err == errPieceDone {
+			continue
+		}
 		if err != nil {
 			l.WithError(err).Errorf("Errror downloading piece")
-			workChan <- pw
 			return
 		}
 
-		if err := checkIntegrity(pw, buf); err != nil {
+		err = checkIntegrity(pw, buf)
+		if err == nil && t.CheckPiece != nil {
+			err = t.CheckPiece(pw.index, buf)
+		}
+		if err != nil {
 			l.WithError(err).Errorf("Failed integrity check")
-			workChan <- pw
+			t.picker.failed(pw)
 			continue
 		}
 
-		c.SendHave(pw.index)
-		resultsChan <- &pieceResult{
-			index: pw.index,
-			buf:   buf,
+		t.picker.finished()
+		atomic.AddInt64(&t.downloaded, int64(len(buf)))
+		select {
+		case resultsChan <- &pieceResult{index: pw.index, buf: buf}:
+		case <-t.done:
+			return
 		}
 	}
 }
 
-// downloadPiece gets all blocks and combines them to a piece
-func downloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-
-	// 30 second timeout, incase peer has slow as shit internet.
-	// Disable the deadline after successful download
-	c.Conn.SetDeadline(time.Now().Add(1 * time.Minute))
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-
-				// Handle last block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
+// downloadPiece gets all blocks and combines them to a piece, blocks that are already there are skipped. In
+// endgame mode other peers download the same piece, errPieceDone means one of them got the last block
+func downloadPiece(p *peerConn, pw *pieceWork) ([]byte, error) {
+	pk := p.t.picker
+
+	// 1 minute timeout, incase peer has slow as shit internet.
+	timeout := time.NewTimer(1 * time.Minute)
+	defer timeout.Stop()
+
+	for {
+		if p.canRequest(pw.index) {
+			for pk.backlog(pw, p) < MaxBacklog {
+				begin, length, ok := pk.nextRequest(pw, p)
+				if !ok {
+					break
 				}
 
 				// Give us the data!
-				if err := c.SendRequest(pw.index, state.requested, blockSize); err != nil {
+				if err := p.SendRequest(pw.index, begin, length); err != nil {
 					return nil, err
 				}
-				state.backlog++
-				state.requested += blockSize
 			}
+		} else if !p.Fast {
+			// Being choked drops our requests, with the fast extension they get rejected instead
+			pk.forget(pw, p)
 		}
 
 		// If choked, will sit here and wait
-		if err := state.readMsg(); err != nil {
-			return nil, err
+		select {
+		case msg := <-p.pieces:
+			index, begin, block, err := parseBlock(msg)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&p.downloadedFrom, int64(len(block)))
+
+			cancel, complete, err := pk.received(pw, p, index, begin, block)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range cancel {
+				other.SendCancel(index, begin, len(block))
+				poke(other.wake)
+			}
+			if complete {
+				return pw.buf, nil
+			}
+		case <-pw.done:
+			return nil, errPieceDone
+		case <-p.wake:
+		case <-p.done:
+			return nil, p.closeErr()
+		case <-timeout.C:
+			return nil, fmt.Errorf("timed out downloading piece %v", pw.index)
 		}
 	}
-	return state.buf, nil
 }
 
-func (state *pieceProgress) readMsg() error {
-	// This call blocks until peer sends a message. If timeout is hit, peer is dropped and requeue'd
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
+// blockSize is the size of the block at begin, the last block of a piece can be smaller
+func blockSize(length, begin int) int {
+	if length-begin < MaxBlockSize {
+		return length - begin
 	}
+	return MaxBlockSize
+}
 
-	// Keep alive
-	if msg == nil {
-		return nil
-	}
-
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		// Peer can get piece of the file mid download and let us know
-		index, err := msg.ParseHave()
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-
-	case message.MsgPiece:
-		n, err := msg.ParsePiece(state.index, state.buf)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+// parseBlock splits a piece message into the index and offset of the block and its data
+func parseBlock(msg *message.Message) (index, begin int, block []byte, err error) {
+	if msg.ID != message.MsgPiece || len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("bad piece message")
 	}
-	return nil
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
@@ -198,6 +304,139 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
+func (t *Torrent) init() {
+	t.initOnce.Do(func() {
+		t.newPeers = make(chan []peers.Peer, 16)
+		t.done = make(chan struct{})
+	})
+}
+
+// AddPeers hands more peers to a running download, peers that were already tried are skipped.
+// Peers added after the download finished are dropped
+func (t *Torrent) AddPeers(ps []peers.Peer) {
+	t.init()
+	select {
+	case t.newPeers <- ps:
+	case <-t.done:
+	}
+}
+
+// Bitfield is a copy of the pieces we have
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	copy(bf, t.bitfield)
+	return bf
+}
+
+func (t *Torrent) addConn(p *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[p] = struct{}{}
+}
+
+func (t *Torrent) dropConn(p *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, p)
+}
+
+// peerConns returns every connected peer
+func (t *Torrent) peerConns() []*peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := make([]*peerConn, 0, len(t.conns))
+	for p := range t.conns {
+		conns = append(conns, p)
+	}
+	return conns
+}
+
+// unchoked is the number of peers we are not choking
+func (t *Torrent) unchoked() int {
+	n := 0
+	for _, p := range t.peerConns() {
+		if !p.isChoking() {
+			n++
+		}
+	}
+	return n
+}
+
+// complete tells if we have every piece
+func (t *Torrent) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.PieceHashes {
+		if !t.bitfield.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Uploaded is the number of bytes sent to peers
+func (t *Torrent) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// validRequest tells if a peer asked for a block of a piece we have, that is no bigger than MaxBlockSize
+func (t *Torrent) validRequest(index, begin, length int) bool {
+	if index < 0 || index >= len(t.PieceHashes) || length <= 0 || length > MaxBlockSize || begin < 0 {
+		return false
+	}
+	if begin+length > t.pieceSize(index) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bitfield.HasPiece(index)
+}
+
+// readBlock reads a block of a piece we have
+func (t *Torrent) readBlock(index, begin, length int) ([]byte, error) {
+	t.mu.Lock()
+	has := t.bitfield.HasPiece(index)
+	t.mu.Unlock()
+
+	if !has {
+		return nil, fmt.Errorf("piece %v is not downloaded", index)
+	}
+	block := make([]byte, length)
+	if _, err := t.storage.Piece(index).ReadAt(block, int64(begin)); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Left is the number of bytes of pieces we still need
+func (t *Torrent) Left() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bf := t.bitfield
+	if bf == nil {
+		bf = t.Have
+	}
+	var left int64
+	for i := range t.PieceHashes {
+		if !bf.HasPiece(i) {
+			left += int64(t.pieceSize(i))
+		}
+	}
+	return left
+}
+
+// Downloaded is the number of bytes of verified pieces that have been downloaded
+func (t *Torrent) Downloaded() int64 {
+	return atomic.LoadInt64(&t.downloaded)
+}
+
 // pieceBounds gets the piece length. all pieces will be the same except the end piece
 func (t *Torrent) pieceBounds(index int) (begin int, end int) {
 	begin = index * t.PieceLength
@@ -214,40 +453,185 @@ func (t *Torrent) pieceSize(index int) int {
 	return end - begin
 }
 
-// Download downloads the torrent. This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
+// Download downloads the pieces of the torrent that are not in Have into Storage, or into memory if
+// there is no Storage. It returns once every piece is there, with Seed it goes on serving peers until
+// ctx is done. Stopping it before every piece is there returns the error of ctx
+func (t *Torrent) Download(ctx context.Context) error {
+	// Seeding needs someone to find us
+	if t.Left() == 0 && (!t.Seed || t.Listener == nil) {
+		return nil
+	}
+
+	useDHT := t.DHT != nil && !t.Private
+	if t.Left() > 0 && len(t.Peers) == 0 && !useDHT && t.Listener == nil {
+		return fmt.Errorf("no peers to download from")
+	}
+
 	logger := logrus.WithField("Name", t.Name)
+	msg := "Starting torrent download"
+	if t.Left() == 0 {
+		msg = "Seeding torrent"
+	}
 	logger.WithFields(logrus.Fields{
 		"Peers":    len(t.Peers),
 		"Size":     util.FormatBytes(t.Length),
 		"InfoHash": string(t.InfoHash[:]),
-	}).Infof("Starting torrent download")
+	}).Infof(msg)
+
+	t.init()
+	defer close(t.done)
+
+	t.mu.Lock()
+	t.bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	copy(t.bitfield, t.Have)
+	t.storage = t.Storage
+	if t.storage == nil {
+		t.storage = storage.NewMemoryStorage(int64(t.PieceLength), int64(t.Length))
+	}
+	t.conns = map[*peerConn]struct{}{}
+	t.mu.Unlock()
+
+	t.rechoke = make(chan struct{}, 1)
+	go t.runChoker(t.done, ChokeInterval, logger)
 
-	// Initialize channels
-	workChan := make(chan *pieceWork, len(t.PieceHashes))
+	handlers := append([]extension.Handler(nil), t.Extensions...)
+	if len(t.Metadata) > 0 {
+		handlers = append(handlers, metadata.NewServer(t.Metadata))
+	}
+	if !t.Private {
+		t.pex = pex.New(t.AddPeers)
+		handlers = append(handlers, t.pex)
+		go t.pex.Run(t.done)
+	}
+	t.extensions = extension.NewRegistry(handlers...)
+	t.extensions.Reqq = MaxRequests
+	if t.Listener != nil {
+		t.extensions.Port = t.Listener.Port()
+	}
+
+	t.picker = newPicker(t, t.bitfield)
 	resultsChan := make(chan *pieceResult)
-	for i, hash := range t.PieceHashes {
-		length := t.pieceSize(i)
-		workChan <- &pieceWork{
-			index:  i,
-			hash:   hash,
-			length: length,
+	donePieces := t.picker.done
+	complete := func() bool { return donePieces == len(t.PieceHashes) }
+
+	// Peers that connect to us are downloaded from and uploaded to the same way
+	var incoming <-chan *client.Client
+	if t.Listener != nil {
+		var err error
+		if incoming, err = t.Listener.Register(t.InfoHash, t.PeerID, t.Bitfield); err != nil {
+			return err
+		}
+		defer t.Listener.Unregister(t.InfoHash)
+		if t.InfoHashV2 != [20]byte{} {
+			if err := t.Listener.Alias(t.InfoHashV2, t.InfoHash); err != nil {
+				return err
+			}
 		}
 	}
 
 	// get to fucking work
-	for _, peer := range t.Peers {
-		go t.startDownloader(peer, workChan, resultsChan, logger)
+	tried := map[string]bool{}
+	active := 0
+	exited := make(chan struct{})
+	spawn := func(download func()) {
+		active++
+		go func() {
+			download()
+			select {
+			case exited <- struct{}{}:
+			case <-t.done:
+			}
+		}()
+	}
+	start := func(ps []peers.Peer) {
+		// Seeds wait for peers to come to them
+		if complete() {
+			return
+		}
+		for _, peer := range ps {
+			if tried[peer.String()] {
+				continue
+			}
+			tried[peer.String()] = true
+
+			peer := peer
+			spawn(func() { t.startDownloader(peer, resultsChan, logger) })
+		}
 	}
+	start(t.Peers)
+
+	// The lookup streams peers in until it is done, the channel is drained if we finish first
+	var dhtPeers <-chan peers.Peer
+	if useDHT {
+		dhtPeers = t.DHT.Announce(t.InfoHash, t.Port)
+		defer func() {
+			if dhtPeers != nil {
+				go func(ch <-chan peers.Peer) {
+					for range ch {
+					}
+				}(dhtPeers)
+			}
+		}()
+	}
+
+	for !complete() || t.Seed {
+		var res *pieceResult
+		select {
+		case <-ctx.Done():
+			if complete() {
+				return nil
+			}
+			return ctx.Err()
+		case res = <-resultsChan:
+		case ps := <-t.newPeers:
+			start(ps)
+			continue
+		case c := <-incoming:
+			spawn(func() { t.runDownloader(c, resultsChan, logger.WithField("Peer", c.Peer().IP)) })
+			continue
+		case peer, ok := <-dhtPeers:
+			if ok {
+				start([]peers.Peer{peer})
+				continue
+			}
+			dhtPeers = nil
+		case <-exited:
+			active--
+		}
+
+		// Every downloader exiting means there is no one left to download from or seed to, unless more
+		// can connect to us
+		if res == nil {
+			if active == 0 && dhtPeers == nil && t.Listener == nil {
+				if complete() {
+					return nil
+				}
+				return fmt.Errorf("all peers disconnected after %v/%v pieces", donePieces, len(t.PieceHashes))
+			}
+			continue
+		}
 
-	// TODO: Change to file store instead of mem store
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-resultsChan
-		begin, end := t.pieceBounds(res.index)
-		copy(buf[begin:end], res.buf)
+		if _, err := t.storage.Piece(res.index).WriteAt(res.buf, 0); err != nil {
+			return fmt.Errorf("error writing piece %v: %w", res.index, err)
+		}
+		t.mu.Lock()
+		t.bitfield.SetPiece(res.index)
+		t.mu.Unlock()
 		donePieces++
+		if t.OnPiece != nil {
+			t.OnPiece(res.index)
+		}
+
+		// Every peer gets to know, the ones still downloading might want it from us. A peer that is slow to
+		// read doesn't hold up the rest
+		for _, p := range t.peerConns() {
+			go func(p *peerConn, index int, done bool) {
+				p.SendHave(index)
+				if done {
+					p.SendNotInterested()
+				}
+			}(p, res.index, complete())
+		}
 
 		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
 		logger.WithFields(logrus.Fields{
@@ -255,8 +639,10 @@ func (t *Torrent) Download() ([]byte, error) {
 			"Piece":        res.index,
 			"Total Pieces": len(t.PieceHashes),
 		}).Infof("Downloaded piece")
-	}
-	close(workChan)
 
-	return buf, nil
+		if complete() && t.OnComplete != nil {
+			t.OnComplete()
+		}
+	}
+	return nil
 }
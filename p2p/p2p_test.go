@@ -1 +1,257 @@
 package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadPrivateSkipsDHT(t *testing.T) {
+	router, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer router.Close()
+
+	d, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{router.Addr().String()}})
+	require.Nil(t, err)
+	defer d.Close()
+	require.Nil(t, d.Bootstrap())
+
+	// Nothing listens on the peer, so the download fails without ever looking at the DHT
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+
+	torrent := Torrent{
+		Peers:       []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{{}},
+		PieceLength: 16384,
+		Length:      100,
+		Private:     true,
+		DHT:         d,
+		Port:        6881,
+	}
+	err = torrent.Download(context.Background())
+	assert.NotNil(t, err)
+
+	assert.Never(t, func() bool {
+		for range router.GetPeers(torrent.InfoHash) {
+			return true
+		}
+		return false
+	}, 300*time.Millisecond, 50*time.Millisecond)
+
+	torrent.Peers = nil
+	err = torrent.Download(context.Background())
+	assert.EqualError(t, err, "no peers to download from")
+}
+
+func TestDownloadHave(t *testing.T) {
+	torrent := Torrent{
+		PieceHashes: [][20]byte{{}, {}, {}},
+		PieceLength: 16384,
+		Length:      40000,
+		Have:        bitfield.Bitfield{0xa0},
+	}
+	assert.EqualValues(t, 16384, torrent.Left())
+
+	// Every piece is there so no peers are needed
+	torrent.Have = bitfield.Bitfield{0xe0}
+	assert.EqualValues(t, 0, torrent.Left())
+	assert.Nil(t, torrent.Download(context.Background()))
+}
+
+// fakeSeeder is a seed on the other end of a pipe that unchokes us and sends every message it gets on msgs. A
+// slow one never answers requests
+func fakeSeeder(t *testing.T, tor *Torrent, data []byte, slow bool) (*client.Client, <-chan *message.Message) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	msgs := make(chan *message.Message, 100)
+	go remote.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+	go func() {
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			msgs <- msg
+			if msg.ID == message.MsgRequest && !slow {
+				index, begin, length, _ := msg.ParseRequest()
+				offset := index*tor.PieceLength + begin
+				remote.Write(message.FormatPiece(index, begin, data[offset:offset+length]).Serialize())
+			}
+		}
+	}()
+
+	bf := make(bitfield.Bitfield, (len(tor.PieceHashes)+7)/8)
+	for i := range tor.PieceHashes {
+		bf.SetPiece(i)
+	}
+	return &client.Client{Conn: local, Choked: true, Bitfield: bf}, msgs
+}
+
+// expect waits for a message of the seeder with id
+func expect(t *testing.T, msgs <-chan *message.Message, id uint8) *message.Message {
+	for {
+		select {
+		case msg := <-msgs:
+			if uint8(msg.ID) == id {
+				return msg
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("never got message %v", id)
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	tor, data := testSeed(t, 2*MaxBlockSize, 3*MaxBlockSize, 0, 1)
+	tor.init()
+	tor.conns = map[*peerConn]struct{}{}
+	tor.picker = newPicker(tor, tor.bitfield)
+	defer close(tor.done)
+	results := make(chan *pieceResult)
+	l := logrus.NewEntry(logrus.StandardLogger())
+
+	// The slow peer takes a piece and never sends a block of it
+	slow, slowMsgs := fakeSeeder(t, tor, data, true)
+	go tor.runDownloader(slow, results, l)
+	index, _, _, err := expect(t, slowMsgs, uint8(message.MsgRequest)).ParseRequest()
+	require.Nil(t, err)
+	blocks := (tor.pieceSize(index) + MaxBlockSize - 1) / MaxBlockSize
+
+	// The fast peer gets the other piece, then endgame has it ask for the blocks the slow peer is sitting on
+	fast, _ := fakeSeeder(t, tor, data, false)
+	go tor.runDownloader(fast, results, l)
+	var got []int
+	for len(got) < 2 {
+		select {
+		case res := <-results:
+			begin, end := tor.pieceBounds(res.index)
+			assert.Equal(t, data[begin:end], res.buf)
+			got = append(got, res.index)
+		case <-time.After(5 * time.Second):
+			t.Fatal("endgame never finished the pieces")
+		}
+	}
+	assert.ElementsMatch(t, []int{0, 1}, got)
+
+	// Every request of the slow peer got cancelled
+	for i := 0; i < blocks; i++ {
+		msg := expect(t, slowMsgs, uint8(message.MsgCancel))
+		cancelIndex, begin, length, err := msg.ParseRequest()
+		require.Nil(t, err)
+		assert.Equal(t, index, cancelIndex)
+		assert.Equal(t, blockSize(tor.pieceSize(index), begin), length)
+	}
+}
+
+// tcpLeecher connects to the listener as a peer without any pieces that gets interested. A greedy one
+// keeps requesting blocks whenever it is unchoked. Returns the port the torrent sees it on
+func tcpLeecher(t *testing.T, addr string, infoHash [20]byte, greedy bool) uint16 {
+	var peerID [20]byte
+	copy(peerID[:], "-FAKE01-leecherleech")
+
+	// The torrent might not be registered yet, which gets us hung up on
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial("tcp", addr)
+		require.Nil(t, err)
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		if _, err := handshake.Read(conn); err != nil {
+			conn.Close()
+			return false
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0}}).Serialize())
+	conn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+	go func() {
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || !greedy {
+				continue
+			}
+			if msg.ID == message.MsgUnchoke || msg.ID == message.MsgPiece {
+				conn.Write(message.FormatRequest(0, 0, MaxBlockSize).Serialize())
+			}
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.TCPAddr).Port)
+}
+
+func TestSeedRechoke(t *testing.T) {
+	defer func(interval time.Duration) { ChokeInterval = interval }(ChokeInterval)
+	ChokeInterval = 50 * time.Millisecond
+
+	tor, _ := testSeed(t, 32768, 65536)
+	tor.InfoHash = [20]byte{4, 5, 6}
+	tor.Storage, tor.Have = tor.storage, tor.bitfield
+	tor.Private = true
+	tor.Seed = true
+	tor.UnchokeSlots = 1
+	events := make(chan ChokeEvent, 100)
+	tor.ChokeEvents = events
+
+	l, err := client.Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer l.Close()
+	tor.Listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- tor.Download(ctx) }()
+
+	// waitEvent waits for a decision about the peer on port that matches
+	waitEvent := func(port uint16, match func(ChokeEvent) bool) ChokeEvent {
+		for {
+			select {
+			case e := <-events:
+				if e.Peer.Port == port && match(e) {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("never got the choke event for %v", port)
+			}
+		}
+	}
+
+	// The first peer to get interested takes the only slot, though it never asks for anything
+	idle := tcpLeecher(t, l.Addr().String(), tor.InfoHash, false)
+	waitEvent(idle, func(e ChokeEvent) bool { return !e.Choked && !e.Optimistic })
+
+	// The next one only gets in optimistically, once we upload to it it outranks the idle one
+	greedy := tcpLeecher(t, l.Addr().String(), tor.InfoHash, true)
+	waitEvent(greedy, func(e ChokeEvent) bool { return !e.Choked && e.Optimistic })
+	e := waitEvent(greedy, func(e ChokeEvent) bool { return !e.Choked && !e.Optimistic })
+	assert.Greater(t, e.Rate, float64(0))
+
+	cancel()
+	assert.Nil(t, <-errs)
+}
@@ -0,0 +1,532 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/pex"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxRequests is the most requests a peer can have queued with us, anything over it gets dropped.
+// It's advertised as reqq in the extended handshake
+const MaxRequests = 250
+
+var errConnClosed = errors.New("connection closed")
+
+// blockRequest is a block a peer asked us for
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// peerConn is a connected peer shared by the download and the upload side. A single goroutine reads
+// every message, pieces get passed on to the download and requests get queued for the upload
+type peerConn struct {
+	downloadedFrom int64 // Block bytes received from the peer, accessed atomically
+	uploadedTo     int64 // Block bytes sent to the peer, accessed atomically
+
+	*client.Client
+	t         *Torrent
+	l         *logrus.Entry
+	connected time.Time
+	started   bool // Only touched by run, set once a message other than an extended one came in
+
+	mu         sync.Mutex // Guards the fields below, as well as Client.Choked and Client.Bitfield
+	interested bool       // Peer wants pieces from us
+	choking    bool       // We are choking the peer
+	requests   []blockRequest
+	counted    bool         // Pieces of the peer are counted by the picker
+	allowed    map[int]bool // Pieces the peer lets us request while it chokes us (BEP 6)
+	allowing   map[int]bool // Pieces we let the peer request while we choke it
+	err        error        // Why the connection closed
+
+	pieces chan *message.Message // Blocks for the download
+	wake   chan struct{}         // Poked when the peer chokes, unchokes or gets a new piece
+	upload chan struct{}         // Poked when a request gets queued
+	done   chan struct{}         // Closed once the connection is gone
+}
+
+func newPeerConn(t *Torrent, c *client.Client, l *logrus.Entry) *peerConn {
+	// Have All and Have None leave the bitfield empty, and Haves only stick to a bitfield that is long enough
+	if n := (len(t.PieceHashes) + 7) / 8; len(c.Bitfield) < n {
+		c.Bitfield = append(c.Bitfield, make(bitfield.Bitfield, n-len(c.Bitfield))...)
+	}
+	if c.HaveAll {
+		for i := range t.PieceHashes {
+			c.Bitfield.SetPiece(i)
+		}
+	}
+
+	return &peerConn{
+		Client:    c,
+		t:         t,
+		l:         l,
+		connected: time.Now(),
+		started:   !c.Inbound(), // Peers we dialed sent their bitfield before the connection got here
+		choking:   true,
+		pieces:    make(chan *message.Message, MaxBacklog),
+		allowed:   map[int]bool{},
+		allowing:  map[int]bool{},
+		wake:      make(chan struct{}, 1),
+		upload:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// poke wakes up whoever waits on ch without ever blocking
+func poke(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// run reads messages until the connection fails, the upload side runs alongside it
+func (p *peerConn) run() {
+	go p.serveRequests()
+	defer close(p.done)
+
+	for {
+		msg, err := p.Read()
+		if err == nil && msg != nil {
+			err = p.handle(msg)
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			p.Conn.Close()
+			return
+		}
+	}
+}
+
+// closeErr is why the connection closed
+func (p *peerConn) closeErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		return errConnClosed
+	}
+	return p.err
+}
+
+func (p *peerConn) handle(msg *message.Message) error {
+	// Extended messages are allowed to come before the bitfield
+	first := !p.started
+	if msg.ID != message.MsgExtended {
+		p.started = true
+	}
+
+	switch msg.ID {
+	case message.MsgBitfield, message.MsgHaveAll, message.MsgHaveNone:
+		return p.gotBitfield(msg, first)
+	case message.MsgUnchoke:
+		p.mu.Lock()
+		p.Choked = false
+		p.mu.Unlock()
+		poke(p.wake)
+	case message.MsgChoke:
+		p.mu.Lock()
+		p.Choked = true
+		p.mu.Unlock()
+		poke(p.wake)
+	case message.MsgHave:
+		// Peer can get piece of the file mid download and let us know
+		index, err := msg.ParseHave()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		if !p.Bitfield.HasPiece(index) {
+			p.Bitfield.SetPiece(index)
+			if p.counted && p.Bitfield.HasPiece(index) {
+				p.t.picker.peerHas(index)
+			}
+		}
+		p.mu.Unlock()
+		poke(p.wake)
+
+	case message.MsgReject:
+		// Our request won't be served, the block can be asked for again
+		index, begin, _, err := msg.ParseRequest()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		if p.Choked {
+			delete(p.allowed, index)
+		}
+		p.mu.Unlock()
+		if p.t.picker != nil {
+			p.t.picker.rejected(p, index, begin)
+		}
+		poke(p.wake)
+	case message.MsgAllowedFast:
+		index, err := msg.ParseHave()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.allowed[index] = true
+		p.mu.Unlock()
+		poke(p.wake)
+
+	case message.MsgSuggest:
+		// Suggestions are only a hint, pieces get picked by how rare they are
+		if _, err := msg.ParseHave(); err != nil {
+			return err
+		}
+
+	case message.MsgInterested, message.MsgNotInterested:
+		p.mu.Lock()
+		p.interested = msg.ID == message.MsgInterested
+		p.mu.Unlock()
+		if msg.ID == message.MsgInterested && p.t.rechoke != nil {
+			poke(p.t.rechoke)
+		}
+	case message.MsgRequest:
+		return p.queueRequest(msg)
+	case message.MsgCancel:
+		return p.cancelRequest(msg)
+
+	case message.MsgPiece:
+		// The download is behind on its blocks, the request is forgotten so the block gets asked for again
+		// instead of stalling the piece
+		select {
+		case p.pieces <- msg:
+		default:
+			index, begin, _, err := parseBlock(msg)
+			if err != nil {
+				return err
+			}
+			if p.t.picker != nil {
+				p.t.picker.rejected(p, index, begin)
+			}
+			poke(p.wake)
+		}
+
+	case message.MsgExtended:
+		if p.Extensions != nil {
+			return p.Extensions.Handle(msg)
+		}
+
+	case message.MsgHashRequest:
+		return p.answerHashRequest(msg)
+	case message.MsgHashes, message.MsgHashReject:
+		// We never ask, piece layers only come from torrent files
+	}
+	return nil
+}
+
+// gotBitfield takes the pieces a peer that connected to us starts out with, it has to be the first message.
+// Peers with nothing can leave it out
+func (p *peerConn) gotBitfield(msg *message.Message, first bool) error {
+	if !first {
+		return fmt.Errorf("got message %v after the first message", msg.ID)
+	}
+	if msg.ID != message.MsgBitfield && !p.Fast {
+		return fmt.Errorf("got message %v without the fast extension", msg.ID)
+	}
+
+	p.mu.Lock()
+	for i := range p.t.PieceHashes {
+		has := msg.ID == message.MsgHaveAll || (msg.ID == message.MsgBitfield && bitfield.Bitfield(msg.Payload).HasPiece(i))
+		if has && !p.Bitfield.HasPiece(i) {
+			p.Bitfield.SetPiece(i)
+			if p.counted {
+				p.t.picker.peerHas(i)
+			}
+		}
+	}
+	p.mu.Unlock()
+	poke(p.wake)
+	return nil
+}
+
+// answerHashRequest sends a v2 peer the piece layer hashes it asked for, requests we can't answer get
+// rejected
+func (p *peerConn) answerHashRequest(msg *message.Message) error {
+	r, err := msg.ParseHashRequest()
+	if err != nil {
+		return err
+	}
+
+	reply := message.FormatHashReject(r)
+	if p.t.Hashes != nil {
+		if hashes, err := p.t.Hashes(r); err == nil {
+			reply = message.FormatHashes(r, hashes)
+		}
+	}
+	_, err = p.Conn.Write(reply.Serialize())
+	return err
+}
+
+// choked tells if the peer is choking us
+func (p *peerConn) choked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Choked
+}
+
+// canRequest tells if we can request blocks of a piece, either the peer isn't choking us or the piece is
+// allowed fast
+func (p *peerConn) canRequest(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.Choked || p.allowed[index]
+}
+
+// hasPiece tells if the peer has a piece
+func (p *peerConn) hasPiece(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Bitfield.HasPiece(index)
+}
+
+// pickable is the pieces we can download from the peer right now. While it chokes us that is only the
+// allowed fast pieces, if it gave us any
+func (p *peerConn) pickable() bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bf := append(bitfield.Bitfield(nil), p.Bitfield...)
+	if !p.Choked || len(p.allowed) == 0 {
+		return bf
+	}
+	fast := make(bitfield.Bitfield, len(bf))
+	for index := range p.allowed {
+		if bf.HasPiece(index) {
+			fast.SetPiece(index)
+		}
+	}
+	return fast
+}
+
+// sendBitfield tells a peer we connected to which pieces we have, peers that connect to us got it from the
+// listener already
+func (p *peerConn) sendBitfield() error {
+	msg := client.BitfieldMessage(p.t.Bitfield(), p.Fast)
+	if p.Fast && p.t.complete() {
+		msg = &message.Message{ID: message.MsgHaveAll}
+	}
+	_, err := p.Conn.Write(msg.Serialize())
+	return err
+}
+
+// sendAllowedFast gives a peer with the fast extension its allowed fast set, so it can get its first pieces
+// before it gets unchoked
+func (p *peerConn) sendAllowedFast() error {
+	set := allowedFastSet(p.Peer().IP, p.t.InfoHash, len(p.t.PieceHashes), AllowedFastPieces)
+
+	p.mu.Lock()
+	for _, index := range set {
+		p.allowing[index] = true
+	}
+	p.mu.Unlock()
+
+	for _, index := range set {
+		if err := p.SendAllowedFast(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countPieces adds the pieces of the peer to the picker, pieces it gets later are counted as they come
+func (p *peerConn) countPieces() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counted = true
+	p.t.picker.addPeer(p.Bitfield)
+}
+
+// uncountPieces takes the pieces of the peer back out of the picker
+func (p *peerConn) uncountPieces() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counted = false
+	p.t.picker.removePeer(p.Bitfield)
+}
+
+// pexFlags describes the peer to the ones we exchange peers with
+func (p *peerConn) pexFlags() byte {
+	var flags byte
+	if !p.Inbound() {
+		flags |= pex.FlagConnectable // We dialed it, so it takes connections
+	}
+	if p.Encrypted() {
+		flags |= pex.FlagEncryption
+	}
+	if p.UTP() {
+		flags |= pex.FlagUTP
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.t.PieceHashes {
+		if !p.Bitfield.HasPiece(i) {
+			return flags
+		}
+	}
+	return flags | pex.FlagSeed
+}
+
+// isInterested tells if the peer wants pieces from us
+func (p *peerConn) isInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interested
+}
+
+// isChoking tells if we are choking the peer
+func (p *peerConn) isChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.choking
+}
+
+// unchoke lets the peer request blocks from us
+func (p *peerConn) unchoke() error {
+	p.mu.Lock()
+	p.choking = false
+	p.mu.Unlock()
+	return p.SendUnchoked()
+}
+
+// choke stops serving the peer, its queued requests are thrown away. Peers with the fast extension get a
+// reject for each of them, and keep the ones for allowed fast pieces
+func (p *peerConn) choke() error {
+	p.mu.Lock()
+	p.choking = true
+	var kept, rejected []blockRequest
+	for _, r := range p.requests {
+		if p.allowing[r.index] {
+			kept = append(kept, r)
+		} else {
+			rejected = append(rejected, r)
+		}
+	}
+	p.requests = kept
+	p.mu.Unlock()
+
+	if err := p.SendChoked(); err != nil {
+		return err
+	}
+	for _, r := range rejected {
+		if err := p.reject(r.index, r.begin, r.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject tells a peer with the fast extension we won't serve a request, other peers just never get the block
+func (p *peerConn) reject(index, begin, length int) error {
+	if !p.Fast {
+		return nil
+	}
+	return p.SendReject(index, begin, length)
+}
+
+// queueRequest queues a valid request of a peer we are not choking, or one for an allowed fast piece.
+// Anything else gets rejected
+func (p *peerConn) queueRequest(msg *message.Message) error {
+	index, begin, length, err := msg.ParseRequest()
+	if err != nil {
+		return err
+	}
+	if !p.t.validRequest(index, begin, length) {
+		p.l.Debugf("Ignoring invalid request for piece %v, begin %v, length %v", index, begin, length)
+		return p.reject(index, begin, length)
+	}
+
+	p.mu.Lock()
+	ok := (!p.choking || p.allowing[index]) && len(p.requests) < MaxRequests
+	if ok {
+		p.requests = append(p.requests, blockRequest{index, begin, length})
+		poke(p.upload)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return p.reject(index, begin, length)
+	}
+	return nil
+}
+
+// cancelRequest drops a queued request, blocks that are already on their way can't be stopped. With the
+// fast extension every request gets an answer, so a dropped one is rejected
+func (p *peerConn) cancelRequest(msg *message.Message) error {
+	index, begin, length, err := msg.ParseRequest()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	dropped := false
+	for i, r := range p.requests {
+		if r == (blockRequest{index, begin, length}) {
+			p.requests = append(p.requests[:i], p.requests[i+1:]...)
+			dropped = true
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if dropped {
+		return p.reject(index, begin, length)
+	}
+	return nil
+}
+
+// nextRequest pops the oldest queued request
+func (p *peerConn) nextRequest() (blockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Choking the peer already dropped everything but allowed fast requests
+	if len(p.requests) == 0 {
+		return blockRequest{}, false
+	}
+	r := p.requests[0]
+	p.requests = p.requests[1:]
+	return r, true
+}
+
+// serveRequests sends the blocks the peer asked for until the connection closes
+func (p *peerConn) serveRequests() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.upload:
+		}
+
+		for {
+			r, ok := p.nextRequest()
+			if !ok {
+				break
+			}
+
+			block, err := p.t.readBlock(r.index, r.begin, r.length)
+			if err != nil {
+				p.l.WithError(err).Errorf("Error reading block for peer")
+				continue
+			}
+			if _, err := p.Conn.Write(message.FormatPiece(r.index, r.begin, block).Serialize()); err != nil {
+				return
+			}
+			atomic.AddInt64(&p.t.uploaded, int64(len(block)))
+			atomic.AddInt64(&p.uploadedTo, int64(len(block)))
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/Squwid/squidtorrent/pex"
+	"github.com/Squwid/squidtorrent/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSeed is a torrent of random data that has every piece except the missing ones
+func testSeed(t *testing.T, pieceLength, length int, missing ...int) (*Torrent, []byte) {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+
+	tor := &Torrent{PieceLength: pieceLength, Length: length}
+	tor.storage = storage.NewMemoryStorage(int64(pieceLength), int64(length))
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		tor.PieceHashes = append(tor.PieceHashes, sha1.Sum(data[begin:end]))
+		_, err := tor.storage.Piece(len(tor.PieceHashes)-1).WriteAt(data[begin:end], 0)
+		require.Nil(t, err)
+	}
+
+	tor.bitfield = make(bitfield.Bitfield, (len(tor.PieceHashes)+7)/8)
+	for i := range tor.PieceHashes {
+		tor.bitfield.SetPiece(i)
+	}
+	for _, i := range missing {
+		tor.bitfield[i/8] &^= 1 << uint(7-i%8)
+	}
+	return tor, data
+}
+
+// fakeLeecher connects a peer to the torrent over a pipe, the returned end is the leecher
+func fakeLeecher(t *testing.T, tor *Torrent) (*peerConn, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	c := &client.Client{Conn: local, Choked: true, Bitfield: make(bitfield.Bitfield, len(tor.bitfield))}
+	p := newPeerConn(tor, c, logrus.NewEntry(logrus.StandardLogger()))
+	go p.run()
+	return p, remote
+}
+
+func send(t *testing.T, conn net.Conn, msgs ...*message.Message) {
+	for _, msg := range msgs {
+		_, err := conn.Write(msg.Serialize())
+		require.Nil(t, err)
+	}
+}
+
+func read(t *testing.T, conn net.Conn) *message.Message {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := message.Read(conn)
+	require.Nil(t, err)
+	return msg
+}
+
+// unchoke unchokes the leecher, the pipe blocks until the leecher reads the message
+func unchoke(t *testing.T, p *peerConn, conn net.Conn) {
+	go p.unchoke()
+	assert.Equal(t, message.MsgUnchoke, read(t, conn).ID)
+}
+
+func TestServeRequests(t *testing.T) {
+	tor, data := testSeed(t, 32768, 70000, 1)
+	p, conn := fakeLeecher(t, tor)
+	unchoke(t, p, conn)
+
+	send(t, conn, &message.Message{ID: message.MsgInterested})
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.interested
+	}, time.Second, time.Millisecond)
+
+	// None of these get an answer, the valid request after them does
+	send(t, conn,
+		message.FormatRequest(0, 0, MaxBlockSize+1), // Too big
+		message.FormatRequest(3, 0, 100),            // No such piece
+		message.FormatRequest(2, 4000, 1000),        // Past the end of the short last piece
+		message.FormatRequest(0, 32768-100, 200),    // Past the end of the piece
+		message.FormatRequest(1, 0, 100),            // We don't have it
+		message.FormatRequest(0, 0, 0),              // Empty
+		message.FormatRequest(2, 1000, 3000),        // Good
+	)
+	assert.Equal(t, message.FormatPiece(2, 1000, data[65536+1000:65536+4000]), read(t, conn))
+	assert.Eventually(t, func() bool { return tor.Uploaded() == 3000 }, time.Second, time.Millisecond)
+
+	send(t, conn, message.FormatRequest(0, 32768-10, 10))
+	assert.Equal(t, message.FormatPiece(0, 32768-10, data[32768-10:32768]), read(t, conn))
+
+	send(t, conn, &message.Message{ID: message.MsgNotInterested})
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return !p.interested
+	}, time.Second, time.Millisecond)
+
+	// Malformed requests drop the connection
+	send(t, conn, &message.Message{ID: message.MsgRequest, Payload: []byte{1}})
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection stayed open")
+	}
+	assert.NotNil(t, p.closeErr())
+}
+
+func TestChokedRequests(t *testing.T) {
+	tor, data := testSeed(t, 16384, 16384)
+	p, conn := fakeLeecher(t, tor)
+
+	// Requests while choked are dropped rather than queued. The keep alive only gets read once the request was handled
+	send(t, conn, message.FormatRequest(0, 0, 10), nil)
+	unchoke(t, p, conn)
+	send(t, conn, message.FormatRequest(0, 10, 10))
+	assert.Equal(t, message.FormatPiece(0, 10, data[10:20]), read(t, conn))
+}
+
+func TestCancelRequest(t *testing.T) {
+	tor, data := testSeed(t, 16384, 16384)
+	p, conn := fakeLeecher(t, tor)
+	unchoke(t, p, conn)
+
+	// Nothing is read until everything is sent, so the first block is the only one on its way
+	send(t, conn,
+		message.FormatRequest(0, 0, 10),
+		message.FormatRequest(0, 10, 10),
+		message.FormatRequest(0, 20, 10),
+		message.FormatCancel(0, 10, 10),
+		message.FormatCancel(0, 100, 10), // Never asked for
+	)
+	assert.Equal(t, message.FormatPiece(0, 0, data[0:10]), read(t, conn))
+	assert.Equal(t, message.FormatPiece(0, 20, data[20:30]), read(t, conn))
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := message.Read(conn)
+	assert.NotNil(t, err, "cancelled block got sent")
+}
+
+func TestMaxRequests(t *testing.T) {
+	tor, _ := testSeed(t, 16384, 16384)
+	p, conn := fakeLeecher(t, tor)
+	unchoke(t, p, conn)
+
+	for i := 0; i < MaxRequests+50; i++ {
+		send(t, conn, message.FormatRequest(0, i%100, 1))
+	}
+
+	// One block may have left the queue before it filled up
+	served := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := message.Read(conn); err != nil {
+			break
+		}
+		served++
+	}
+	assert.GreaterOrEqual(t, served, MaxRequests)
+	assert.LessOrEqual(t, served, MaxRequests+1)
+}
+
+func TestPexFlags(t *testing.T) {
+	type testCase struct {
+		bitfield bitfield.Bitfield
+		haveAll  bool
+		expected byte
+	}
+
+	tcs := map[string]testCase{
+		"Leecher we dialed": {
+			bitfield: bitfield.Bitfield{0x80},
+			expected: pex.FlagConnectable,
+		},
+		"Seed": {
+			bitfield: bitfield.Bitfield{0xe0},
+			expected: pex.FlagConnectable | pex.FlagSeed,
+		},
+		"Seed that sent Have All": {
+			haveAll:  true,
+			expected: pex.FlagConnectable | pex.FlagSeed,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			tor, _ := testSeed(t, 16384, 40000)
+			local, remote := net.Pipe()
+			t.Cleanup(func() {
+				local.Close()
+				remote.Close()
+			})
+
+			c := &client.Client{Conn: local, Bitfield: tc.bitfield, HaveAll: tc.haveAll}
+			p := newPeerConn(tor, c, logrus.NewEntry(logrus.StandardLogger()))
+			assert.Equal(t, tc.expected, p.pexFlags())
+		})
+	}
+}
+
+func TestHashRequests(t *testing.T) {
+	tor, _ := testSeed(t, 16384, 40000)
+	_, conn := fakeLeecher(t, tor)
+	r := message.HashRequest{PiecesRoot: [32]byte{1}, Length: 2, ProofLayers: 1}
+
+	// Torrents without v2 piece layers reject every request
+	send(t, conn, message.FormatHashRequest(r))
+	assert.Equal(t, message.FormatHashReject(r), read(t, conn))
+
+	tor.Hashes = func(got message.HashRequest) ([][32]byte, error) {
+		if got.PiecesRoot != r.PiecesRoot {
+			return nil, errors.New("unknown root")
+		}
+		return [][32]byte{{1}, {2}, {3}}, nil
+	}
+	send(t, conn, message.FormatHashRequest(r))
+	assert.Equal(t, message.FormatHashes(r, [][32]byte{{1}, {2}, {3}}), read(t, conn))
+
+	other := message.HashRequest{PiecesRoot: [32]byte{2}, Length: 1}
+	send(t, conn, message.FormatHashRequest(other))
+	assert.Equal(t, message.FormatHashReject(other), read(t, conn))
+}
+
+func TestInboundBitfield(t *testing.T) {
+	type testCase struct {
+		fast     bool
+		msgs     []*message.Message
+		bitfield bitfield.Bitfield
+		fails    bool
+	}
+
+	tcs := map[string]testCase{
+		"Bitfield": {
+			msgs:     []*message.Message{{ID: message.MsgBitfield, Payload: []byte{0xa0}}},
+			bitfield: bitfield.Bitfield{0xa0},
+		},
+		"Extended before the bitfield": {
+			msgs:     []*message.Message{message.FormatExtended(0, []byte("de")), {ID: message.MsgBitfield, Payload: []byte{0x40}}},
+			bitfield: bitfield.Bitfield{0x40},
+		},
+		"No bitfield": {
+			bitfield: bitfield.Bitfield{0x00},
+		},
+		"Have All": {
+			fast:     true,
+			msgs:     []*message.Message{{ID: message.MsgHaveAll}},
+			bitfield: bitfield.Bitfield{0xe0},
+		},
+		"Have None": {
+			fast:     true,
+			msgs:     []*message.Message{{ID: message.MsgHaveNone}},
+			bitfield: bitfield.Bitfield{0x00},
+		},
+		"Have All without the fast extension": {
+			msgs:  []*message.Message{{ID: message.MsgHaveAll}},
+			fails: true,
+		},
+		"Bitfield that comes late": {
+			msgs:  []*message.Message{message.FormatHave(0), {ID: message.MsgBitfield, Payload: []byte{0xa0}}},
+			fails: true,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			tor, _ := testSeed(t, 16384, 40000)
+			ln, err := client.Listen("127.0.0.1:0", mse.Disable)
+			require.Nil(t, err)
+			defer ln.Close()
+			conns, err := ln.Register(tor.InfoHash, tor.PeerID, tor.Bitfield)
+			require.Nil(t, err)
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			require.Nil(t, err)
+			defer conn.Close()
+			hs := handshake.New(tor.InfoHash, [20]byte{'B'})
+			if tc.fast {
+				hs.SetReserved(handshake.ReservedFast)
+			}
+			_, err = conn.Write(hs.Serialize())
+			require.Nil(t, err)
+			_, err = handshake.Read(conn)
+			require.Nil(t, err)
+			read(t, conn)
+
+			// The bitfield is read by the peer loop, the one after it tells when it got there
+			p := newPeerConn(tor, <-conns, logrus.NewEntry(logrus.StandardLogger()))
+			go p.run()
+			send(t, conn, append(tc.msgs, &message.Message{ID: message.MsgInterested})...)
+			if tc.fails {
+				select {
+				case <-p.done:
+				case <-time.After(time.Second):
+					t.Fatal("peer should have been hung up on")
+				}
+				return
+			}
+			assert.Eventually(t, func() bool {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				return p.interested
+			}, time.Second, time.Millisecond)
+			p.mu.Lock()
+			assert.Equal(t, tc.bitfield, p.Bitfield)
+			p.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+)
+
+// RandomPieces is how many pieces we need before going rarest first. The rarest pieces tend to be the slowest
+// to get, random ones get us something to trade with sooner
+const RandomPieces = 4
+
+// picker hands out the pieces to download. It counts how many connected peers have every piece and gives
+// each peer the rarest piece it has, pieces that were partly downloaded by a peer that left go first.
+//
+// Once every piece is taken we are in endgame mode. Peers without work join the pieces that are still being
+// downloaded, and once every block of a piece is requested they ask for the same blocks as the other peers.
+// Whoever gets a block first wins, the other requests for it get cancelled
+type picker struct {
+	mu           sync.Mutex
+	pieces       []*pieceWork // nil for the pieces we had from the start
+	availability []int        // Connected peers that have each piece
+	free         int          // Pieces nobody is downloading
+	done         int
+	changed      chan struct{} // Closed and replaced whenever a piece frees up or endgame starts
+}
+
+func newPicker(t *Torrent, have bitfield.Bitfield) *picker {
+	pk := &picker{
+		pieces:       make([]*pieceWork, len(t.PieceHashes)),
+		availability: make([]int, len(t.PieceHashes)),
+		changed:      make(chan struct{}),
+	}
+	for i, hash := range t.PieceHashes {
+		if have.HasPiece(i) {
+			pk.done++
+			continue
+		}
+		pk.pieces[i] = &pieceWork{
+			index:  i,
+			hash:   hash,
+			length: t.pieceSize(i),
+		}
+		pk.free++
+	}
+	return pk
+}
+
+// addPeer counts the pieces of a peer that connected
+func (pk *picker) addPeer(bf bitfield.Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.availability {
+		if bf.HasPiece(i) {
+			pk.availability[i]++
+		}
+	}
+}
+
+// removePeer stops counting the pieces of a peer that is gone
+func (pk *picker) removePeer(bf bitfield.Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	for i := range pk.availability {
+		if bf.HasPiece(i) {
+			pk.availability[i]--
+		}
+	}
+}
+
+// peerHas counts a piece a peer got after connecting
+func (pk *picker) peerHas(index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	if index >= 0 && index < len(pk.availability) {
+		pk.availability[index]++
+	}
+}
+
+// pick gets the next piece to download from a peer with the pieces in bf, the peer has to release it once
+// it is done with it. When the peer has nothing we need the piece is nil, and the channel gets closed once
+// that might have changed
+func (pk *picker) pick(bf bitfield.Bitfield) (*pieceWork, <-chan struct{}) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	var pw *pieceWork
+	if pk.free > 0 {
+		pw = pk.choose(bf)
+	} else {
+		pw = pk.endgame(bf)
+	}
+	if pw == nil {
+		return nil, pk.changed
+	}
+
+	if pw.buf == nil {
+		pw.buf = make([]byte, pw.length)
+		pw.blocks = make([]bool, (pw.length+MaxBlockSize-1)/MaxBlockSize)
+		pw.requests = make([][]*peerConn, len(pw.blocks))
+		pw.done = make(chan struct{})
+	}
+	if pw.peers == 0 {
+		pk.free--
+		if pk.free == 0 {
+			// Peers waiting for work can help out with the pieces that are left
+			pk.wake()
+		}
+	}
+	pw.peers++
+	return pw, nil
+}
+
+// choose picks a piece nobody is downloading that the peer has
+func (pk *picker) choose(bf bitfield.Bitfield) *pieceWork {
+	var candidates []int
+	for i, pw := range pk.pieces {
+		if pw == nil || pw.complete || pw.peers > 0 || !bf.HasPiece(i) {
+			continue
+		}
+		// Partial pieces are finished before anything new gets started
+		if pw.partial() {
+			return pw
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if pk.done < RandomPieces {
+		return pk.pieces[candidates[rand.Intn(len(candidates))]]
+	}
+
+	// Rarest first, ties are broken at random so peers don't all go for the same piece
+	best, ties := -1, 0
+	for _, i := range candidates {
+		switch {
+		case best < 0 || pk.availability[i] < pk.availability[best]:
+			best, ties = i, 1
+		case pk.availability[i] == pk.availability[best]:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return pk.pieces[best]
+}
+
+// endgame picks the piece the peer has with the fewest peers downloading it
+func (pk *picker) endgame(bf bitfield.Bitfield) *pieceWork {
+	var best *pieceWork
+	for i, pw := range pk.pieces {
+		if pw == nil || pw.complete || !bf.HasPiece(i) {
+			continue
+		}
+		if best == nil || pw.peers < best.peers {
+			best = pw
+		}
+	}
+	return best
+}
+
+// nextRequest picks a block of pw for p to request. Blocks nobody asked for go first, after that the ones
+// with the fewest requests, which only happens in endgame mode
+func (pk *picker) nextRequest(pw *pieceWork, p *peerConn) (begin, length int, ok bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	best := -1
+	for i, got := range pw.blocks {
+		if got || requested(pw.requests[i], p) {
+			continue
+		}
+		if best < 0 || len(pw.requests[i]) < len(pw.requests[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, 0, false
+	}
+	pw.requests[best] = append(pw.requests[best], p)
+	begin = best * MaxBlockSize
+	return begin, blockSize(pw.length, begin), true
+}
+
+// backlog is the number of requests p has out for blocks of pw
+func (pk *picker) backlog(pw *pieceWork, p *peerConn) int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	n := 0
+	for _, peers := range pw.requests {
+		if requested(peers, p) {
+			n++
+		}
+	}
+	return n
+}
+
+// received stores a block p sent. Blocks we already have, or that are not part of pw, are ignored. The other
+// peers that were asked for the block are returned so their requests can be cancelled, and complete tells
+// if it was the last block of the piece
+func (pk *picker) received(pw *pieceWork, p *peerConn, index, begin int, block []byte) (cancel []*peerConn, complete bool, err error) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	i := begin / MaxBlockSize
+	if index != pw.index || pw.complete || begin%MaxBlockSize != 0 || i >= len(pw.blocks) || pw.blocks[i] {
+		return nil, false, nil
+	}
+	if len(block) != blockSize(pw.length, begin) {
+		return nil, false, fmt.Errorf("block at %v of piece %v is %v bytes", begin, index, len(block))
+	}
+
+	copy(pw.buf[begin:], block)
+	pw.blocks[i] = true
+	for _, other := range pw.requests[i] {
+		if other != p {
+			cancel = append(cancel, other)
+		}
+	}
+	pw.requests[i] = nil
+
+	for _, got := range pw.blocks {
+		if !got {
+			return cancel, false, nil
+		}
+	}
+	pw.complete = true
+	close(pw.done)
+	return cancel, true, nil
+}
+
+// rejected forgets a request p turned down, so the block gets requested again
+func (pk *picker) rejected(p *peerConn, index, begin int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if index < 0 || index >= len(pk.pieces) || pk.pieces[index] == nil {
+		return
+	}
+	pw := pk.pieces[index]
+	if i := begin / MaxBlockSize; begin >= 0 && i < len(pw.requests) {
+		pw.requests[i] = without(pw.requests[i], p)
+	}
+}
+
+// forget drops every request p has out for blocks of pw, like when it chokes us
+func (pk *picker) forget(pw *pieceWork, p *peerConn) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.forgetLocked(pw, p)
+}
+
+func (pk *picker) forgetLocked(pw *pieceWork, p *peerConn) {
+	for i, peers := range pw.requests {
+		pw.requests[i] = without(peers, p)
+	}
+}
+
+// release takes p off a piece. Its requests are forgotten, and an unfinished piece without peers is up for
+// grabs again with the blocks it already has
+func (pk *picker) release(pw *pieceWork, p *peerConn) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.forgetLocked(pw, p)
+	pw.peers--
+	if pw.peers == 0 && !pw.complete {
+		pk.free++
+		pk.wake()
+	}
+}
+
+// failed throws away a piece that did not match its hash, it gets downloaded again from scratch
+func (pk *picker) failed(pw *pieceWork) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.pieces[pw.index] = &pieceWork{
+		index:  pw.index,
+		hash:   pw.hash,
+		length: pw.length,
+	}
+	pk.free++
+	pk.wake()
+}
+
+// finished marks a piece as downloaded and verified
+func (pk *picker) finished() {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.done++
+}
+
+// wake lets every waiting peer look for work again
+func (pk *picker) wake() {
+	close(pk.changed)
+	pk.changed = make(chan struct{})
+}
+
+// partial tells if some of the blocks of the piece are downloaded
+func (pw *pieceWork) partial() bool {
+	for _, got := range pw.blocks {
+		if got {
+			return true
+		}
+	}
+	return false
+}
+
+func requested(peers []*peerConn, p *peerConn) bool {
+	for _, other := range peers {
+		if other == p {
+			return true
+		}
+	}
+	return false
+}
+
+// without removes p from peers
+func without(peers []*peerConn, p *peerConn) []*peerConn {
+	for i, other := range peers {
+		if other == p {
+			return append(peers[:i:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
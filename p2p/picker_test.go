@@ -0,0 +1,234 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPick(t *testing.T) {
+	type testCase struct {
+		have    bitfield.Bitfield   // Pieces we have
+		peers   []bitfield.Bitfield // Other connected peers
+		partial []int
+		peer    bitfield.Bitfield
+		want    []int // Any of these is fine
+	}
+
+	tcs := map[string]testCase{
+		"Rarest": {
+			have:  bitfield.Bitfield{0b11110000},
+			peers: []bitfield.Bitfield{{0b00001110}, {0b00001100}, {0b00000100}},
+			peer:  bitfield.Bitfield{0b00001111},
+			want:  []int{7},
+		},
+		"Rarest the peer has": {
+			have:  bitfield.Bitfield{0b11110000},
+			peers: []bitfield.Bitfield{{0b00001110}, {0b00001100}, {0b00000110}},
+			peer:  bitfield.Bitfield{0b00001110},
+			want:  []int{4, 6},
+		},
+		"Random for the first pieces": {
+			peers: []bitfield.Bitfield{{0b11111110}, {0b11111110}},
+			peer:  bitfield.Bitfield{0b11111111},
+			want:  []int{0, 1, 2, 3, 4, 5, 6, 7},
+		},
+		"Partial first": {
+			have:    bitfield.Bitfield{0b11110000},
+			peers:   []bitfield.Bitfield{{0b00001110}, {0b00001100}},
+			partial: []int{5},
+			peer:    bitfield.Bitfield{0b00001111},
+			want:    []int{5},
+		},
+		"Partial the peer doesn't have": {
+			have:    bitfield.Bitfield{0b11110000},
+			peers:   []bitfield.Bitfield{{0b00001110}},
+			partial: []int{5},
+			peer:    bitfield.Bitfield{0b00001001},
+			want:    []int{7},
+		},
+		"Nothing we need": {
+			have: bitfield.Bitfield{0b11110000},
+			peer: bitfield.Bitfield{0b11110000},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			tor := &Torrent{PieceHashes: make([][20]byte, 8), PieceLength: 16384, Length: 8 * 16384}
+			pk := newPicker(tor, tc.have)
+			for _, bf := range tc.peers {
+				pk.addPeer(bf)
+			}
+			pk.addPeer(tc.peer)
+			for _, i := range tc.partial {
+				pk.pieces[i].blocks = []bool{true}
+			}
+
+			pw, changed := pk.pick(tc.peer)
+			if tc.want == nil {
+				assert.Nil(t, pw)
+				assert.NotNil(t, changed)
+				return
+			}
+			require.NotNil(t, pw)
+			assert.Contains(t, tc.want, pw.index)
+
+			// Taken pieces are not handed out twice
+			again, _ := pk.pick(bitfield.Bitfield{1 << uint(7-pw.index)})
+			assert.Nil(t, again)
+		})
+	}
+}
+
+func TestPickWaits(t *testing.T) {
+	tor := &Torrent{PieceHashes: make([][20]byte, 2), PieceLength: 16384, Length: 2 * 16384}
+	pk := newPicker(tor, nil)
+
+	pw, _ := pk.pick(bitfield.Bitfield{0b01000000})
+	require.NotNil(t, pw)
+	none, changed := pk.pick(bitfield.Bitfield{0b01000000})
+	assert.Nil(t, none)
+
+	// A peer failing the piece lets the next one have it
+	pk.release(pw, nil)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("putting a piece back should wake waiting peers")
+	}
+	again, _ := pk.pick(bitfield.Bitfield{0b01000000})
+	assert.Equal(t, pw, again)
+}
+
+func TestPickerAvailability(t *testing.T) {
+	tor, _ := testSeed(t, 16384, 3*16384, 0, 1, 2)
+	tor.picker = newPicker(tor, tor.bitfield)
+	p, conn := fakeLeecher(t, tor)
+	p.Bitfield = bitfield.Bitfield{0b10000000}
+	p.countPieces()
+	assert.Equal(t, []int{1, 0, 0}, tor.picker.availability)
+
+	// Haves are only counted once, even when a peer sends them twice. The keep-alive gets read once they are handled
+	send(t, conn, message.FormatHave(2), message.FormatHave(2), message.FormatHave(0), nil)
+	tor.picker.mu.Lock()
+	assert.Equal(t, []int{1, 0, 1}, tor.picker.availability)
+	tor.picker.mu.Unlock()
+
+	p.uncountPieces()
+	assert.Equal(t, []int{0, 0, 0}, tor.picker.availability)
+}
+
+func TestPickEndgame(t *testing.T) {
+	tor := &Torrent{PieceHashes: make([][20]byte, 1), PieceLength: 2 * MaxBlockSize, Length: 2 * MaxBlockSize}
+	pk := newPicker(tor, nil)
+	slow, fast := &peerConn{}, &peerConn{}
+
+	pw, _ := pk.pick(bitfield.Bitfield{0xff})
+	require.NotNil(t, pw)
+	for i := 0; i < 3; i++ {
+		pk.nextRequest(pw, slow)
+	}
+	assert.Equal(t, 2, pk.backlog(pw, slow))
+
+	// Every piece is taken, the next peer joins in and asks for the same blocks
+	again, _ := pk.pick(bitfield.Bitfield{0xff})
+	require.Equal(t, pw, again)
+	for i := 0; i < 2; i++ {
+		begin, _, ok := pk.nextRequest(pw, fast)
+		require.True(t, ok)
+		assert.Equal(t, i*MaxBlockSize, begin)
+	}
+	_, _, ok := pk.nextRequest(pw, fast)
+	assert.False(t, ok)
+
+	block := make([]byte, MaxBlockSize)
+	cancel, complete, err := pk.received(pw, fast, pw.index, 0, block)
+	require.Nil(t, err)
+	assert.Equal(t, []*peerConn{slow}, cancel)
+	assert.False(t, complete)
+	assert.Equal(t, 1, pk.backlog(pw, slow))
+
+	// Blocks that are already there are ignored
+	cancel, complete, err = pk.received(pw, slow, pw.index, 0, block)
+	assert.Nil(t, err)
+	assert.Nil(t, cancel)
+	assert.False(t, complete)
+	_, _, err = pk.received(pw, slow, pw.index, MaxBlockSize, block[:10])
+	assert.NotNil(t, err)
+
+	_, complete, err = pk.received(pw, fast, pw.index, MaxBlockSize, block)
+	require.Nil(t, err)
+	assert.True(t, complete)
+	select {
+	case <-pw.done:
+	default:
+		t.Fatal("peers still on the piece should be told it is done")
+	}
+
+	// Finished pieces are never picked again
+	pk.release(pw, slow)
+	pk.release(pw, fast)
+	got, _ := pk.pick(bitfield.Bitfield{0xff})
+	assert.Nil(t, got)
+}
+
+func TestDownloadPartialPiece(t *testing.T) {
+	tor, data := testSeed(t, 40000, 40000, 0)
+	tor.picker = newPicker(tor, tor.bitfield)
+	p, conn := fakeLeecher(t, tor)
+	p.Choked = false
+
+	// The first block came from a peer that left, only the rest get requested
+	pw, _ := tor.picker.pick(bitfield.Bitfield{0xff})
+	require.NotNil(t, pw)
+	pw.blocks[0] = true
+	copy(pw.buf, data[:MaxBlockSize])
+
+	result := make(chan []byte)
+	go func() {
+		buf, err := downloadPiece(p, pw)
+		assert.Nil(t, err)
+		result <- buf
+	}()
+	assert.Equal(t, message.FormatRequest(0, MaxBlockSize, MaxBlockSize), read(t, conn))
+	assert.Equal(t, message.FormatRequest(0, 2*MaxBlockSize, 40000-2*MaxBlockSize), read(t, conn))
+
+	send(t, conn,
+		message.FormatPiece(0, 2*MaxBlockSize, data[2*MaxBlockSize:]),
+		message.FormatPiece(0, MaxBlockSize, data[MaxBlockSize:2*MaxBlockSize]),
+	)
+	select {
+	case buf := <-result:
+		assert.Equal(t, data, buf)
+	case <-time.After(time.Second):
+		t.Fatal("piece never finished")
+	}
+}
+
+func TestDroppedBlock(t *testing.T) {
+	tor, data := testSeed(t, 40000, 40000, 0)
+	tor.picker = newPicker(tor, tor.bitfield)
+	p, conn := fakeLeecher(t, tor)
+
+	pw, _ := tor.picker.pick(bitfield.Bitfield{0xff})
+	require.NotNil(t, pw)
+	_, _, ok := tor.picker.nextRequest(pw, p)
+	require.True(t, ok)
+
+	// Nobody takes the blocks off the peer, so the next one can't be passed on and gets asked for again
+	for i := 0; i < cap(p.pieces); i++ {
+		p.pieces <- &message.Message{ID: message.MsgPiece}
+	}
+	send(t, conn, message.FormatPiece(0, 0, data[:MaxBlockSize]))
+	assert.Eventually(t, func() bool { return tor.picker.backlog(pw, p) == 0 }, time.Second, time.Millisecond)
+	select {
+	case <-p.wake:
+	case <-time.After(time.Second):
+		t.Fatal("the download should be woken up to request the block again")
+	}
+}
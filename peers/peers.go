@@ -10,10 +10,21 @@ import (
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	ID   [20]byte // Only known when a tracker sent the peer as a dictionary, zero otherwise
 }
 
+// Unmarshal decodes compact IPv4 peers
 func Unmarshal(pbs []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 bytes for ip, 2 for port
+	return unmarshal(pbs, net.IPv4len)
+}
+
+// Unmarshal6 decodes compact IPv6 peers
+func Unmarshal6(pbs []byte) ([]Peer, error) {
+	return unmarshal(pbs, net.IPv6len)
+}
+
+func unmarshal(pbs []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2 // ip followed by 2 bytes for port
 
 	// Double check that math is good
 	if len(pbs)%peerSize != 0 {
@@ -24,12 +35,26 @@ func Unmarshal(pbs []byte) ([]Peer, error) {
 	peers := make([]Peer, peerCount)
 	for i := 0; i < peerCount; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(pbs[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16(pbs[offset+4 : offset+6])
+		peers[i].IP = net.IP(pbs[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16(pbs[offset+ipLen : offset+peerSize])
 	}
 	return peers, nil
 }
 
+// Marshal encodes peers in the compact format, IPv4 peers go in the first slice and IPv6 peers in the second
+func Marshal(ps []Peer) (compact []byte, compact6 []byte) {
+	for _, p := range ps {
+		if ip4 := p.IP.To4(); ip4 != nil {
+			compact = append(compact, ip4...)
+			compact = append(compact, byte(p.Port>>8), byte(p.Port))
+		} else if ip6 := p.IP.To16(); ip6 != nil {
+			compact6 = append(compact6, ip6...)
+			compact6 = append(compact6, byte(p.Port>>8), byte(p.Port))
+		}
+	}
+	return compact, compact6
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), fmt.Sprintf("%v", p.Port))
 }
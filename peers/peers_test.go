@@ -38,6 +38,25 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshal6(t *testing.T) {
+	ps, err := Unmarshal6([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1})
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6881}}, ps)
+
+	_, err = Unmarshal6([]byte{127, 0, 0, 1, 0x00, 0x50})
+	assert.NotNil(t, err)
+}
+
+func TestMarshal(t *testing.T) {
+	compact, compact6 := Marshal([]Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("1.1.1.1"), Port: 443}, // 16 byte form of an IPv4 address
+	})
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}, compact)
+	assert.Equal(t, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}, compact6)
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  Peer
@@ -47,6 +66,10 @@ func TestString(t *testing.T) {
 			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 8080},
 			output: "127.0.0.1:8080",
 		},
+		{
+			input:  Peer{IP: net.ParseIP("2001:db8::1"), Port: 8080},
+			output: "[2001:db8::1]:8080",
+		},
 	}
 	for _, test := range tests {
 		s := test.input.String()
@@ -0,0 +1,283 @@
+package pex
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Squwid/squidtorrent/extension"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/zeebo/bencode"
+)
+
+// https://www.bittorrent.org/beps/bep_0011.html
+
+const (
+	// Name is the name of the extension in the extended handshake
+	Name = "ut_pex"
+
+	// Interval is how often peers exchange deltas, BEP 11 forbids sending more than once a minute
+	Interval = time.Minute
+
+	// MaxPeers is the most added and the most dropped peers in a single message
+	MaxPeers = 50
+)
+
+// Flags describing an added peer
+const (
+	FlagEncryption  byte = 0x01 // Prefers encryption
+	FlagSeed        byte = 0x02 // Is a seed
+	FlagUTP         byte = 0x04 // Supports uTP
+	FlagHolepunch   byte = 0x08 // Supports holepunching
+	FlagConnectable byte = 0x10 // Accepts incoming connections
+)
+
+type bencodeMsg struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// Message is a parsed ut_pex message, IPv4 and IPv6 peers are combined
+type Message struct {
+	Added      []peers.Peer
+	AddedFlags []byte // Flags of every added peer, same order as Added
+	Dropped    []peers.Peer
+}
+
+// ParseMessage decodes the payload of a ut_pex message
+func ParseMessage(payload []byte) (*Message, error) {
+	var bm bencodeMsg
+	if err := bencode.DecodeBytes(payload, &bm); err != nil {
+		return nil, err
+	}
+
+	var m Message
+	added, err := peers.Unmarshal([]byte(bm.Added))
+	if err != nil {
+		return nil, err
+	}
+	added6, err := peers.Unmarshal6([]byte(bm.Added6))
+	if err != nil {
+		return nil, err
+	}
+	m.Added = append(added, added6...)
+	m.AddedFlags = append(flags(bm.AddedF, len(added)), flags(bm.Added6F, len(added6))...)
+
+	dropped, err := peers.Unmarshal([]byte(bm.Dropped))
+	if err != nil {
+		return nil, err
+	}
+	dropped6, err := peers.Unmarshal6([]byte(bm.Dropped6))
+	if err != nil {
+		return nil, err
+	}
+	m.Dropped = append(dropped, dropped6...)
+
+	return &m, nil
+}
+
+// flags pads or trims the flags of a peer list to exactly one byte per peer
+func flags(s string, n int) []byte {
+	f := make([]byte, n)
+	copy(f, s)
+	return f
+}
+
+// Bytes bencodes the message, splitting peers by address family
+func (m Message) Bytes() ([]byte, error) {
+	var bm bencodeMsg
+	var f, f6 []byte
+	for i, p := range m.Added {
+		var flag byte
+		if i < len(m.AddedFlags) {
+			flag = m.AddedFlags[i]
+		}
+
+		compact, compact6 := peers.Marshal([]peers.Peer{p})
+		bm.Added += string(compact)
+		bm.Added6 += string(compact6)
+		if len(compact) > 0 {
+			f = append(f, flag)
+		} else if len(compact6) > 0 {
+			f6 = append(f6, flag)
+		}
+	}
+	bm.AddedF, bm.Added6F = string(f), string(f6)
+
+	dropped, dropped6 := peers.Marshal(m.Dropped)
+	bm.Dropped, bm.Dropped6 = string(dropped), string(dropped6)
+
+	return bencode.EncodeBytes(bm)
+}
+
+// connState is what has been exchanged with a single peer
+type connState struct {
+	self         string                // Address of the peer itself, never sent back to it
+	sent         map[string]peers.Peer // Peers the remote was told about and not dropped since
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// listedPeer is a connected peer that gets passed on to the rest
+type listedPeer struct {
+	peer  peers.Peer
+	flags byte
+}
+
+// A Handler exchanges peers of a single torrent. It keeps track of the peers we are connected to and
+// periodically sends every connection the peers that were added or dropped since the last message
+type Handler struct {
+	onPeers func([]peers.Peer)
+
+	mu        sync.Mutex
+	connected map[string]listedPeer
+	conns     map[*extension.Conn]*connState
+}
+
+// New creates a handler that calls onPeers with peers that other peers told us about
+func New(onPeers func([]peers.Peer)) *Handler {
+	return &Handler{
+		onPeers:   onPeers,
+		connected: map[string]listedPeer{},
+		conns:     map[*extension.Conn]*connState{},
+	}
+}
+
+func (h *Handler) Name() string {
+	return Name
+}
+
+// AddConn starts exchanging peers with a connected peer, flags describe it to the others. Only peers with
+// FlagConnectable get passed on, for the rest we don't know a port they can be reached on
+func (h *Handler) AddConn(c *extension.Conn, peer peers.Peer, flags byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if flags&FlagConnectable != 0 {
+		h.connected[peer.String()] = listedPeer{peer, flags}
+	}
+	h.conns[c] = &connState{
+		self: peer.String(),
+		sent: map[string]peers.Peer{},
+	}
+}
+
+// DropConn stops exchanging with a peer, it gets sent as dropped to the rest
+func (h *Handler) DropConn(c *extension.Conn, peer peers.Peer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.connected, peer.String())
+	delete(h.conns, c)
+}
+
+// HandleMessage passes on the added peers of a message. Peers sending messages too often get ignored
+func (h *Handler) HandleMessage(c *extension.Conn, payload []byte) error {
+	h.mu.Lock()
+	state, ok := h.conns[c]
+	if ok {
+		// Allow some slack for timers that fire a little early
+		if !state.lastReceived.IsZero() && time.Since(state.lastReceived) < Interval/2 {
+			ok = false
+		} else {
+			state.lastReceived = time.Now()
+		}
+	}
+	h.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	m, err := ParseMessage(payload)
+	if err != nil {
+		return err
+	}
+	if len(m.Added) > MaxPeers {
+		m.Added = m.Added[:MaxPeers]
+	}
+	if len(m.Added) > 0 {
+		h.onPeers(m.Added)
+	}
+	return nil
+}
+
+// Run sends deltas to every connection once per Interval until stop is closed
+func (h *Handler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.sendDeltas()
+		}
+	}
+}
+
+// sendDeltas sends a message to every connection that supports ut_pex and is due for one
+func (h *Handler) sendDeltas() {
+	type pending struct {
+		c       *extension.Conn
+		payload []byte
+	}
+	var out []pending
+
+	h.mu.Lock()
+	for c, state := range h.conns {
+		if !c.Supports(Name) || time.Since(state.lastSent) < Interval {
+			continue
+		}
+
+		m := h.delta(state)
+		if len(m.Added) == 0 && len(m.Dropped) == 0 {
+			continue
+		}
+		payload, err := m.Bytes()
+		if err != nil {
+			continue
+		}
+
+		for _, p := range m.Added {
+			state.sent[p.String()] = p
+		}
+		for _, p := range m.Dropped {
+			delete(state.sent, p.String())
+		}
+		state.lastSent = time.Now()
+		out = append(out, pending{c, payload})
+	}
+	h.mu.Unlock()
+
+	// Writes happen outside the lock so a slow peer does not hold up the rest
+	for _, p := range out {
+		p.c.Send(Name, p.payload)
+	}
+}
+
+// delta is what a connection has not been told yet, capped to MaxPeers each way
+func (h *Handler) delta(state *connState) Message {
+	var m Message
+	for addr, lp := range h.connected {
+		if len(m.Added) == MaxPeers {
+			break
+		}
+		if _, ok := state.sent[addr]; !ok && addr != state.self {
+			m.Added = append(m.Added, lp.peer)
+			m.AddedFlags = append(m.AddedFlags, lp.flags)
+		}
+	}
+	for addr, p := range state.sent {
+		if len(m.Dropped) == MaxPeers {
+			break
+		}
+		if _, ok := h.connected[addr]; !ok {
+			m.Dropped = append(m.Dropped, p)
+		}
+	}
+	return m
+}
@@ -0,0 +1,198 @@
+package pex
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/extension"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *Message
+		fails  bool
+	}{
+		"ipv4 and ipv6": {
+			input: "d" +
+				"5:added12:" + string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2}) +
+				"7:added.f1:" + string([]byte{FlagSeed}) + // Flags can come up short
+				"6:added618:" + string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe3}) +
+				"8:added6.f1:" + string([]byte{FlagUTP}) +
+				"7:dropped6:" + string([]byte{10, 0, 0, 3, 0x1a, 0xe4}) +
+				"e",
+			output: &Message{
+				Added: []peers.Peer{
+					{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+					{IP: net.IP{10, 0, 0, 2}, Port: 6882},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6883},
+				},
+				AddedFlags: []byte{FlagSeed, 0, FlagUTP},
+				Dropped:    []peers.Peer{{IP: net.IP{10, 0, 0, 3}, Port: 6884}},
+			},
+		},
+		"empty": {
+			input:  "de",
+			output: &Message{Added: []peers.Peer{}, AddedFlags: []byte{}, Dropped: []peers.Peer{}},
+		},
+		"malformed added": {
+			input: "d5:added5:12345e",
+			fails: true,
+		},
+		"not bencode": {
+			input: "x",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := ParseMessage([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := Message{
+		Added: []peers.Peer{
+			{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6883},
+		},
+		AddedFlags: []byte{FlagConnectable, FlagSeed},
+		Dropped:    []peers.Peer{{IP: net.IP{10, 0, 0, 3}, Port: 6884}},
+	}
+	b, err := m.Bytes()
+	require.Nil(t, err)
+
+	parsed, err := ParseMessage(b)
+	require.Nil(t, err)
+	assert.Equal(t, &m, parsed)
+}
+
+// pexConn is an extension connection over a pipe where the remote asked for ut_pex on id 1
+func pexConn(t *testing.T, h *Handler) (*extension.Conn, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	c := extension.NewRegistry(h).NewConn(local)
+	hs, err := extension.Handshake{M: map[string]int{Name: 1}}.Message()
+	require.Nil(t, err)
+	require.Nil(t, c.Handle(hs))
+	return c, remote
+}
+
+func TestHandleMessage(t *testing.T) {
+	var found []peers.Peer
+	h := New(func(ps []peers.Peer) { found = append(found, ps...) })
+
+	c, _ := pexConn(t, h)
+	h.AddConn(c, peers.Peer{IP: net.IP{10, 0, 0, 9}, Port: 1}, FlagConnectable)
+
+	payload, err := Message{Added: []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}}.Bytes()
+	require.Nil(t, err)
+	require.Nil(t, h.HandleMessage(c, payload))
+	assert.Equal(t, []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}, found)
+
+	// Second message right away is too soon and gets ignored
+	require.Nil(t, h.HandleMessage(c, payload))
+	assert.Len(t, found, 1)
+}
+
+// byPort sorts the added peers of a message and their flags along with them
+type byPort Message
+
+func (m byPort) Len() int           { return len(m.Added) }
+func (m byPort) Less(i, j int) bool { return m.Added[i].Port < m.Added[j].Port }
+func (m byPort) Swap(i, j int) {
+	m.Added[i], m.Added[j] = m.Added[j], m.Added[i]
+	m.AddedFlags[i], m.AddedFlags[j] = m.AddedFlags[j], m.AddedFlags[i]
+}
+
+func TestSendDeltas(t *testing.T) {
+	h := New(func([]peers.Peer) {})
+
+	a := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	b := peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6882}
+	c := peers.Peer{IP: net.IP{10, 0, 0, 3}, Port: 6883}
+
+	in := peers.Peer{IP: net.IP{10, 0, 0, 4}, Port: 50000}
+
+	connA, remoteA := pexConn(t, h)
+	h.AddConn(connA, a, FlagConnectable)
+	connB, remoteB := pexConn(t, h)
+	h.AddConn(connB, b, FlagConnectable|FlagSeed)
+	connC, remoteC := pexConn(t, h)
+	h.AddConn(connC, c, FlagConnectable|FlagUTP|FlagEncryption)
+
+	// A peer that connected to us gets the rest, but isn't passed on since its port is not one it listens on
+	connIn, remoteIn := pexConn(t, h)
+	h.AddConn(connIn, in, FlagUTP)
+
+	// Pipes block writes until they are read, only A and the incoming peer get looked at
+	go io.Copy(ioutil.Discard, remoteB)
+	go io.Copy(ioutil.Discard, remoteC)
+	inDeltas := make(chan *Message, 1)
+	go func() {
+		msg, err := message.Read(remoteIn)
+		if err != nil {
+			return
+		}
+		_, payload, _ := msg.ParseExtended()
+		m, _ := ParseMessage(payload)
+		inDeltas <- m
+	}()
+
+	read := func() *Message {
+		remoteA.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := message.Read(remoteA)
+		require.Nil(t, err)
+		id, payload, err := msg.ParseExtended()
+		require.Nil(t, err)
+		require.Equal(t, uint8(1), id)
+		m, err := ParseMessage(payload)
+		require.Nil(t, err)
+		sort.Sort(byPort(*m))
+		return m
+	}
+
+	// First message has every other peer, never the peer itself, with the flags they were added with
+	go h.sendDeltas()
+	m := read()
+	assert.Equal(t, []peers.Peer{b, c}, m.Added)
+	assert.Equal(t, []byte{FlagConnectable | FlagSeed, FlagConnectable | FlagUTP | FlagEncryption}, m.AddedFlags)
+	assert.Empty(t, m.Dropped)
+
+	select {
+	case m := <-inDeltas:
+		assert.Len(t, m.Added, 3)
+	case <-time.After(time.Second):
+		t.Fatal("incoming peer never got a delta")
+	}
+
+	// Nothing is sent again before the interval passed
+	h.DropConn(connB, b)
+	h.sendDeltas()
+
+	h.mu.Lock()
+	h.conns[connA].lastSent = time.Now().Add(-Interval)
+	h.mu.Unlock()
+	go h.sendDeltas()
+	m = read()
+	assert.Empty(t, m.Added)
+	assert.Equal(t, []peers.Peer{b}, m.Dropped)
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileStorage keeps a torrent in its files on disk. Pieces that cross the end of a file carry on
+// into the next one
+type FileStorage struct {
+	pieceLength int64
+	length      int64
+	files       []diskFile
+}
+
+type diskFile struct {
+	File
+	offset int64    // Where the file starts in the torrent
+	f      *os.File // nil if the file does not exist or is padding
+}
+
+// NewFileStorage creates the directory tree and every file of a torrent under dir, files that already
+// exist are kept as they are
+func NewFileStorage(dir string, files []File, pieceLength int64) (*FileStorage, error) {
+	s := &FileStorage{pieceLength: pieceLength}
+	for _, file := range files {
+		if file.Padding {
+			s.files = append(s.files, diskFile{File: file, offset: s.length})
+			s.length += file.Length
+			continue
+		}
+
+		path, err := join(dir, file.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.files = append(s.files, diskFile{File: file, offset: s.length, f: f})
+		s.length += file.Length
+	}
+	return s, nil
+}
+
+// OpenFileStorage opens the files of a torrent under dir read only, nothing gets created. Reads from files
+// that do not exist fail with an error that matches os.ErrNotExist
+func OpenFileStorage(dir string, files []File, pieceLength int64) (*FileStorage, error) {
+	s := &FileStorage{pieceLength: pieceLength}
+	for _, file := range files {
+		if file.Padding {
+			s.files = append(s.files, diskFile{File: file, offset: s.length})
+			s.length += file.Length
+			continue
+		}
+
+		path, err := join(dir, file.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.Close()
+			return nil, err
+		}
+
+		s.files = append(s.files, diskFile{File: file, offset: s.length, f: f})
+		s.length += file.Length
+	}
+	return s, nil
+}
+
+// join puts the path of a file under dir, paths that end up anywhere else are an error
+func join(dir, path string) (string, error) {
+	joined := filepath.Join(dir, path)
+	rel, err := filepath.Rel(dir, joined)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %v is outside of %v", path, dir)
+	}
+	return joined, nil
+}
+
+// Piece gets a piece of the torrent
+func (s *FileStorage) Piece(index int) Piece {
+	return newPiece(s, index, s.pieceLength, s.length)
+}
+
+// Close closes every file
+func (s *FileStorage) Close() error {
+	var err error
+	for _, file := range s.files {
+		if file.f == nil {
+			continue
+		}
+		if cerr := file.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *FileStorage) readAt(b []byte, off int64) (int, error) {
+	return s.span(b, off, false)
+}
+
+func (s *FileStorage) writeAt(b []byte, off int64) (int, error) {
+	return s.span(b, off, true)
+}
+
+// span reads or writes b over every file it overlaps, starting at the torrent offset off
+func (s *FileStorage) span(b []byte, off int64, write bool) (int, error) {
+	// First file that ends after off, zero length files are skipped over since they end where they start
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].offset+s.files[i].Length > off
+	})
+
+	total := 0
+	for ; len(b) > 0 && i < len(s.files); i++ {
+		file := s.files[i]
+		n := file.offset + file.Length - off
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		if n <= 0 {
+			continue
+		}
+
+		var done int
+		var err error
+		switch {
+		case file.Padding:
+			// Padding reads as zeros and writes to it go nowhere
+			if !write {
+				for j := range b[:n] {
+					b[j] = 0
+				}
+			}
+			done = int(n)
+		case file.f == nil:
+			err = os.ErrNotExist
+		case write:
+			done, err = file.f.WriteAt(b[:n], off-file.offset)
+		default:
+			done, err = file.f.ReadAt(b[:n], off-file.offset)
+			if err == io.EOF {
+				// The file is there but the data is not written yet
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		total += done
+		if err != nil {
+			return total, fmt.Errorf("%v: %w", file.Path, err)
+		}
+		b = b[n:]
+		off += n
+	}
+	if len(b) > 0 {
+		return total, io.ErrUnexpectedEOF
+	}
+	return total, nil
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	type testCase struct {
+		pieceLength int64
+		files       []File
+	}
+
+	tcs := map[string]testCase{
+		"Single file": {
+			pieceLength: 16,
+			files:       []File{{Path: "a.txt", Length: 40}},
+		},
+		"Pieces cross files": {
+			pieceLength: 16,
+			files: []File{
+				{Path: "dir/a.txt", Length: 10},
+				{Path: "dir/sub/b.txt", Length: 30},
+				{Path: "c.txt", Length: 3},
+			},
+		},
+		"File inside of a piece": {
+			pieceLength: 32,
+			files: []File{
+				{Path: "a", Length: 5},
+				{Path: "b", Length: 2},
+				{Path: "c", Length: 40},
+			},
+		},
+		"Padding": {
+			pieceLength: 16,
+			files: []File{
+				{Path: "a", Length: 10},
+				{Path: ".pad/6", Length: 6, Padding: true},
+				{Path: "b", Length: 20},
+			},
+		},
+		"Empty files": {
+			pieceLength: 16,
+			files: []File{
+				{Path: "empty/start", Length: 0},
+				{Path: "a", Length: 20},
+				{Path: "empty/middle", Length: 0},
+				{Path: "b", Length: 20},
+				{Path: "empty/end", Length: 0},
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewFileStorage(dir, tc.files, tc.pieceLength)
+			require.Nil(t, err)
+
+			var length int64
+			for _, f := range tc.files {
+				length += f.Length
+				_, err := os.Stat(filepath.Join(dir, f.Path))
+				assert.Equal(t, f.Padding, err != nil, "%v should be created unless it is padding", f.Path)
+			}
+			data := make([]byte, length)
+			_, err = rand.Read(data)
+			require.Nil(t, err)
+
+			// Padding is always zeros
+			var offset int64
+			for _, f := range tc.files {
+				if f.Padding {
+					copy(data[offset:offset+f.Length], make([]byte, f.Length))
+				}
+				offset += f.Length
+			}
+
+			// Write every piece in two halves, then read it back in one go
+			for i := 0; int64(i)*tc.pieceLength < length; i++ {
+				begin := int64(i) * tc.pieceLength
+				end := begin + tc.pieceLength
+				if end > length {
+					end = length
+				}
+				half := (end - begin) / 2
+
+				p := s.Piece(i)
+				n, err := p.WriteAt(data[begin+half:end], half)
+				require.Nil(t, err)
+				assert.EqualValues(t, end-begin-half, n)
+				_, err = p.WriteAt(data[begin:begin+half], 0)
+				require.Nil(t, err)
+
+				got := make([]byte, end-begin)
+				_, err = p.ReadAt(got, 0)
+				require.Nil(t, err)
+				assert.Equal(t, data[begin:end], got)
+			}
+			require.Nil(t, s.Close())
+
+			// Files on disk hold their part of the torrent
+			offset = 0
+			for _, f := range tc.files {
+				if f.Padding {
+					offset += f.Length
+					continue
+				}
+				got, err := os.ReadFile(filepath.Join(dir, f.Path))
+				require.Nil(t, err)
+				assert.Equal(t, data[offset:offset+f.Length], got, f.Path)
+				offset += f.Length
+			}
+		})
+	}
+}
+
+func TestFileStorageBounds(t *testing.T) {
+	s, err := NewFileStorage(t.TempDir(), []File{{Path: "a", Length: 20}, {Path: "b", Length: 5}}, 16)
+	require.Nil(t, err)
+	defer s.Close()
+
+	_, err = s.Piece(1).WriteAt(make([]byte, 10), 0)
+	assert.NotNil(t, err, "last piece is only 9 bytes")
+	_, err = s.Piece(0).WriteAt(make([]byte, 4), -1)
+	assert.NotNil(t, err)
+	_, err = s.Piece(2).ReadAt(make([]byte, 1), 0)
+	assert.NotNil(t, err)
+	_, err = s.Piece(-1).ReadAt(make([]byte, 1), 0)
+	assert.NotNil(t, err)
+
+	// Nothing written yet, so the files are too short to read from
+	_, err = s.Piece(1).ReadAt(make([]byte, 9), 0)
+	assert.NotNil(t, err)
+}
+
+func TestFileStorageOutside(t *testing.T) {
+	tests := map[string]string{
+		"Parent":      "..",
+		"Climbs out":  filepath.Join("..", "escaped"),
+		"Climbs back": filepath.Join("a", "..", "..", "escaped"),
+		"The dir":     ".",
+		"Empty":       "",
+	}
+
+	for name, path := range tests {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "out")
+			files := []File{{Path: "a", Length: 4}, {Path: path, Length: 4}}
+
+			_, err := NewFileStorage(dir, files, 4)
+			assert.NotNil(t, err)
+			_, err = OpenFileStorage(dir, files, 4)
+			assert.NotNil(t, err)
+			_, err = os.Stat(filepath.Join(parent, "escaped"))
+			assert.True(t, errors.Is(err, os.ErrNotExist))
+		})
+	}
+}
+
+func TestFileStorageKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	files := []File{{Path: "a", Length: 8}}
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "a"), []byte("12345678"), 0644))
+
+	s, err := NewFileStorage(dir, files, 4)
+	require.Nil(t, err)
+	defer s.Close()
+
+	got := make([]byte, 4)
+	_, err = s.Piece(1).ReadAt(got, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("5678"), got)
+}
+
+func TestOpenFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "a"), []byte("12345678"), 0644))
+	files := []File{{Path: "a", Length: 8}, {Path: "missing/b", Length: 8}}
+
+	s, err := OpenFileStorage(dir, files, 6)
+	require.Nil(t, err)
+	defer s.Close()
+
+	got := make([]byte, 6)
+	_, err = s.Piece(0).ReadAt(got, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("123456"), got)
+
+	_, err = s.Piece(1).ReadAt(got, 0)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Nothing is created and nothing can be written
+	_, err = s.Piece(0).WriteAt([]byte("x"), 0)
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
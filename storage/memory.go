@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"sync"
+)
+
+// MemoryStorage keeps the whole torrent in memory, only useful for small torrents and tests
+type MemoryStorage struct {
+	pieceLength int64
+
+	mu  sync.RWMutex
+	buf []byte
+}
+
+// NewMemoryStorage creates an empty in memory torrent
+func NewMemoryStorage(pieceLength, length int64) *MemoryStorage {
+	return &MemoryStorage{pieceLength: pieceLength, buf: make([]byte, length)}
+}
+
+// Piece gets a piece of the torrent
+func (m *MemoryStorage) Piece(index int) Piece {
+	return newPiece(m, index, m.pieceLength, int64(len(m.buf)))
+}
+
+// Bytes is a copy of the whole torrent, pieces that were never written are zeros
+func (m *MemoryStorage) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]byte(nil), m.buf...)
+}
+
+// Close does nothing, the data stays around until the storage is garbage collected
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+func (m *MemoryStorage) readAt(b []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copy(b, m.buf[off:]), nil
+}
+
+func (m *MemoryStorage) writeAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copy(m.buf[off:], b), nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(4, 10)
+
+	_, err := s.Piece(1).WriteAt([]byte("efgh"), 0)
+	require.Nil(t, err)
+	_, err = s.Piece(2).WriteAt([]byte("j"), 1)
+	require.Nil(t, err)
+	_, err = s.Piece(0).WriteAt([]byte("ab"), 0)
+	require.Nil(t, err)
+
+	got := make([]byte, 2)
+	_, err = s.Piece(1).ReadAt(got, 2)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("gh"), got)
+	assert.Equal(t, []byte("ab\x00\x00efgh\x00j"), s.Bytes())
+
+	_, err = s.Piece(2).WriteAt([]byte("abc"), 0)
+	assert.NotNil(t, err, "last piece is only 2 bytes")
+	_, err = s.Piece(3).ReadAt(got, 0)
+	assert.NotNil(t, err)
+	assert.Nil(t, s.Close())
+}
@@ -0,0 +1,74 @@
+// Package storage keeps the pieces of a torrent, either on disk or in memory
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage holds the data of a torrent. Implementations must be safe to use from multiple goroutines
+type Storage interface {
+	// Piece gets a piece to read and write blocks of, offsets are from the start of the piece
+	Piece(index int) Piece
+	Close() error
+}
+
+// Piece is a single piece of a torrent. Reads and writes past the end of the piece fail
+type Piece interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// File is a file inside of a torrent, files are laid out back to back in the order they are listed
+type File struct {
+	Path    string // Relative to the download directory
+	Length  int64
+	Padding bool // Only there to line the next file up with a piece (BEP 47), it is all zeros and never hits the disk
+}
+
+// piece maps piece offsets to offsets in the whole torrent
+type piece struct {
+	data  storageData
+	index int
+	begin int64
+	end   int64
+}
+
+// storageData is a torrent as one long run of bytes, offsets are always in range
+type storageData interface {
+	readAt(b []byte, off int64) (int, error)
+	writeAt(b []byte, off int64) (int, error)
+}
+
+func newPiece(data storageData, index int, pieceLength, length int64) piece {
+	p := piece{data: data, index: index, begin: int64(index) * pieceLength}
+	p.end = p.begin + pieceLength
+	if p.end > length {
+		p.end = length
+	}
+	return p
+}
+
+func (p piece) check(n int, off int64) error {
+	if p.index < 0 || p.begin >= p.end {
+		return fmt.Errorf("piece %v out of range", p.index)
+	}
+	if off < 0 || p.begin+off+int64(n) > p.end {
+		return fmt.Errorf("offset %v length %v is outside of piece %v", off, n, p.index)
+	}
+	return nil
+}
+
+func (p piece) ReadAt(b []byte, off int64) (int, error) {
+	if err := p.check(len(b), off); err != nil {
+		return 0, err
+	}
+	return p.data.readAt(b, p.begin+off)
+}
+
+func (p piece) WriteAt(b []byte, off int64) (int, error) {
+	if err := p.check(len(b), off); err != nil {
+		return 0, err
+	}
+	return p.data.writeAt(b, p.begin+off)
+}
@@ -0,0 +1,220 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Squwid/squidtorrent/storage"
+	"github.com/zeebo/bencode"
+)
+
+const (
+	// minPieceLength and maxPieceLength bound the piece length a Builder picks on its own
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+
+	// targetPieces is about how many pieces a Builder aims for, fewer pieces means a smaller torrent file
+	// but more data thrown away when a piece fails its hash check
+	targetPieces = 1500
+
+	// createdBy is what goes in created by when the Builder does not say otherwise
+	createdBy = "squidtorrent"
+)
+
+var errNoFiles = errors.New("no files to create a torrent from")
+
+// Builder creates torrent files out of a file or a directory
+type Builder struct {
+	PieceLength  uint32     // Picked from the total size when 0, otherwise it has to be a multiple of 16K
+	Name         string     // Defaults to the name of the file or directory
+	AnnounceList [][]string // Tiers of trackers
+	URLList      []string   // Web seeds (BEP 19)
+	Comment      string
+	CreatedBy    string    // Defaults to squidtorrent
+	CreationDate time.Time // Defaults to now
+	Private      bool
+}
+
+// Build walks path and hashes every file in it. A single file makes a single file torrent, a directory
+// makes a multi file torrent with its files in lexical order. Anything that is not a regular file is skipped
+func (b Builder) Build(path string) (*TorrentFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	bci := BencodeInfo{Name: b.Name}
+	if bci.Name == "" {
+		bci.Name = filepath.Base(path)
+	}
+	if b.Private {
+		bci.Private = bencode.RawMessage("i1e")
+	}
+
+	// Files are read relative to dir
+	dir := path
+	var files []storage.File
+	if info.IsDir() {
+		err := filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+
+			files = append(files, storage.File{Path: rel, Length: fi.Size()})
+			bci.Files = append(bci.Files, file{Length: fi.Size(), Path: strings.Split(filepath.ToSlash(rel), "/")})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dir = filepath.Dir(path)
+		files = []storage.File{{Path: filepath.Base(path), Length: info.Size()}}
+		bci.Length = info.Size()
+	}
+
+	var length int64
+	for _, f := range files {
+		length += f.Length
+	}
+	if length == 0 {
+		return nil, errNoFiles
+	}
+
+	bci.PieceLength = b.PieceLength
+	if bci.PieceLength == 0 {
+		bci.PieceLength = PieceLength(length)
+	} else if bci.PieceLength%minPieceLength != 0 {
+		return nil, errPieceLength
+	}
+
+	if bci.Pieces, err = hashFiles(dir, files, int64(bci.PieceLength), length); err != nil {
+		return nil, err
+	}
+
+	raw, err := bci.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	ti, err := parseInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &TorrentFile{
+		Info:         *ti,
+		AnnounceList: b.AnnounceList,
+		URLList:      b.URLList,
+		Comment:      b.Comment,
+		CreatedBy:    b.CreatedBy,
+		CreationDate: b.CreationDate,
+	}
+	if tf.CreatedBy == "" {
+		tf.CreatedBy = createdBy
+	}
+	if tf.CreationDate.IsZero() {
+		tf.CreationDate = time.Now()
+	}
+	return tf, nil
+}
+
+// PieceLength picks a piece length for a torrent of length bytes, the smallest power of two that keeps
+// it at about 1500 pieces, between 16KiB and 16MiB
+func PieceLength(length int64) uint32 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return uint32(pieceLength)
+}
+
+// hashFiles hashes every piece of the files laid out back to back, in parallel
+func hashFiles(dir string, files []storage.File, pieceLength, length int64) ([]byte, error) {
+	store, err := storage.OpenFileStorage(dir, files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	numPieces := int((length + pieceLength - 1) / pieceLength)
+	size := func(i int) int64 {
+		if end := int64(i+1) * pieceLength; end > length {
+			return length - int64(i)*pieceLength
+		}
+		return pieceLength
+	}
+
+	pieces := make([]byte, numPieces*sha1.Size)
+	errs := make([]error, numPieces)
+	readPieces(store, numPieces, size, func(i int, data []byte, err error) {
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		hash := sha1.Sum(data)
+		copy(pieces[i*sha1.Size:], hash[:])
+	})
+
+	// Files that changed size while they were read show up here
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error reading piece %v: %w", i, err)
+		}
+	}
+	return pieces, nil
+}
+
+// Bytes encodes the torrent file
+func (tf *TorrentFile) Bytes() ([]byte, error) {
+	if len(tf.Info.Metadata) == 0 {
+		return nil, errors.New("torrent has no info dictionary")
+	}
+
+	var mi struct {
+		Info         bencode.RawMessage `bencode:"info"`
+		Announce     string             `bencode:"announce,omitempty"`
+		AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+		URLList      []string           `bencode:"url-list,omitempty"`
+		Comment      string             `bencode:"comment,omitempty"`
+		CreatedBy    string             `bencode:"created by,omitempty"`
+		CreationDate int64              `bencode:"creation date,omitempty"`
+	}
+	mi.Info = tf.Info.Metadata
+	mi.AnnounceList = tf.AnnounceList
+	if len(tf.AnnounceList) > 0 && len(tf.AnnounceList[0]) > 0 {
+		mi.Announce = tf.AnnounceList[0][0]
+	}
+	mi.URLList = tf.URLList
+	mi.Comment = tf.Comment
+	mi.CreatedBy = tf.CreatedBy
+	if !tf.CreationDate.IsZero() {
+		mi.CreationDate = tf.CreationDate.Unix()
+	}
+	return bencode.EncodeBytes(mi)
+}
+
+// WriteFile writes the torrent file to path
+func (tf *TorrentFile) WriteFile(path string) error {
+	raw, err := tf.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0644)
+}
@@ -0,0 +1,156 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, path string, length int) {
+	data := make([]byte, length)
+	_, err := rand.Read(data)
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, os.WriteFile(path, data, 0644))
+}
+
+func TestBuild(t *testing.T) {
+	type testCase struct {
+		files       map[string]int // Relative to the torrent directory, a single "" is a single file torrent
+		builder     Builder
+		pieceLength uint32
+		paths       []string // Files of the opened torrent, in order
+	}
+
+	tcs := map[string]testCase{
+		"Single file": {
+			files:       map[string]int{"": 100000},
+			pieceLength: 16384,
+			paths:       []string{"squid"},
+		},
+		"Directory": {
+			files: map[string]int{
+				"b.txt":         40000,
+				"a/z.txt":       10,
+				"a/empty":       0,
+				"a/deep/c.bin":  70000,
+				"another/d.bin": 16384,
+			},
+			builder: Builder{
+				AnnounceList: [][]string{{"http://a.com/announce", "udp://b.com:80"}, {"https://c.com/announce"}},
+				URLList:      []string{"http://seed.com/files/"},
+				Comment:      "some comment",
+				CreatedBy:    "tests",
+				CreationDate: time.Unix(1600000000, 0),
+				Private:      true,
+			},
+			pieceLength: 16384,
+			paths: []string{
+				filepath.Join("squid", "a", "deep", "c.bin"),
+				filepath.Join("squid", "a", "empty"),
+				filepath.Join("squid", "a", "z.txt"),
+				filepath.Join("squid", "another", "d.bin"),
+				filepath.Join("squid", "b.txt"),
+			},
+		},
+		"Piece length override": {
+			files:       map[string]int{"a": 100000, "b": 3},
+			builder:     Builder{PieceLength: 32768, Name: "renamed"},
+			pieceLength: 32768,
+			paths:       []string{filepath.Join("renamed", "a"), filepath.Join("renamed", "b")},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "squid")
+			for p, length := range tc.files {
+				writeTestFile(t, filepath.Join(path, p), length)
+			}
+
+			built, err := tc.builder.Build(path)
+			require.Nil(t, err)
+			torrentPath := filepath.Join(t.TempDir(), "squid.torrent")
+			require.Nil(t, built.WriteFile(torrentPath))
+
+			tf, err := Open(torrentPath)
+			require.Nil(t, err)
+			assert.Equal(t, built.Info.InfoHash, tf.Info.InfoHash)
+			hash, err := tf.Info.BencodeInfo.hash()
+			require.Nil(t, err)
+			assert.Equal(t, hash, tf.Info.InfoHash)
+
+			assert.Equal(t, tc.pieceLength, tf.Info.BencodeInfo.PieceLength)
+			assert.Equal(t, tc.builder.Private, tf.Info.Private)
+			assert.Equal(t, tc.builder.AnnounceList, tf.AnnounceList)
+			assert.Equal(t, tc.builder.URLList, tf.URLList)
+			assert.Equal(t, tc.builder.Comment, tf.Comment)
+			if tc.builder.CreatedBy == "" {
+				assert.Equal(t, "squidtorrent", tf.CreatedBy)
+			} else {
+				assert.Equal(t, tc.builder.CreatedBy, tf.CreatedBy)
+			}
+			if tc.builder.CreationDate.IsZero() {
+				assert.WithinDuration(t, time.Now(), tf.CreationDate, time.Minute)
+			} else {
+				assert.Equal(t, tc.builder.CreationDate.Unix(), tf.CreationDate.Unix())
+			}
+
+			var paths []string
+			for _, f := range tf.Info.Files {
+				paths = append(paths, f.Path)
+			}
+			assert.Equal(t, tc.paths, paths)
+
+			// The torrent matches the files it was made out of
+			if tc.builder.Name == "" {
+				res, err := tf.Info.Verify(dir)
+				require.Nil(t, err)
+				assert.True(t, res.Complete())
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Builder{}.Build(dir)
+	assert.Equal(t, errNoFiles, err)
+
+	writeTestFile(t, filepath.Join(dir, "a"), 100)
+	_, err = Builder{PieceLength: 1000}.Build(dir)
+	assert.Equal(t, errPieceLength, err)
+
+	_, err = Builder{}.Build(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestPieceLength(t *testing.T) {
+	tests := map[string]struct {
+		length      int64
+		pieceLength uint32
+	}{
+		"tiny": {
+			length:      100,
+			pieceLength: 16384,
+		},
+		"size of debian": {
+			length:      353370112,
+			pieceLength: 262144,
+		},
+		"huge": {
+			length:      1 << 40,
+			pieceLength: 16777216,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.pieceLength, PieceLength(test.length))
+	}
+}
@@ -0,0 +1,418 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
+	"github.com/Squwid/squidtorrent/handshake"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTorrent builds a multi file torrent out of random data, returning the torrent and the
+// concatenated data of all of its files
+func testTorrent(t *testing.T, pieceLength uint32, lengths ...int64) (*TorrentFile, []byte) {
+	bci := BencodeInfo{
+		PieceLength: pieceLength,
+		Name:        "squid",
+	}
+
+	var data []byte
+	for i, l := range lengths {
+		buf := make([]byte, l)
+		_, err := rand.Read(buf)
+		require.Nil(t, err)
+		data = append(data, buf...)
+		bci.Files = append(bci.Files, file{Length: l, Path: []string{"dir", string(rune('a' + i))}})
+	}
+	for begin := 0; begin < len(data); begin += int(pieceLength) {
+		end := begin + int(pieceLength)
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		bci.Pieces = append(bci.Pieces, hash[:]...)
+	}
+
+	hash, err := bci.hash()
+	require.Nil(t, err)
+	ti, err := bci.toTorrent(hash)
+	require.Nil(t, err)
+	return &TorrentFile{Info: *ti}, data
+}
+
+// fakeSeeder is a peer that has every piece of data and serves any request after unchoking
+func fakeSeeder(t *testing.T, infoHash [20]byte, pieceLength int, data []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSeeder(conn, infoHash, pieceLength, data)
+		}
+	}()
+	return l
+}
+
+func serveSeeder(conn net.Conn, infoHash [20]byte, pieceLength int, data []byte) {
+	defer conn.Close()
+
+	if _, err := handshake.Read(conn); err != nil {
+		return
+	}
+	var peerID [20]byte
+	copy(peerID[:], "-FAKE01-seederseeder")
+	if _, err := conn.Write(handshake.New(infoHash, peerID).Serialize()); err != nil {
+		return
+	}
+
+	seed(conn, pieceLength, data)
+}
+
+// dialSeeder is a seeder that connects to the address instead of waiting for us, until it gets an answer
+func dialSeeder(addr string, infoHash [20]byte, pieceLength int, data []byte) {
+	var peerID [20]byte
+	copy(peerID[:], "-FAKE01-dialerdialer")
+
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+
+		// The torrent might not be registered yet, which gets us hung up on
+		if _, err := handshake.Read(conn); err != nil {
+			conn.Close()
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		defer conn.Close()
+		seed(conn, pieceLength, data)
+		return
+	}
+}
+
+// seed sends a full bitfield and serves every request after the handshakes are done
+func seed(conn net.Conn, pieceLength int, data []byte) {
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	bf := make([]byte, (numPieces+7)/8)
+	for i := range bf {
+		bf[i] = 0xff
+	}
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: bf}).Serialize())
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.MsgInterested:
+			conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+		case message.MsgRequest:
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			length := binary.BigEndian.Uint32(msg.Payload[8:12])
+			offset := int(index)*pieceLength + int(begin)
+
+			payload := make([]byte, 8+length)
+			copy(payload, msg.Payload[0:8])
+			copy(payload[8:], data[offset:offset+int(length)])
+			conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+		}
+	}
+}
+
+// fakeTracker responds to every announce with a compact list of the listeners
+func fakeTracker(listeners ...net.Listener) *httptest.Server {
+	return httptest.NewServer(announceHandler(listeners...))
+}
+
+// announceHandler is the handler of fakeTracker
+func announceHandler(listeners ...net.Listener) http.HandlerFunc {
+	var compact []byte
+	for _, l := range listeners {
+		addr := l.Addr().(*net.TCPAddr)
+		compact = append(compact, addr.IP.To4()...)
+		compact = append(compact, byte(addr.Port>>8), byte(addr.Port))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers" + strconv.Itoa(len(compact)) + ":" + string(compact) + "e"))
+	}
+}
+
+func TestDownloadToFile(t *testing.T) {
+	const pieceLength = 32768
+	tf, data := testTorrent(t, pieceLength, 50000, 3, 70000)
+
+	seeders := []net.Listener{
+		fakeSeeder(t, tf.Info.InfoHash, pieceLength, data),
+		fakeSeeder(t, tf.Info.InfoHash, pieceLength, data),
+	}
+	for _, s := range seeders {
+		defer s.Close()
+	}
+
+	var mu sync.Mutex
+	var events []string
+	announce := announceHandler(seeders...)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		announce(w, r)
+	}))
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	outDir := t.TempDir()
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+
+	// Trackers hear that we are gone even though we are not seeding
+	mu.Lock()
+	assert.Equal(t, []string{"started", "completed", "stopped"}, events)
+	mu.Unlock()
+
+	var offset int64
+	for _, f := range tf.Info.Files {
+		got, err := os.ReadFile(filepath.Join(outDir, f.Path))
+		require.Nil(t, err)
+		assert.Equal(t, data[offset:offset+f.Length], got)
+		offset += f.Length
+	}
+}
+
+func TestDownloadToFileIncoming(t *testing.T) {
+	const pieceLength = 16384
+	tf, data := testTorrent(t, pieceLength, 40000)
+
+	// The tracker knows no one, the only seeder connects to us
+	tracker := fakeTracker()
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	l, err := client.Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer l.Close()
+	tf.Listener = l
+	go dialSeeder(l.Addr().String(), tf.Info.InfoHash, pieceLength, data)
+
+	outDir := t.TempDir()
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+
+	got, err := os.ReadFile(filepath.Join(outDir, tf.Info.Files[0].Path))
+	require.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloadToFileReannounce(t *testing.T) {
+	defer func(interval time.Duration) { defaultAnnounceInterval = interval }(defaultAnnounceInterval)
+	defaultAnnounceInterval = 50 * time.Millisecond
+
+	const pieceLength = 16384
+	tf, data := testTorrent(t, pieceLength, 40000)
+
+	seeder := fakeSeeder(t, tf.Info.InfoHash, pieceLength, data)
+	defer seeder.Close()
+	addr := seeder.Addr().(*net.TCPAddr)
+	compact := string(append(addr.IP.To4(), byte(addr.Port>>8), byte(addr.Port)))
+
+	// The seeder only shows up from the second announce on, which has no event since it is a regular one
+	var announces int32
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&announces, 1) == 1 {
+			assert.Equal(t, "started", r.URL.Query().Get("event"))
+			w.Write([]byte("d5:peers0:e"))
+			return
+		}
+		if r.URL.Query().Get("event") == "" {
+			w.Write([]byte("d5:peers6:" + compact + "e"))
+			return
+		}
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	// Without a listener a download with no peers gives up right away
+	l, err := client.Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer l.Close()
+	tf.Listener = l
+
+	outDir := t.TempDir()
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+
+	got, err := os.ReadFile(filepath.Join(outDir, tf.Info.Files[0].Path))
+	require.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestDownloadToFileNoPeers(t *testing.T) {
+	tf, _ := testTorrent(t, 16384, 100)
+
+	// Tracker hands out a peer that is not listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l.Close()
+
+	tracker := fakeTracker(l)
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	assert.NotNil(t, tf.DownloadToFile(context.Background(), t.TempDir()))
+}
+
+func TestDownloadToFileDHT(t *testing.T) {
+	const pieceLength = 16384
+	tf, data := testTorrent(t, pieceLength, 40000)
+
+	seeder := fakeSeeder(t, tf.Info.InfoHash, pieceLength, data)
+	defer seeder.Close()
+
+	// The seeder announces itself through one node, the download finds it through another
+	router, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer router.Close()
+
+	node := func() *dht.Server {
+		d, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{router.Addr().String()}})
+		require.Nil(t, err)
+		require.Nil(t, d.Bootstrap())
+		return d
+	}
+	seederNode := node()
+	defer seederNode.Close()
+	for range seederNode.Announce(tf.Info.InfoHash, uint16(seeder.Addr().(*net.TCPAddr).Port)) {
+	}
+
+	tf.DHT = node()
+	defer tf.DHT.Close()
+
+	outDir := t.TempDir()
+	require.Eventually(t, func() bool {
+		return tf.DownloadToFile(context.Background(), outDir) == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	got, err := os.ReadFile(filepath.Join(outDir, tf.Info.Files[0].Path))
+	require.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	// Private torrents never touch the DHT, and without trackers there is nothing to download from
+	tf.Info.Private = true
+	assert.NotNil(t, tf.DownloadToFile(context.Background(), t.TempDir()))
+}
+
+// leech connects to addr as a peer without any pieces and fetches a block once it gets unchoked
+func leech(t *testing.T, addr string, infoHash [20]byte, index, begin, length int) []byte {
+	var peerID [20]byte
+	copy(peerID[:], "-FAKE01-leecherleech")
+
+	// Like dialSeeder, the torrent might not be registered yet
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial("tcp", addr)
+		require.Nil(t, err)
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		if _, err := handshake.Read(conn); err != nil {
+			conn.Close()
+			return false
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0}}).Serialize())
+	conn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+
+	for {
+		msg, err := message.Read(conn)
+		require.Nil(t, err)
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgUnchoke:
+			conn.Write(message.FormatRequest(index, begin, length).Serialize())
+		case message.MsgPiece:
+			buf := make([]byte, begin+length)
+			_, err := msg.ParsePiece(index, buf)
+			require.Nil(t, err)
+			return buf[begin:]
+		}
+	}
+}
+
+func TestDownloadToFileSeed(t *testing.T) {
+	const pieceLength = 16384
+	tf, data := testTorrent(t, pieceLength, 40000)
+
+	tracker := fakeTracker()
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	l, err := client.Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer l.Close()
+	tf.Listener = l
+	tf.Seed = true
+	go dialSeeder(l.Addr().String(), tf.Info.InfoHash, pieceLength, data)
+
+	outDir := t.TempDir()
+	seed := func() (context.CancelFunc, <-chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() { errs <- tf.DownloadToFile(ctx, outDir) }()
+		return cancel, errs
+	}
+
+	// The download keeps going once it is done, and hands out what it got
+	cancel, errs := seed()
+	require.Eventually(t, func() bool {
+		got, _ := os.ReadFile(filepath.Join(outDir, tf.Info.Files[0].Path))
+		return bytes.Equal(data, got)
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, data[pieceLength+100:pieceLength+200], leech(t, l.Addr().String(), tf.Info.InfoHash, 1, 100, 100))
+	select {
+	case err := <-errs:
+		t.Fatalf("download returned while seeding: %v", err)
+	default:
+	}
+	cancel()
+	assert.Nil(t, <-errs)
+
+	// A torrent that was already downloaded seeds as well
+	cancel, errs = seed()
+	assert.Equal(t, data[2*pieceLength:], leech(t, l.Addr().String(), tf.Info.InfoHash, 2, 0, len(data)-2*pieceLength))
+	cancel()
+	assert.Nil(t, <-errs)
+}
@@ -0,0 +1,139 @@
+package torrentfile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+)
+
+// resumeInterval is the least time between saves of the resume data while downloading
+const resumeInterval = 10 * time.Second
+
+// resumeData is what is saved about a download so it can carry on where it left off. It only gets trusted
+// if every file still has the size and modification time that was saved along with it
+type resumeData struct {
+	InfoHash []byte       `bencode:"info hash"`
+	Bitfield []byte       `bencode:"bitfield"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+type resumeFile struct {
+	Length  int64 `bencode:"length"`
+	ModTime int64 `bencode:"mtime"` // Unix nanoseconds
+}
+
+// resumePath is where the resume data of the torrent is kept, empty without a ResumeDir
+func (tf *TorrentFile) resumePath() string {
+	if tf.ResumeDir == "" {
+		return ""
+	}
+	return filepath.Join(tf.ResumeDir, hex.EncodeToString(tf.Info.InfoHash[:])+".resume")
+}
+
+// statFiles gets the size and modification time of every file of the torrent, files that do not exist
+// have neither
+func (tf *TorrentFile) statFiles(outDir string) []resumeFile {
+	files := make([]resumeFile, len(tf.Info.Files))
+	for i, f := range tf.Info.Files {
+		if info, err := os.Stat(filepath.Join(outDir, f.Path)); err == nil {
+			files[i] = resumeFile{Length: info.Size(), ModTime: info.ModTime().UnixNano()}
+		}
+	}
+	return files
+}
+
+// loadResume gets the pieces the resume data says are done, as long as it matches the files on disk
+func (tf *TorrentFile) loadResume(outDir string) (bitfield.Bitfield, bool) {
+	path := tf.resumePath()
+	if path == "" {
+		return nil, false
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var rd resumeData
+	if err := bencode.DecodeBytes(raw, &rd); err != nil {
+		logrus.WithError(err).Warnf("Error reading resume data")
+		return nil, false
+	}
+	if !bytes.Equal(rd.InfoHash, tf.Info.InfoHash[:]) || len(rd.Bitfield) != (int(tf.Info.NumPieces)+7)/8 {
+		return nil, false
+	}
+
+	files := tf.statFiles(outDir)
+	if len(rd.Files) != len(files) {
+		return nil, false
+	}
+	for i := range files {
+		if rd.Files[i] != files[i] {
+			return nil, false
+		}
+	}
+	return rd.Bitfield, true
+}
+
+// saveResume saves the pieces that are done along with the state of the files they are in
+func (tf *TorrentFile) saveResume(outDir string, bf bitfield.Bitfield) error {
+	path := tf.resumePath()
+	if path == "" {
+		return nil
+	}
+
+	raw, err := bencode.EncodeBytes(resumeData{
+		InfoHash: tf.Info.InfoHash[:],
+		Bitfield: bf,
+		Files:    tf.statFiles(outDir),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkPieces hashes the data already in the storage, any piece that can't be read counts as missing
+func (tf *TorrentFile) checkPieces(store storage.Storage) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (tf.Info.NumPieces+7)/8)
+	for i, state := range tf.Info.hashPieces(store) {
+		if state == pieceGood {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// resume gets the pieces that are already in the output directory. The resume data is used if it still
+// matches the files, otherwise everything on disk gets checked
+func (tf *TorrentFile) resume(outDir string, store storage.Storage) bitfield.Bitfield {
+	logger := logrus.WithField("Name", tf.Info.Name)
+	if bf, ok := tf.loadResume(outDir); ok {
+		logger.Debugf("Using resume data")
+		return bf
+	}
+
+	bf := tf.checkPieces(store)
+	have := 0
+	for i := 0; i < int(tf.Info.NumPieces); i++ {
+		if bf.HasPiece(i) {
+			have++
+		}
+	}
+	logger.Infof("Checked existing data, %v/%v pieces are done", have, tf.Info.NumPieces)
+	return bf
+}
@@ -0,0 +1,162 @@
+package torrentfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/bitfield"
+	"github.com/Squwid/squidtorrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles writes the torrent data to the output directory, skipping the files that are not listed
+func writeFiles(t *testing.T, tf *TorrentFile, outDir string, data []byte, only ...int) {
+	var offset int64
+	for i, f := range tf.Info.Files {
+		write := len(only) == 0
+		for _, o := range only {
+			write = write || o == i
+		}
+		if write {
+			path := filepath.Join(outDir, f.Path)
+			require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.Nil(t, os.WriteFile(path, data[offset:offset+f.Length], 0644))
+		}
+		offset += f.Length
+	}
+}
+
+func openStorage(t *testing.T, tf *TorrentFile, outDir string) storage.Storage {
+	s, err := storage.NewFileStorage(outDir, tf.Info.storageFiles(), int64(tf.Info.BencodeInfo.PieceLength))
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCheckPieces(t *testing.T) {
+	// Pieces 0 and 1 are in the first file, 2 crosses into the second and 3 is all second file
+	tf, data := testTorrent(t, 16384, 40000, 25000)
+
+	type testCase struct {
+		files   []int
+		corrupt int64 // Offset of a flipped byte, -1 for none
+		have    []int
+	}
+
+	tcs := map[string]testCase{
+		"Nothing on disk": {
+			files:   []int{-1},
+			corrupt: -1,
+		},
+		"Everything on disk": {
+			corrupt: -1,
+			have:    []int{0, 1, 2, 3},
+		},
+		"Only the first file": {
+			files:   []int{0},
+			corrupt: -1,
+			have:    []int{0, 1},
+		},
+		"Only the second file": {
+			files:   []int{1},
+			corrupt: -1,
+			have:    []int{3},
+		},
+		"Corrupt piece": {
+			corrupt: 20000,
+			have:    []int{0, 2, 3},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			buf := append([]byte(nil), data...)
+			if tc.corrupt >= 0 {
+				buf[tc.corrupt]++
+			}
+			outDir := t.TempDir()
+			writeFiles(t, tf, outDir, buf, tc.files...)
+
+			bf := tf.checkPieces(openStorage(t, tf, outDir))
+			for i := 0; i < int(tf.Info.NumPieces); i++ {
+				want := false
+				for _, h := range tc.have {
+					want = want || h == i
+				}
+				assert.Equal(t, want, bf.HasPiece(i), "piece %v", i)
+			}
+		})
+	}
+}
+
+func TestResumeData(t *testing.T) {
+	tf, data := testTorrent(t, 16384, 40000, 25000)
+	tf.ResumeDir = t.TempDir()
+	outDir := t.TempDir()
+	writeFiles(t, tf, outDir, data, 0)
+	store := openStorage(t, tf, outDir)
+
+	_, ok := tf.loadResume(outDir)
+	assert.False(t, ok, "nothing saved yet")
+
+	// Resume data says something different from what is on disk, it gets trusted while the files are untouched
+	bf := bitfield.Bitfield{0x20}
+	require.Nil(t, tf.saveResume(outDir, bf))
+	got, ok := tf.loadResume(outDir)
+	require.True(t, ok)
+	assert.Equal(t, bf, got)
+	assert.Equal(t, bf, tf.resume(outDir, store))
+
+	// Touching a file makes the resume data useless, so the data is checked again
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(outDir, tf.Info.Files[0].Path), later, later))
+	_, ok = tf.loadResume(outDir)
+	assert.False(t, ok)
+	got = tf.resume(outDir, store)
+	assert.Equal(t, bitfield.Bitfield{0xc0}, got)
+
+	require.Nil(t, tf.saveResume(outDir, got))
+	other := *tf
+	other.Info.InfoHash[0]++
+	require.Nil(t, os.Rename(tf.resumePath(), other.resumePath()))
+	_, ok = other.loadResume(outDir)
+	assert.False(t, ok)
+}
+
+func TestDownloadToFileResume(t *testing.T) {
+	const pieceLength = 16384
+	tf, data := testTorrent(t, pieceLength, 40000, 25000)
+	tf.ResumeDir = t.TempDir()
+	outDir := t.TempDir()
+
+	// Only the last piece is missing. The seeder has a corrupt first piece, so that one has to come from disk
+	writeFiles(t, tf, outDir, data)
+	bad := append([]byte(nil), data...)
+	bad[0]++
+	seeder := fakeSeeder(t, tf.Info.InfoHash, pieceLength, bad)
+	defer seeder.Close()
+	tracker := fakeTracker(seeder)
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	require.Nil(t, os.Truncate(filepath.Join(outDir, tf.Info.Files[1].Path), 25000-100))
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+
+	var offset int64
+	for _, f := range tf.Info.Files {
+		got, err := os.ReadFile(filepath.Join(outDir, f.Path))
+		require.Nil(t, err)
+		assert.Equal(t, data[offset:offset+f.Length], got)
+		offset += f.Length
+	}
+
+	// Everything is there now, so nothing gets announced or downloaded
+	tracker.Close()
+	_, ok := tf.loadResume(outDir)
+	assert.True(t, ok)
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+}
@@ -0,0 +1,149 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// udpMaxScrape is the most infohashes that fit in a single UDP scrape
+const udpMaxScrape = 74
+
+var errScrapeUnsupported = errors.New("tracker does not support scraping")
+
+type bencodeScrapeResp struct {
+	FailureReason string                       `bencode:"failure reason"`
+	Files         map[string]bencodeScrapeFile `bencode:"files"` // Keyed by the raw 20 byte infohash
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks a single tracker for the swarm stats of every infohash. Infohashes the tracker does
+// not know about are left out of the result
+func Scrape(tracker string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return scrapeUDP(u.Host, infoHashes)
+	case "http", "https":
+		return scrapeHTTP(u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// Scrape gets the swarm stats of the torrent from the first tracker that answers, tier by tier
+func (tf TorrentFile) Scrape() (*ScrapeResult, error) {
+	lastErr := fmt.Errorf("torrent has no supported trackers")
+	for _, tier := range tf.AnnounceList {
+		for _, tracker := range tier {
+			results, err := Scrape(tracker, tf.Info.InfoHash)
+			if err != nil {
+				lastErr = fmt.Errorf("scrape %v: %w", tracker, err)
+				continue
+			}
+			res, ok := results[tf.Info.InfoHash]
+			if !ok {
+				lastErr = fmt.Errorf("scrape %v: torrent is not registered", tracker)
+				continue
+			}
+			return &res, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// scrapeURL turns an announce url into a scrape url. Only urls where the last path element starts
+// with 'announce' can be scraped, https://www.bittorrent.org/beps/bep_0048.html
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announce.Path, "/")
+	if i < 0 || !strings.HasPrefix(announce.Path[i+1:], "announce") {
+		return nil, errScrapeUnsupported
+	}
+
+	u := *announce
+	u.Path = announce.Path[:i+1] + "scrape" + strings.TrimPrefix(announce.Path[i+1:], "announce")
+	u.RawPath = ""
+	return &u, nil
+}
+
+func scrapeHTTP(announce *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var scrapeResp bencodeScrapeResp
+	if err := bencode.NewDecoder(resp.Body).Decode(&scrapeResp); err != nil {
+		return nil, err
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, errors.New(scrapeResp.FailureReason)
+	}
+
+	results := map[[20]byte]ScrapeResult{}
+	for k, f := range scrapeResp.Files {
+		if len(k) != 20 {
+			continue
+		}
+		var h [20]byte
+		copy(h[:], k)
+		results[h] = ScrapeResult{
+			Seeders:   f.Complete,
+			Leechers:  f.Incomplete,
+			Completed: f.Downloaded,
+		}
+	}
+	return results, nil
+}
+
+func scrapeUDP(host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	ut, err := dialUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer ut.Close()
+
+	results := map[[20]byte]ScrapeResult{}
+	for begin := 0; begin < len(infoHashes); begin += udpMaxScrape {
+		end := begin + udpMaxScrape
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		res, err := ut.scrape(infoHashes[begin:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range res {
+			results[infoHashes[begin+i]] = r
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,109 @@
+package torrentfile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"announce": {
+			input:  "http://example.com/announce",
+			output: "http://example.com/scrape",
+		},
+		"announce with suffix": {
+			input:  "http://example.com/x/announce.php",
+			output: "http://example.com/x/scrape.php",
+		},
+		"keeps query": {
+			input:  "http://example.com/announce?passkey=abc",
+			output: "http://example.com/scrape?passkey=abc",
+		},
+		"announce not last element": {
+			input: "http://example.com/announce/x",
+			fails: true,
+		},
+		"no announce": {
+			input: "http://example.com/a",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		u, err := url.Parse(test.input)
+		require.Nil(t, err)
+
+		scrape, err := scrapeURL(u)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, scrape.String(), name)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		query = r.URL.Query()
+		w.Write([]byte("d5:filesd" +
+			"20:" + string(testInfoHash[:]) + "d8:completei5e10:downloadedi50e10:incompletei10ee" +
+			"ee"))
+	}))
+	defer ts.Close()
+
+	other := [20]byte{9}
+	results, err := Scrape(ts.URL+"/announce", testInfoHash, other)
+	require.Nil(t, err)
+	assert.Equal(t, []string{string(testInfoHash[:]), string(other[:])}, query["info_hash"])
+	assert.Equal(t, map[[20]byte]ScrapeResult{
+		testInfoHash: {Seeders: 5, Leechers: 10, Completed: 50},
+	}, results)
+}
+
+func TestScrapeUDP(t *testing.T) {
+	stub := newUDPTrackerStub(t, 0, "")
+
+	// More hashes than fit in one packet
+	hashes := make([][20]byte, udpMaxScrape+6)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+		hashes[i][1] = 1 // Keep hashes unique from the test infohash
+	}
+
+	results, err := Scrape(stub.url(), hashes...)
+	require.Nil(t, err)
+	assert.Len(t, results, len(hashes))
+	assert.Equal(t, ScrapeResult{Seeders: 77, Completed: 78, Leechers: 79}, results[hashes[77]])
+}
+
+func TestTorrentFileScrape(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesd" +
+			"20:" + string(testInfoHash[:]) + "d8:completei1e10:downloadedi2e10:incompletei3ee" +
+			"ee"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{
+		Info: TorrentInfo{InfoHash: testInfoHash},
+		AnnounceList: [][]string{
+			{ts.URL + "/unscrapable"},
+			{ts.URL + "/announce"},
+		},
+	}
+	res, err := tf.Scrape()
+	require.Nil(t, err)
+	assert.Equal(t, &ScrapeResult{Seeders: 1, Leechers: 3, Completed: 2}, res)
+}
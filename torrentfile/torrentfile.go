@@ -1,6 +1,8 @@
 package torrentfile
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
@@ -9,8 +11,17 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 	"unicode"
 
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/dht"
+	"github.com/Squwid/squidtorrent/merkle"
+	"github.com/Squwid/squidtorrent/metadata"
+	"github.com/Squwid/squidtorrent/p2p"
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/Squwid/squidtorrent/storage"
+	"github.com/sirupsen/logrus"
 	"github.com/zeebo/bencode"
 )
 
@@ -21,82 +32,250 @@ var (
 	errPieceLength      = errors.New("piece length must be multiple of 16K")
 )
 
+// Port is announced when there is no listener, and is the default port to listen on
 const Port uint16 = 6881
 
+// peerIDPrefix identifies squidtorrent to other peers
+const peerIDPrefix = "-SQ0001-"
+
 // TorrentFile contains all information that a torrent needs to be downloaded
 type TorrentFile struct {
 	Info         TorrentInfo
 	AnnounceList [][]string
 	URLList      []string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time        // Zero when the torrent does not say
+	DHT          *dht.Server      // Optional, finds peers of torrents that are not private
+	Listener     *client.Listener // Optional, accepts peers that connect to us. Its port gets announced
+	Dialer       client.Dialer    // How we connect to peers
+	ResumeDir    string           // Optional, where resume data is kept. Without it existing data is always rechecked
+	Seed         bool             // Keep seeding to peers that connect to the Listener once every piece is there
 }
 
 // TorrentInfo contains info about the torrent file
 type TorrentInfo struct {
 	Name        string
-	InfoHash    [20]byte
+	InfoHash    [20]byte // v2 only torrents use the first 20 bytes of InfoHashV2
+	InfoHashV2  [32]byte // SHA-256 of the info dictionary, only set for v2 and hybrid torrents
+	MetaVersion int      // 2 for v2 and hybrid torrents (BEP 52)
 	Length      int64
 	NumPieces   uint32
 	Private     bool
 	Files       []File
 	BencodeInfo BencodeInfo
+	Metadata    []byte // Raw bencoded info dictionary, the infohash is the hash of these bytes
+
+	// PieceLayers are the hashes of the pieces of every v2 file bigger than a piece, by pieces root
+	PieceLayers map[[32]byte][]merkle.Hash
 }
 
 type BencodeInfo struct {
 	PieceLength uint32             `bencode:"piece length"`
 	Pieces      []byte             `bencode:"pieces"`
 	Name        string             `bencode:"name"`
-	Private     bencode.RawMessage `bencode:"private"`
-	Length      int64              `bencode:"length"` // Single File Mode
-	Files       []file             `bencode:"files"`  // Multiple File mode
+	Private     bencode.RawMessage `bencode:"private,omitempty"`
+	Length      int64              `bencode:"length,omitempty"` // Single File Mode
+	Files       []file             `bencode:"files,omitempty"`  // Multiple File mode
+	MetaVersion int                `bencode:"meta version,omitempty"`
+	FileTree    bencode.RawMessage `bencode:"file tree,omitempty"` // v2 files
 }
 
 // File represents a file inside of a torrent
 type File struct {
-	Length int64
-	Path   string
+	Length     int64
+	Path       string
+	PiecesRoot [32]byte // Root of the merkle tree of the file, v2 only
+	Padding    bool     // Lines the next file up with a piece (BEP 47), it is never written
 }
 
 type file struct {
 	Length int64    `bencode:"length"`
 	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"` // p for padding files
 }
 
-func (tf *TorrentFile) DownloadToFile(path string) error {
-	// outFile, err := os.Create(path)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer outFile.Close()
-
-	// var peerID [20]byte
-	// if _, err := rand.Read(peerID[:]); err != nil {
-	// 	return err
-	// } // TODO: Change peer id to a static one
-
-	// peers, err := tf.requestPeers(peerID, Port)
-	// if err != nil {
-	// 	return err
-	// }
-
-	// torrent := p2p.Torrent{
-	// 	Peers:    peers,
-	// 	PeerID:   peerID,
-	// 	InfoHash: tf.InfoHash,
-	// 	// PieceHashes: tf.PieceHashes,
-	// 	// PieceLength: tf.PieceLength,
-	// 	// Length:      tf.Length,
-	// 	Name: tf.Name,
-	// }
-
-	// buf, err := torrent.Download()
-	// if err != nil {
-	// 	return err
-	// }
-
-	// if _, err := outFile.Write(buf); err != nil {
-	// 	return err
-	// }
-	return nil
+// DownloadToFile announces to the trackers and downloads the torrent from the returned peers. Pieces are
+// written straight into the files of the torrent in the output directory, pieces that are already there
+// are kept. With Seed it goes on seeding until ctx is done
+func (tf *TorrentFile) DownloadToFile(ctx context.Context, outDir string) error {
+	peerID, err := NewPeerID()
+	if err != nil {
+		return err
+	}
+
+	port := Port
+	if tf.Listener != nil {
+		port = tf.Listener.Port()
+	}
+
+	if tf.Info.IsV2() && !tf.Info.IsHybrid() {
+		return errV2Only
+	}
+
+	store, err := storage.NewFileStorage(outDir, tf.Info.storageFiles(), int64(tf.Info.BencodeInfo.PieceLength))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	logger := logrus.WithField("Name", tf.Info.Name)
+	torrent := p2p.Torrent{
+		PeerID:      peerID,
+		InfoHash:    tf.Info.InfoHash,
+		PieceHashes: tf.Info.pieceHashes(),
+		PieceLength: int(tf.Info.BencodeInfo.PieceLength),
+		Length:      int(tf.Info.Length),
+		Name:        tf.Info.Name,
+		Private:     tf.Info.Private,
+		Metadata:    tf.Info.Metadata,
+		DHT:         tf.DHT,
+		Port:        port,
+		Listener:    tf.Listener,
+		Dialer:      tf.Dialer,
+		Storage:     store,
+		CheckPiece:  tf.Info.checkMerkle,
+		Have:        tf.resume(outDir, store),
+		Seed:        tf.Seed,
+	}
+	if tf.Info.IsHybrid() {
+		copy(torrent.InfoHashV2[:], tf.Info.InfoHashV2[:])
+		torrent.Hashes = tf.Info.Hashes
+	}
+	if torrent.Left() == 0 {
+		logger.Infof("Torrent is already downloaded")
+		if err := tf.saveResume(outDir, torrent.Have); err != nil || !tf.Seed || tf.Listener == nil {
+			return err
+		}
+	}
+
+	// Resume data is saved every so often while downloading, and once more when we are done
+	lastSave := time.Now()
+	torrent.OnPiece = func(int) {
+		if time.Since(lastSave) < resumeInterval {
+			return
+		}
+		lastSave = time.Now()
+		if err := tf.saveResume(outDir, torrent.Bitfield()); err != nil {
+			logger.WithError(err).Warnf("Error saving resume data")
+		}
+	}
+	defer func() {
+		if err := tf.saveResume(outDir, torrent.Bitfield()); err != nil {
+			logger.WithError(err).Warnf("Error saving resume data")
+		}
+	}()
+
+	announcer := NewAnnouncer(tf)
+	defer announcer.Close()
+
+	resp, err := announcer.Announce(AnnounceRequest{
+		PeerID: peerID,
+		Port:   port,
+		Left:   torrent.Left(),
+		Event:  EventStarted,
+	})
+	if err != nil {
+		// Trackerless torrents can still get their peers from the DHT
+		if tf.DHT == nil || tf.Info.Private {
+			return err
+		}
+		logger.WithError(err).Warnf("Error announcing, only using the DHT")
+		resp = &AnnounceResponse{}
+	}
+	if resp.Warning != "" {
+		logger.Warnf("Tracker warning: %v", resp.Warning)
+	}
+	torrent.Peers = resp.Peers
+
+	torrent.OnComplete = func() {
+		if _, err := announcer.Announce(AnnounceRequest{
+			PeerID:     peerID,
+			Port:       port,
+			Uploaded:   torrent.Uploaded(),
+			Downloaded: torrent.Downloaded(),
+			Event:      EventCompleted,
+		}); err != nil {
+			logger.WithError(err).Warnf("Error announcing completed")
+		}
+		if tf.Seed {
+			logger.Infof("Download done, seeding")
+		}
+	}
+
+	// Trackers keep getting announced to every interval, the peers they hand out join the download
+	stopAnnounce := make(chan struct{})
+	announced := make(chan struct{})
+	go func() {
+		defer close(announced)
+		wait := nextAnnounce(resp)
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stopAnnounce:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			resp, err := announcer.Announce(AnnounceRequest{
+				PeerID:     peerID,
+				Port:       port,
+				Uploaded:   torrent.Uploaded(),
+				Downloaded: torrent.Downloaded(),
+				Left:       torrent.Left(),
+			})
+			if err != nil {
+				logger.WithError(err).Warnf("Error announcing")
+				continue
+			}
+			wait = nextAnnounce(resp)
+			torrent.AddPeers(resp.Peers)
+		}
+	}()
+
+	err = torrent.Download(ctx)
+	close(stopAnnounce)
+	<-announced
+
+	// Let the trackers know we are gone so they stop handing us out
+	if _, aerr := announcer.Announce(AnnounceRequest{
+		PeerID:     peerID,
+		Port:       port,
+		Uploaded:   torrent.Uploaded(),
+		Downloaded: torrent.Downloaded(),
+		Left:       torrent.Left(),
+		Event:      EventStopped,
+	}); aerr != nil {
+		logger.WithError(aerr).Warnf("Error announcing stopped")
+	}
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
+
+// nextAnnounce is how long to wait before the next regular announce, the interval of the tracker but never
+// less than its min interval
+func nextAnnounce(resp *AnnounceResponse) time.Duration {
+	wait := resp.Interval
+	if wait <= 0 {
+		wait = defaultAnnounceInterval
+	}
+	if wait < resp.MinInterval {
+		wait = resp.MinInterval
+	}
+	return wait
+}
+
+// NewPeerID creates a random azureus style peer id, '-SQ0001-' followed by 12 random bytes
+func NewPeerID() ([20]byte, error) {
+	var peerID [20]byte
+	n := copy(peerID[:], peerIDPrefix)
+	if _, err := rand.Read(peerID[n:]); err != nil {
+		return [20]byte{}, err
+	}
+	return peerID, nil
 }
 
 // Open parses a torrent file
@@ -115,6 +294,10 @@ func Open(path string) (*TorrentFile, error) {
 		Announce     bencode.RawMessage `bencode:"announce"`
 		AnnounceList bencode.RawMessage `bencode:"announce-list"`
 		URLList      bencode.RawMessage `bencode:"url-list"`
+		Comment      bencode.RawMessage `bencode:"comment"`
+		CreatedBy    bencode.RawMessage `bencode:"created by"`
+		CreationDate bencode.RawMessage `bencode:"creation date"`
+		PieceLayers  bencode.RawMessage `bencode:"piece layers"`
 	}
 	if err := bencode.NewDecoder(file).Decode(&bcode); err != nil {
 		return nil, err
@@ -123,19 +306,30 @@ func Open(path string) (*TorrentFile, error) {
 		return nil, fmt.Errorf("expected info in torrent file but there was none")
 	}
 
-	// Info part of the encoded torrent is BencodeInfo, make a torrent object from this
-	var bci BencodeInfo
-	if err := bencode.DecodeBytes(bcode.Info, &bci); err != nil {
-		return nil, err
-	}
-
-	ti, err := bci.toTorrent()
+	ti, err := parseInfo(bcode.Info)
 	if err != nil {
 		return nil, err
 	}
 
+	if ti.IsV2() && len(bcode.PieceLayers) > 0 {
+		var layers map[string][]byte
+		if err := bencode.DecodeBytes(bcode.PieceLayers, &layers); err != nil {
+			return nil, err
+		}
+		if err := ti.addPieceLayers(layers); err != nil {
+			return nil, err
+		}
+	}
 	tf.Info = *ti
 
+	// Optional fields that are broken are left out rather than failing the whole torrent
+	bencode.DecodeBytes(bcode.Comment, &tf.Comment)
+	bencode.DecodeBytes(bcode.CreatedBy, &tf.CreatedBy)
+	var date int64
+	if err := bencode.DecodeBytes(bcode.CreationDate, &date); err == nil && date > 0 {
+		tf.CreationDate = time.Unix(date, 0)
+	}
+
 	// Decide between announce list or announce url
 	if len(bcode.AnnounceList) > 0 {
 		var al [][]string
@@ -159,11 +353,76 @@ func Open(path string) (*TorrentFile, error) {
 		}
 	}
 
-	// TODO: Stuff with seeding at some point
-
+	// Web seeds are either a single url or a list of them
+	if len(bcode.URLList) > 0 {
+		var s string
+		if err := bencode.DecodeBytes(bcode.URLList, &s); err == nil {
+			if s != "" {
+				tf.URLList = []string{s}
+			}
+		} else {
+			bencode.DecodeBytes(bcode.URLList, &tf.URLList)
+		}
+	}
 	return &tf, nil
 }
 
+// ParseInfo parses a raw info dictionary that was fetched from peers, it has to match the infohash
+func ParseInfo(raw []byte, infoHash [20]byte) (*TorrentInfo, error) {
+	ti, err := parseInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ti.InfoHash != infoHash {
+		return nil, fmt.Errorf("info hash %x does not match %x", ti.InfoHash, infoHash)
+	}
+	return ti, nil
+}
+
+// FetchInfo downloads the info dictionary of a torrent from peers (BEP 9)
+func FetchInfo(d client.Dialer, infoHash [20]byte, ps []peers.Peer) (*TorrentInfo, error) {
+	peerID, err := NewPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := metadata.Fetch(d, ps, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return ParseInfo(raw, infoHash)
+}
+
+// parseInfo decodes a raw info dictionary. Info part of the encoded torrent is BencodeInfo, make a
+// torrent object from this
+func parseInfo(raw []byte) (*TorrentInfo, error) {
+	var bci BencodeInfo
+	if err := bencode.DecodeBytes(raw, &bci); err != nil {
+		return nil, err
+	}
+
+	if bci.MetaVersion != 0 && bci.MetaVersion != 1 && bci.MetaVersion != 2 {
+		return nil, fmt.Errorf("unsupported meta version %v", bci.MetaVersion)
+	}
+
+	// Info hash is taken from the raw bytes, re-encoding would drop any keys that BencodeInfo does not know about.
+	// v2 only torrents have no v1 part to check
+	ti := &TorrentInfo{Name: bci.Name, Private: private(bci.Private), BencodeInfo: bci}
+	if bci.MetaVersion != 2 || len(bci.Pieces) > 0 {
+		var err error
+		if ti, err = bci.toTorrent(sha1.Sum(raw)); err != nil {
+			return nil, err
+		}
+	}
+	if bci.MetaVersion == 2 {
+		if err := bci.addV2(ti, raw); err != nil {
+			return nil, err
+		}
+	}
+	ti.Metadata = raw
+	return ti, nil
+}
+
 func (bci BencodeInfo) Bytes() ([]byte, error) {
 	return bencode.EncodeBytes(bci)
 }
@@ -181,13 +440,22 @@ func (ti TorrentInfo) PieceHash(index uint32) []byte {
 	return ti.BencodeInfo.PieceHash(index)
 }
 
+// pieceHashes splits the pieces blob into the hash of each piece
+func (ti TorrentInfo) pieceHashes() [][20]byte {
+	hashes := make([][20]byte, ti.NumPieces)
+	for i := range hashes {
+		copy(hashes[i][:], ti.PieceHash(uint32(i)))
+	}
+	return hashes
+}
+
 func (bci BencodeInfo) PieceHash(index uint32) []byte {
 	begin := index * sha1.Size
 	end := begin + sha1.Size
 	return bci.Pieces[begin:end]
 }
 
-func (bci BencodeInfo) toTorrent() (*TorrentInfo, error) {
+func (bci BencodeInfo) toTorrent(infoHash [20]byte) (*TorrentInfo, error) {
 	if bci.PieceLength == 0 {
 		return nil, errZeroPieceLength
 	}
@@ -199,10 +467,10 @@ func (bci BencodeInfo) toTorrent() (*TorrentInfo, error) {
 		return nil, errZeroPieces
 	}
 
-	// No .. allowed in file names
+	// File names have to stay inside the torrent directory
 	for _, file := range bci.Files {
 		for _, path := range file.Path {
-			if strings.TrimSpace(path) == ".." {
+			if !validName(path) {
 				return nil, fmt.Errorf("invalid file name %v", filepath.Join(file.Path...))
 			}
 		}
@@ -211,6 +479,7 @@ func (bci BencodeInfo) toTorrent() (*TorrentInfo, error) {
 	ti := TorrentInfo{
 		NumPieces:   uint32(numPieces),
 		Name:        bci.Name,
+		Private:     private(bci.Private),
 		BencodeInfo: bci,
 	}
 
@@ -230,17 +499,15 @@ func (bci BencodeInfo) toTorrent() (*TorrentInfo, error) {
 		return nil, errInvalidPieceData
 	}
 
-	// Hash file info
-	hash, err := bci.hash()
-	if err != nil {
-		return nil, err
-	}
-	ti.InfoHash = hash
+	ti.InfoHash = infoHash
 
 	// If name is blank, create one
 	if ti.Name == "" {
 		ti.Name = hex.EncodeToString(ti.InfoHash[:])
 	}
+	if !validName(ti.Name) {
+		return nil, fmt.Errorf("invalid torrent name %q", ti.Name)
+	}
 
 	if isMultiFile {
 		ti.Files = make([]File, len(bci.Files))
@@ -251,8 +518,9 @@ func (bci BencodeInfo) toTorrent() (*TorrentInfo, error) {
 				parts = append(parts, clean(p))
 			}
 			ti.Files[i] = File{
-				Path:   filepath.Join(parts...),
-				Length: f.Length,
+				Path:    filepath.Join(parts...),
+				Length:  f.Length,
+				Padding: strings.Contains(f.Attr, "p"),
 			}
 		}
 	} else {
@@ -273,20 +541,29 @@ func private(b []byte) bool {
 	}
 
 	var i int64
-	if err := bencode.DecodeBytes(b, &i); err != nil {
+	if err := bencode.DecodeBytes(b, &i); err == nil {
 		return i != 0
 	}
 
+	// Some torrents have the flag as a string
 	var s string
-	if err := bencode.DecodeBytes(b, &s); err != nil {
-		return true
+	if err := bencode.DecodeBytes(b, &s); err == nil {
+		return !(s == "" || s == "0")
 	}
-	return !(s == "" || s == "0")
+	return true
 }
 
 func isTrackerSupported(s string) bool {
-	// TODO: add udp when udp is done
-	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") // || strings.HasPrefix(s, "udp://")
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "udp://")
+}
+
+// validName is false for names that can't be a single file or directory, like .. or ones with a separator
+func validName(s string) bool {
+	switch strings.TrimSpace(s) {
+	case "", ".", "..":
+		return false
+	}
+	return !strings.ContainsAny(s, `/\`)
 }
 
 func clean(s string, max ...int) string {
@@ -24,6 +24,38 @@ func TestTorrent(t *testing.T) {
 	}, tor.AnnounceList)
 }
 
+func TestPrivate(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output bool
+	}{
+		"missing":      {input: "", output: false},
+		"zero":         {input: "i0e", output: false},
+		"one":          {input: "i1e", output: true},
+		"string one":   {input: "1:1", output: true},
+		"string zero":  {input: "1:0", output: false},
+		"empty string": {input: "0:", output: false},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, private([]byte(test.input)), name)
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+	tor, err := Open("data_test/ubuntu-14.04.1-server-amd64.iso.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ti, err := ParseInfo(tor.Info.Metadata, tor.Info.InfoHash)
+	assert.Nil(t, err)
+	assert.Equal(t, tor.Info, *ti)
+
+	_, err = ParseInfo(tor.Info.Metadata, [20]byte{1})
+	assert.NotNil(t, err)
+}
+
 // func TestToTorrent(t *testing.T) {
 // 	tests := map[string]struct {
 // 		input  BencodeInfo
@@ -86,3 +118,38 @@ func TestTorrent(t *testing.T) {
 // 		assert.Equal(t, test.output, to)
 // 	}
 // }
+
+func TestToTorrentNames(t *testing.T) {
+	tests := map[string]struct {
+		name  string
+		path  []string // nil for a single file torrent
+		fails bool
+	}{
+		"Single file":          {name: "a.iso"},
+		"Multiple files":       {name: "a", path: []string{"dir", "b"}},
+		"Blank name":           {name: "", path: []string{"b"}},
+		"Name is ..":           {name: "..", fails: true},
+		"Name is . ":           {name: ". ", path: []string{"b"}, fails: true},
+		"Name has a separator": {name: "../../b", fails: true},
+		"Name has a backslash": {name: `..\b`, fails: true},
+		"Path has ..":          {name: "a", path: []string{"..", "b"}, fails: true},
+		"Path has .":           {name: "a", path: []string{".", "b"}, fails: true},
+		"Path is empty":        {name: "a", path: []string{"dir", ""}, fails: true},
+		"Path has a separator": {name: "a", path: []string{"dir/../../b"}, fails: true},
+	}
+
+	for name, test := range tests {
+		bci := BencodeInfo{PieceLength: 4, Pieces: make([]byte, 20), Name: test.name, Length: 4}
+		if test.path != nil {
+			bci.Length = 0
+			bci.Files = []file{{Length: 4, Path: test.path}}
+		}
+
+		_, err := bci.toTorrent([20]byte{1})
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
@@ -1,61 +1,368 @@
 package torrentfile
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Squwid/squidtorrent/peers"
 	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultNumWant is how many peers are asked for when an announce does not specify
+const DefaultNumWant = 50
+
+// defaultAnnounceInterval is how long to wait between announces when the tracker doesn't say
+var defaultAnnounceInterval = 30 * time.Minute
+
+// Event tells the tracker why an announce is being made, a blank event is a regular announce
+type Event string
+
+const (
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventCompleted Event = "completed"
+	EventStopped   Event = "stopped"
 )
 
 type bencodeTrackerResp struct {
-	Interval int `bencode:"interval"` // How often to reconnect to the tracker to refresh list of peers (in seconds)
+	FailureReason  string `bencode:"failure reason"`  // If present no other keys are, the announce failed
+	WarningMessage string `bencode:"warning message"` // Announce worked, but the tracker has something to say
+	Interval       int    `bencode:"interval"`        // How often to reconnect to the tracker to refresh list of peers (in seconds)
+	MinInterval    int    `bencode:"min interval"`    // Announces must not be made more often than this
+	TrackerID      string `bencode:"tracker id"`      // Has to be sent back on the next announces
+	Complete       int    `bencode:"complete"`        // Number of seeders
+	Incomplete     int    `bencode:"incomplete"`      // Number of leechers
+
+	// Peers is a blob that contains ip addresses of each peer, by groups of 6 bytes, (first 4 ip, last 2 port).
+	// Trackers that ignore compact send a list of dictionaries instead, which is left nil here
+	Peers interface{} `bencode:"peers"`
 
-	// Peers is a blob that contains ip addresses of each peer, by groups of 6 bytes, (first 4 ip, last 2 port)
-	Peers string `bencode:"peers"`
+	// Peers6 is the same for IPv6 peers, groups of 18 bytes (BEP 7)
+	Peers6 string `bencode:"peers6"`
 }
 
-// Build GET request url to hit tracker to announce presense as a peer and receeive list of other peers
-func (tf TorrentFile) buildTrackerURL(peerID [20]byte) (string, error) {
-	base, err := url.Parse(tf.Info.Files[0].Path)
+// bencodePeerList is the non compact form of the peers, decoded on its own since it can't share a field
+// with the compact one
+type bencodePeerList struct {
+	Peers []bencodePeer `bencode:"peers"`
+}
+
+type bencodePeer struct {
+	IP     string `bencode:"ip"` // IPv4, IPv6 or a hostname
+	Port   int    `bencode:"port"`
+	PeerID string `bencode:"peer id"`
+}
+
+// AnnounceRequest contains the stats that are reported to the tracker on every announce
+type AnnounceRequest struct {
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int // Defaults to DefaultNumWant when 0
+}
+
+// AnnounceResponse is the parsed result of a successful announce
+type AnnounceResponse struct {
+	Peers       []peers.Peer
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Warning     string
+}
+
+// ScrapeResult is the state of the swarm of a single torrent
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int // Number of times the torrent has been downloaded
+}
+
+// An Announcer announces a single torrent to its trackers. Trackers are tried tier by tier following
+// BEP 12, each tier is shuffled once and a tracker that responds gets moved to the front of its tier
+type Announcer struct {
+	infoHash [20]byte
+	key      uint32
+	client   *http.Client
+
+	// Only guards the state, announces run concurrently
+	mu          sync.Mutex
+	tiers       [][]string
+	trackerIDs  map[string]string
+	udpTrackers map[string]*udpTracker // Keyed by host, keeps connection ids around
+}
+
+// NewAnnouncer creates an announcer for the trackers of a torrent file
+func NewAnnouncer(tf *TorrentFile) *Announcer {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	tiers := make([][]string, len(tf.AnnounceList))
+	for i, tier := range tf.AnnounceList {
+		tiers[i] = append([]string(nil), tier...)
+		r.Shuffle(len(tiers[i]), func(a, b int) {
+			tiers[i][a], tiers[i][b] = tiers[i][b], tiers[i][a]
+		})
+	}
+
+	return &Announcer{
+		infoHash:    tf.Info.InfoHash,
+		key:         r.Uint32(),
+		client:      &http.Client{Timeout: 15 * time.Second},
+		tiers:       tiers,
+		trackerIDs:  map[string]string{},
+		udpTrackers: map[string]*udpTracker{},
+	}
+}
+
+// Close closes the sockets of any UDP trackers
+func (a *Announcer) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for host, ut := range a.udpTrackers {
+		ut.Close()
+		delete(a.udpTrackers, host)
+	}
+	return nil
+}
+
+// Announce sends the request to the first tracker that responds, tier by tier
+func (a *Announcer) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	// Trackers are tried in the order they were in when we started, another announce might be reordering them
+	a.mu.Lock()
+	tiers := make([][]string, len(a.tiers))
+	for i, tier := range a.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	a.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no supported trackers")
+	}
+
+	var lastErr error
+	for i, tier := range tiers {
+		for _, tracker := range tier {
+			resp, err := a.announce(tracker, req)
+			if err != nil {
+				lastErr = fmt.Errorf("announce to %v: %w", tracker, err)
+				continue
+			}
+			a.promote(i, tracker)
+			return resp, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// promote moves a working tracker to the front of its tier
+func (a *Announcer) promote(tier int, tracker string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	trackers := a.tiers[tier]
+	for i, t := range trackers {
+		if t == tracker {
+			copy(trackers[1:i+1], trackers[0:i])
+			trackers[0] = tracker
+			return
+		}
+	}
+}
+
+func (a *Announcer) announce(tracker string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(tracker)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// https://www.bittorrent.org/beps/bep_0003.html
-	params := url.Values{
-		"info_hash":  []string{string(tf.Info.InfoHash[:])}, // Identifies the file that is gonna get downloaded
-		"peer_id":    []string{string(peerID[:])},           // Real BitTorrent clients have pre-generated ids, come up with our own
-		"port":       []string{fmt.Sprintf("%v", Port)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{fmt.Sprintf("%v", tf.Info.Length)},
+	if u.Scheme == "udp" {
+		ut, err := a.udpTracker(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return ut.announce(a.infoHash, a.key, req)
 	}
+	return a.announceHTTP(tracker, req)
+}
 
-	// Craft up the url with the values
-	base.RawQuery = params.Encode()
-	return base.String(), nil
+// udpTracker returns the connection to a UDP tracker, dialing it the first time
+func (a *Announcer) udpTracker(host string) (*udpTracker, error) {
+	a.mu.Lock()
+	ut, ok := a.udpTrackers[host]
+	a.mu.Unlock()
+	if ok {
+		return ut, nil
+	}
+
+	// Dialing resolves the host, which is not done while holding the lock
+	ut, err := dialUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if other, ok := a.udpTrackers[host]; ok {
+		ut.Close()
+		return other, nil
+	}
+	a.udpTrackers[host] = ut
+	return ut, nil
 }
 
-func (tf TorrentFile) Announce(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := tf.buildTrackerURL(peerID, port)
+func (a *Announcer) announceHTTP(tracker string, req AnnounceRequest) (*AnnounceResponse, error) {
+	url, err := a.buildTrackerURL(tracker, req)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
+	resp, err := a.client.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
 	var trackerResp bencodeTrackerResp
-	if err := bencode.Unmarshal(resp.Body, &trackerResp); err != nil {
+	if err := bencode.Unmarshal(bytes.NewReader(body), &trackerResp); err != nil {
+		return nil, err
+	}
+	if trackerResp.FailureReason != "" {
+		return nil, errors.New(trackerResp.FailureReason)
+	}
+	if trackerResp.TrackerID != "" {
+		a.mu.Lock()
+		a.trackerIDs[tracker] = trackerResp.TrackerID
+		a.mu.Unlock()
+	}
+
+	var ps []peers.Peer
+	if compact, ok := trackerResp.Peers.(string); ok {
+		ps, err = peers.Unmarshal([]byte(compact))
+	} else {
+		ps, err = unmarshalPeerList(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps6, err := peers.Unmarshal6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	ps = append(ps, ps6...)
+
+	return &AnnounceResponse{
+		Peers:       ps,
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		Seeders:     trackerResp.Complete,
+		Leechers:    trackerResp.Incomplete,
+		Warning:     trackerResp.WarningMessage,
+	}, nil
+}
+
+// unmarshalPeerList decodes the dictionary form of the peers, resolving hostnames. Peers that can't be
+// resolved are skipped
+func unmarshalPeerList(body []byte) ([]peers.Peer, error) {
+	var list bencodePeerList
+	if err := bencode.Unmarshal(bytes.NewReader(body), &list); err != nil {
+		return nil, err
+	}
+
+	ps := make([]peers.Peer, 0, len(list.Peers))
+	for _, bp := range list.Peers {
+		if bp.Port <= 0 || bp.Port > math.MaxUint16 {
+			continue
+		}
+		ip := net.ParseIP(bp.IP)
+		if ip == nil {
+			addr, err := net.ResolveIPAddr("ip", bp.IP)
+			if err != nil {
+				logrus.WithError(err).WithField("Host", bp.IP).Debugf("Skipping tracker peer")
+				continue
+			}
+			ip = addr.IP
+		}
+
+		p := peers.Peer{IP: ip, Port: uint16(bp.Port)}
+		if len(bp.PeerID) == len(p.ID) {
+			copy(p.ID[:], bp.PeerID)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// Build GET request url to hit tracker to announce presense as a peer and receeive list of other peers
+func (a *Announcer) buildTrackerURL(tracker string, req AnnounceRequest) (string, error) {
+	base, err := url.Parse(tracker)
+	if err != nil {
+		return "", err
+	}
+
+	numWant := req.NumWant
+	if numWant == 0 {
+		numWant = DefaultNumWant
+	}
+
+	// https://www.bittorrent.org/beps/bep_0003.html
+	// Some trackers already have a query in the announce url (private passkeys), keep it
+	params := base.Query()
+	params.Set("info_hash", string(a.infoHash[:])) // Identifies the file that is gonna get downloaded
+	params.Set("peer_id", string(req.PeerID[:]))   // Real BitTorrent clients have pre-generated ids, come up with our own
+	params.Set("port", strconv.Itoa(int(req.Port)))
+	params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(req.Left, 10))
+	params.Set("compact", "1")
+	params.Set("numwant", strconv.Itoa(numWant))
+	params.Set("key", strconv.FormatUint(uint64(a.key), 16))
+	if req.Event != EventNone {
+		params.Set("event", string(req.Event))
+	}
+	a.mu.Lock()
+	id, ok := a.trackerIDs[tracker]
+	a.mu.Unlock()
+	if ok {
+		params.Set("trackerid", id)
+	}
+
+	// Craft up the url with the values
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+// Announce asks the trackers in the announce list for peers as a fresh download
+func (tf TorrentFile) Announce(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	a := NewAnnouncer(&tf)
+	defer a.Close()
+
+	resp, err := a.Announce(AnnounceRequest{
+		PeerID: peerID,
+		Port:   port,
+		Left:   tf.Info.Length,
+		Event:  EventStarted,
+	})
+	if err != nil {
 		return nil, err
 	}
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	return resp.Peers, nil
 }
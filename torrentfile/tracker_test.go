@@ -1,56 +1,222 @@
 package torrentfile
 
-// func TestBuildTrackerURL(t *testing.T) {
-// 	to := TorrentFile{
-// 		Announce: "http://bttracker.debian.org:6969/announce",
-// 		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
-// 		PieceHashes: [][20]byte{
-// 			{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
-// 			{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
-// 		},
-// 		PieceLength: 262144,
-// 		Length:      351272960,
-// 		Name:        "debian-10.2.0-amd64-netinst.iso",
-// 	}
-// 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
-// 	const port uint16 = 6882
-// 	url, err := to.buildTrackerURL(peerID, port)
-// 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=0"
-// 	assert.Nil(t, err)
-// 	assert.Equal(t, url, expected)
-// }
-
-// func TestRequestPeers(t *testing.T) {
-// 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		response := []byte(
-// 			"d" +
-// 				"8:interval" + "i900e" +
-// 				"5:peers" + "12:" +
-// 				string([]byte{
-// 					192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
-// 					127, 0, 0, 1, 0x1A, 0xE9, // 0x1AE9 = 6889
-// 				}) + "e")
-// 		w.Write(response)
-// 	}))
-// 	defer ts.Close()
-// 	tf := TorrentFile{
-// 		Announce: ts.URL,
-// 		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
-// 		PieceHashes: [][20]byte{
-// 			{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
-// 			{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
-// 		},
-// 		PieceLength: 262144,
-// 		Length:      351272960,
-// 		Name:        "debian-10.2.0-amd64-netinst.iso",
-// 	}
-// 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
-// 	const port uint16 = 6882
-// 	expected := []peers.Peer{
-// 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
-// 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
-// 	}
-// 	p, err := tf.requestPeers(peerID, port)
-// 	assert.Nil(t, err)
-// 	assert.Equal(t, expected, p)
-// }
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testInfoHash = [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+	testPeerID   = [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+)
+
+func testAnnouncer(announceList ...[]string) *Announcer {
+	return NewAnnouncer(&TorrentFile{
+		Info:         TorrentInfo{InfoHash: testInfoHash, Length: 351272960},
+		AnnounceList: announceList,
+	})
+}
+
+func TestBuildTrackerURL(t *testing.T) {
+	a := testAnnouncer([]string{"http://bttracker.debian.org:6969/announce?passkey=abc"})
+	a.key = 0xbeef
+	a.trackerIDs["http://bttracker.debian.org:6969/announce?passkey=abc"] = "tid"
+
+	u, err := a.buildTrackerURL("http://bttracker.debian.org:6969/announce?passkey=abc", AnnounceRequest{
+		PeerID:     testPeerID,
+		Port:       6882,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+		Event:      EventStarted,
+	})
+	assert.Nil(t, err)
+	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=20&event=started&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&key=beef&left=30&numwant=50&passkey=abc&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&trackerid=tid&uploaded=10"
+	assert.Equal(t, expected, u)
+}
+
+func TestAnnounce(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		response := []byte(
+			"d" +
+				"8:completei5e" +
+				"10:incompletei7e" +
+				"8:interval" + "i900e" +
+				"12:min interval" + "i60e" +
+				"5:peers" + "12:" +
+				string([]byte{
+					192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
+					127, 0, 0, 1, 0x1A, 0xE9, // 0x1AE9 = 6889
+				}) +
+				"6:peers6" + "18:" +
+				string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1}) +
+				"10:tracker id" + "3:xyz" +
+				"15:warning message" + "4:slow" +
+				"e")
+		w.Write(response)
+	}))
+	defer ts.Close()
+
+	a := testAnnouncer([]string{ts.URL})
+	resp, err := a.Announce(AnnounceRequest{PeerID: testPeerID, Port: 6881, Left: 100, Event: EventStarted})
+	require.Nil(t, err)
+	assert.Equal(t, &AnnounceResponse{
+		Peers: []peers.Peer{
+			{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+			{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		},
+		Interval:    900 * time.Second,
+		MinInterval: 60 * time.Second,
+		Seeders:     5,
+		Leechers:    7,
+		Warning:     "slow",
+	}, resp)
+	assert.Equal(t, "started", query.Get("event"))
+	assert.Equal(t, "", query.Get("trackerid"))
+
+	// Tracker id has to be sent back on the next announce
+	_, err = a.Announce(AnnounceRequest{PeerID: testPeerID, Port: 6881})
+	require.Nil(t, err)
+	assert.Equal(t, "xyz", query.Get("trackerid"))
+	assert.Equal(t, "", query.Get("event"))
+}
+
+func TestAnnouncePeerList(t *testing.T) {
+	// Trackers that ignore compact send dictionaries, ip can be a hostname
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peersl" +
+			"d2:ip11:192.0.2.1237:peer id20:-TR2940-abcdefghijkl4:porti6881ee" +
+			"d2:ip11:2001:db8::14:porti6882ee" +
+			"d2:ip9:localhost4:porti6883ee" +
+			"d2:ip8:10.0.0.14:porti70000ee" + // Skipped
+			"ee"))
+	}))
+	defer ts.Close()
+
+	resp, err := testAnnouncer([]string{ts.URL}).Announce(AnnounceRequest{PeerID: testPeerID, Port: 6881})
+	require.Nil(t, err)
+	require.Len(t, resp.Peers, 3)
+
+	var id [20]byte
+	copy(id[:], "-TR2940-abcdefghijkl")
+	assert.Equal(t, peers.Peer{IP: net.ParseIP("192.0.2.123"), Port: 6881, ID: id}, resp.Peers[0])
+	assert.Equal(t, peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6882}, resp.Peers[1])
+	assert.True(t, resp.Peers[2].IP.IsLoopback())
+	assert.Equal(t, uint16(6883), resp.Peers[2].Port)
+	assert.Equal(t, 900*time.Second, resp.Interval)
+}
+
+func TestAnnounceFailureReason(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason12:unregisterede"))
+	}))
+	defer ts.Close()
+
+	_, err := testAnnouncer([]string{ts.URL}).Announce(AnnounceRequest{PeerID: testPeerID})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unregistered")
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer working.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:nopee"))
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	a := testAnnouncer(
+		[]string{down.URL},
+		[]string{failing.URL, working.URL, down.URL + "/other"},
+	)
+	// Undo the shuffle to get a known order
+	a.tiers[1] = []string{failing.URL, down.URL + "/other", working.URL}
+
+	_, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+	require.Nil(t, err)
+
+	// Working tracker moves to the front of its tier, the rest keep their order
+	assert.Equal(t, [][]string{
+		{down.URL},
+		{working.URL, failing.URL, down.URL + "/other"},
+	}, a.tiers)
+}
+
+func TestAnnounceConcurrent(t *testing.T) {
+	// The first announce hangs until it is let go, the second one gets answered right away
+	release := make(chan struct{})
+	var first int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&first, 1) == 1 {
+			<-release
+		}
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	a := testAnnouncer([]string{ts.URL})
+	go a.Announce(AnnounceRequest{PeerID: testPeerID})
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&first) == 1 }, time.Second, 10*time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		_, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("announce waited on the other one")
+	}
+}
+
+func TestNextAnnounce(t *testing.T) {
+	type testCase struct {
+		resp     AnnounceResponse
+		expected time.Duration
+	}
+
+	tcs := map[string]testCase{
+		"Interval of the tracker": {
+			resp:     AnnounceResponse{Interval: 900 * time.Second, MinInterval: 60 * time.Second},
+			expected: 900 * time.Second,
+		},
+		"Never under the min interval": {
+			resp:     AnnounceResponse{Interval: 30 * time.Second, MinInterval: 60 * time.Second},
+			expected: 60 * time.Second,
+		},
+		"No interval": {
+			resp:     AnnounceResponse{},
+			expected: defaultAnnounceInterval,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, nextAnnounce(&tc.resp))
+		})
+	}
+}
+
+func TestAnnounceNoTrackers(t *testing.T) {
+	_, err := testAnnouncer().Announce(AnnounceRequest{PeerID: testPeerID})
+	assert.NotNil(t, err)
+}
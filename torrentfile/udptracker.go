@@ -0,0 +1,234 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+)
+
+// https://www.bittorrent.org/beps/bep_0015.html
+
+const udpProtocolID uint64 = 0x41727101980 // Magic constant sent in connect requests
+
+const (
+	udpActionConnect uint32 = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+// udpConnIDLifetime is how long a client may keep using a connection id
+const udpConnIDLifetime = time.Minute
+
+var (
+	// udpTimeout is the first retransmit timeout, it doubles after every retransmission. BEP 15 starts at
+	// 15 seconds, trackers that are up answer well within this
+	udpTimeout = 5 * time.Second
+
+	// udpMaxRetransmits caps the backoff. BEP 15 lets n go up to 8 (over an hour), give up a lot sooner
+	// so that one dead tracker does not hold up the rest of the tier
+	udpMaxRetransmits = 3
+
+	// udpMaxWait is the most a single request waits for its response over all of its retransmissions
+	udpMaxWait = 20 * time.Second
+)
+
+var errUDPTimeout = errors.New("udp tracker timed out")
+
+// udpEvents maps announce events to their ids on the wire
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// udpTracker is a connection with a single UDP tracker, caching the connection id between requests.
+// Requests take turns, one at a time
+type udpTracker struct {
+	conn       net.Conn
+	mu         sync.Mutex // Held for a whole request
+	connID     uint64
+	connIDTime time.Time
+}
+
+func dialUDPTracker(host string) (*udpTracker, error) {
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{conn: conn}, nil
+}
+
+func (ut *udpTracker) Close() error {
+	return ut.conn.Close()
+}
+
+// announce asks the tracker for peers for the infohash
+func (ut *udpTracker) announce(infoHash [20]byte, key uint32, req AnnounceRequest) (*AnnounceResponse, error) {
+	numWant := req.NumWant
+	if numWant == 0 {
+		numWant = DefaultNumWant
+	}
+
+	// Announce body after the connection id, action and transaction id
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash[:])
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], udpEvents[req.Event])
+	binary.BigEndian.PutUint32(body[68:72], 0) // Let the tracker use the source address
+	binary.BigEndian.PutUint32(body[72:76], key)
+	binary.BigEndian.PutUint32(body[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+
+	ut.mu.Lock()
+	resp, err := ut.do(udpActionAnnounce, body)
+	ut.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("announce response too short: %v bytes", len(resp))
+	}
+
+	// Trackers we talk to over IPv6 send IPv6 peers
+	unmarshal := peers.Unmarshal
+	if addr, ok := ut.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = peers.Unmarshal6
+	}
+	ps, err := unmarshal(resp[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &AnnounceResponse{
+		Peers:    ps,
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+	}, nil
+}
+
+// scrape gets the swarm stats of every infohash, in the same order
+func (ut *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, h := range infoHashes {
+		body = append(body, h[:]...)
+	}
+
+	ut.mu.Lock()
+	resp, err := ut.do(udpActionScrape, body)
+	ut.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("expected %v bytes of scrape results but got %v", 12*len(infoHashes), len(resp))
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		offset := i * 12
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(resp[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
+
+// connectionID returns the cached connection id, connecting again once it expired
+func (ut *udpTracker) connectionID() (uint64, error) {
+	if ut.connIDTime.IsZero() || time.Since(ut.connIDTime) >= udpConnIDLifetime {
+		resp, err := ut.do(udpActionConnect, nil)
+		if err != nil {
+			return 0, err
+		}
+		if len(resp) < 8 {
+			return 0, fmt.Errorf("connect response too short: %v bytes", len(resp))
+		}
+		ut.connID = binary.BigEndian.Uint64(resp[0:8])
+		ut.connIDTime = time.Now()
+	}
+	return ut.connID, nil
+}
+
+// do sends a request and returns the body of the response after the action and transaction id.
+// Requests are retransmitted with exponential backoff, a new connection id is grabbed for a
+// retransmission if the old one expired in the meantime
+func (ut *udpTracker) do(action uint32, body []byte) ([]byte, error) {
+	deadline := time.Now().Add(udpMaxWait)
+	for n := 0; n <= udpMaxRetransmits; n++ {
+		connID := udpProtocolID
+		if action != udpActionConnect {
+			var err error
+			if connID, err = ut.connectionID(); err != nil {
+				return nil, err
+			}
+		}
+
+		txID := rand.Uint32()
+		req := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(req[0:8], connID)
+		binary.BigEndian.PutUint32(req[8:12], action)
+		binary.BigEndian.PutUint32(req[12:16], txID)
+		copy(req[16:], body)
+		if _, err := ut.conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		timeout := udpTimeout << uint(n)
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+		if timeout <= 0 {
+			break
+		}
+
+		resp, err := ut.read(action, txID, timeout)
+		if err == errUDPTimeout {
+			continue
+		}
+		return resp, err
+	}
+	return nil, errUDPTimeout
+}
+
+// read waits for the response to a transaction, ignoring anything else the tracker sends
+func (ut *udpTracker) read(action, txID uint32, timeout time.Duration) ([]byte, error) {
+	ut.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer ut.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := ut.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errUDPTimeout
+			}
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		switch respAction := binary.BigEndian.Uint32(buf[0:4]); respAction {
+		case action:
+			return append([]byte(nil), buf[8:n]...), nil
+		case udpActionError:
+			return nil, errors.New(string(buf[8:n]))
+		default:
+			return nil, fmt.Errorf("expected action %v but got %v", action, respAction)
+		}
+	}
+}
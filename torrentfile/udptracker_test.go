@@ -0,0 +1,255 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Squwid/squidtorrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// udpTrackerStub is an in-process BEP 15 tracker
+type udpTrackerStub struct {
+	conn   net.PacketConn
+	connID uint64
+
+	mu       sync.Mutex
+	drop     int    // Number of packets to ignore before answering
+	fail     string // Answer every announce with this error
+	connects int
+	announce []byte // Last announce request
+}
+
+func newUDPTrackerStub(t *testing.T, drop int, fail string) *udpTrackerStub {
+	return listenUDPTrackerStub(t, "127.0.0.1:0", drop, fail)
+}
+
+// listenUDPTrackerStub starts a stub on the address, over IPv6 it hands out IPv6 peers
+func listenUDPTrackerStub(t *testing.T, addr string, drop int, fail string) *udpTrackerStub {
+	conn, err := net.ListenPacket("udp", addr)
+	require.Nil(t, err)
+
+	s := &udpTrackerStub{conn: conn, connID: 0xdeadbeef, drop: drop, fail: fail}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+// state returns a snapshot of the counters that are updated by the serving goroutine
+func (s *udpTrackerStub) state() (drop, connects int, announce []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drop, s.connects, s.announce
+}
+
+func (s *udpTrackerStub) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpTrackerStub) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *udpTrackerStub) handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[4:8], binary.BigEndian.Uint32(req[12:16]))
+
+	if action == udpActionConnect {
+		s.connects++
+		binary.BigEndian.PutUint32(resp[0:4], udpActionConnect)
+		return append(resp, 0, 0, 0, 0, 0xde, 0xad, 0xbe, 0xef)
+	}
+
+	if connID != s.connID {
+		binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+		return append(resp, "bad connection id"...)
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		if s.fail != "" {
+			binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+			return append(resp, s.fail...)
+		}
+		s.announce = append([]byte(nil), req...)
+		binary.BigEndian.PutUint32(resp[0:4], udpActionAnnounce)
+		resp = append(resp,
+			0, 0, 0x07, 0x08, // Interval 1800
+			0, 0, 0, 3, // Leechers
+			0, 0, 0, 9, // Seeders
+		)
+		if s.conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+			return append(resp, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1)
+		}
+		return append(resp,
+			127, 0, 0, 1, 0x1A, 0xE1,
+			10, 0, 0, 2, 0x1A, 0xE9,
+		)
+	case udpActionScrape:
+		binary.BigEndian.PutUint32(resp[0:4], udpActionScrape)
+		for i := 16; i < len(req); i += 20 {
+			// Stats are made up from the first byte of the hash
+			b := req[i]
+			resp = append(resp, 0, 0, 0, b, 0, 0, 0, b+1, 0, 0, 0, b+2)
+		}
+		return resp
+	}
+	return nil
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	stub := newUDPTrackerStub(t, 0, "")
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+	a.key = 0x01020304
+
+	resp, err := a.Announce(AnnounceRequest{
+		PeerID:     testPeerID,
+		Port:       6882,
+		Uploaded:   1,
+		Downloaded: 2,
+		Left:       3,
+		Event:      EventStarted,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, &AnnounceResponse{
+		Peers: []peers.Peer{
+			{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+			{IP: net.IP{10, 0, 0, 2}, Port: 6889},
+		},
+		Interval: 1800 * time.Second,
+		Leechers: 3,
+		Seeders:  9,
+	}, resp)
+
+	_, _, req := stub.state()
+	assert.Equal(t, testInfoHash[:], req[16:36])
+	assert.Equal(t, testPeerID[:], req[36:56])
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(req[56:64]))
+	assert.Equal(t, uint64(3), binary.BigEndian.Uint64(req[64:72]))
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(req[72:80]))
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(req[80:84]))
+	assert.Equal(t, uint32(0x01020304), binary.BigEndian.Uint32(req[88:92]))
+	assert.Equal(t, uint32(DefaultNumWant), binary.BigEndian.Uint32(req[92:96]))
+	assert.Equal(t, uint16(6882), binary.BigEndian.Uint16(req[96:98]))
+
+	// Connection id is cached for the second announce
+	_, err = a.Announce(AnnounceRequest{PeerID: testPeerID})
+	require.Nil(t, err)
+	_, connects, _ := stub.state()
+	assert.Equal(t, 1, connects)
+}
+
+func TestUDPAnnounce6(t *testing.T) {
+	stub := listenUDPTrackerStub(t, "[::1]:0", 0, "")
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+	resp, err := a.Announce(AnnounceRequest{PeerID: testPeerID, Port: 6882})
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6881}}, resp.Peers)
+}
+
+func TestUDPAnnounceRetransmit(t *testing.T) {
+	defer func(timeout time.Duration) { udpTimeout = timeout }(udpTimeout)
+	udpTimeout = 20 * time.Millisecond
+
+	stub := newUDPTrackerStub(t, 2, "") // Lose the first connect and its retransmission
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+
+	resp, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+	require.Nil(t, err)
+	assert.Len(t, resp.Peers, 2)
+}
+
+func TestUDPAnnounceTimeout(t *testing.T) {
+	defer func(timeout time.Duration, retransmits int) {
+		udpTimeout, udpMaxRetransmits = timeout, retransmits
+	}(udpTimeout, udpMaxRetransmits)
+	udpTimeout = 10 * time.Millisecond
+	udpMaxRetransmits = 2
+
+	stub := newUDPTrackerStub(t, 100, "")
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+
+	_, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+	assert.NotNil(t, err)
+	drop, _, _ := stub.state()
+	assert.Equal(t, 97, drop) // Initial attempt and two retransmissions
+}
+
+func TestUDPAnnounceMaxWait(t *testing.T) {
+	defer func(timeout, wait time.Duration, retransmits int) {
+		udpTimeout, udpMaxWait, udpMaxRetransmits = timeout, wait, retransmits
+	}(udpTimeout, udpMaxWait, udpMaxRetransmits)
+	udpTimeout = 50 * time.Millisecond
+	udpMaxWait = 120 * time.Millisecond
+	udpMaxRetransmits = 8
+
+	stub := newUDPTrackerStub(t, 100, "")
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+
+	// The backoff would go on for over 25 seconds, the cap stops it after the second try
+	start := time.Now()
+	_, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	drop, _, _ := stub.state()
+	assert.Equal(t, 98, drop)
+}
+
+func TestUDPAnnounceError(t *testing.T) {
+	stub := newUDPTrackerStub(t, 0, "torrent not registered")
+
+	a := testAnnouncer([]string{stub.url()})
+	defer a.Close()
+
+	_, err := a.Announce(AnnounceRequest{PeerID: testPeerID})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "torrent not registered")
+}
+
+func TestUDPScrape(t *testing.T) {
+	stub := newUDPTrackerStub(t, 0, "")
+
+	ut, err := dialUDPTracker(stub.conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer ut.Close()
+
+	results, err := ut.scrape([][20]byte{{1}, {5}})
+	require.Nil(t, err)
+	assert.Equal(t, []ScrapeResult{
+		{Seeders: 1, Completed: 2, Leechers: 3},
+		{Seeders: 5, Completed: 6, Leechers: 7},
+	}, results)
+}
@@ -0,0 +1,301 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/Squwid/squidtorrent/merkle"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/zeebo/bencode"
+)
+
+var (
+	errV2Only         = errors.New("downloading v2 only torrents is not supported, only v1 and hybrid torrents")
+	errV2PieceLength  = errors.New("v2 piece length must be a power of two of at least 16K")
+	errHybridMismatch = errors.New("v1 and v2 files of hybrid torrent do not match")
+	errNoPieceLayer   = errors.New("piece layer of file is not known")
+	errHashRequest    = errors.New("invalid hash request")
+)
+
+// v2File is a file out of a file tree
+type v2File struct {
+	Path       []string
+	Length     int64
+	PiecesRoot [32]byte
+}
+
+// IsV2 tells if the torrent has v2 metadata (BEP 52), it can be a hybrid torrent that also has v1 metadata
+func (ti TorrentInfo) IsV2() bool {
+	return ti.MetaVersion == 2
+}
+
+// IsHybrid tells if the torrent has both v1 and v2 metadata. Hybrid torrents have both info hashes and
+// use the v1 one in handshakes
+func (ti TorrentInfo) IsHybrid() bool {
+	return ti.IsV2() && len(ti.BencodeInfo.Pieces) > 0
+}
+
+// parseFileTree flattens a file tree into its files, ordered by path like the dictionaries they are in
+func parseFileTree(raw bencode.RawMessage, path []string) ([]v2File, error) {
+	var tree map[string]bencode.RawMessage
+	if err := bencode.DecodeBytes(raw, &tree); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []v2File
+	for _, name := range names {
+		// A file is a dictionary with an empty key, everything else is a directory
+		if name == "" {
+			if len(path) == 0 {
+				return nil, errors.New("file tree has a file without a name")
+			}
+			var f struct {
+				Length     int64  `bencode:"length"`
+				PiecesRoot []byte `bencode:"pieces root"`
+			}
+			if err := bencode.DecodeBytes(tree[name], &f); err != nil {
+				return nil, err
+			}
+			file := v2File{Path: path, Length: f.Length}
+			if f.Length > 0 {
+				if len(f.PiecesRoot) != len(file.PiecesRoot) {
+					return nil, fmt.Errorf("invalid pieces root of %v", filepath.Join(path...))
+				}
+				copy(file.PiecesRoot[:], f.PiecesRoot)
+			}
+			files = append(files, file)
+			continue
+		}
+
+		if !validName(name) {
+			return nil, fmt.Errorf("invalid file name %v", filepath.Join(append(path, name)...))
+		}
+		sub, err := parseFileTree(tree[name], append(append([]string(nil), path...), name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// addV2 fills in the v2 metadata of a parsed info dictionary. For v2 only torrents this is all there is, so
+// the files are laid out like the v1 part of a hybrid torrent would be, with padding up to every piece
+func (bci BencodeInfo) addV2(ti *TorrentInfo, raw []byte) error {
+	if bci.PieceLength < merkle.BlockSize || merkle.Width(int(bci.PieceLength)) != int(bci.PieceLength) {
+		return errV2PieceLength
+	}
+	files, err := parseFileTree(bci.FileTree, nil)
+	if err != nil {
+		return err
+	}
+
+	ti.MetaVersion = 2
+	ti.InfoHashV2 = sha256.Sum256(raw)
+
+	if len(bci.Pieces) > 0 {
+		// Hybrid torrent, the v1 files are the same ones with padding in between
+		i := 0
+		for j := range ti.Files {
+			if ti.Files[j].Padding {
+				continue
+			}
+			if i >= len(files) || files[i].Length != ti.Files[j].Length {
+				return errHybridMismatch
+			}
+			ti.Files[j].PiecesRoot = files[i].PiecesRoot
+			i++
+		}
+		if i != len(files) {
+			return errHybridMismatch
+		}
+		return nil
+	}
+
+	ti.Name = bci.Name
+	copy(ti.InfoHash[:], ti.InfoHashV2[:])
+	if ti.Name == "" {
+		ti.Name = fmt.Sprintf("%x", ti.InfoHashV2)
+	}
+	if !validName(ti.Name) {
+		return fmt.Errorf("invalid torrent name %q", ti.Name)
+	}
+
+	pieceLength := int64(bci.PieceLength)
+	ti.Length, ti.NumPieces, ti.Files = 0, 0, nil
+	for i, f := range files {
+		// A torrent of a single file has just the one named after the torrent
+		path := clean(ti.Name)
+		if len(files) > 1 || len(f.Path) > 1 || f.Path[0] != bci.Name {
+			parts := []string{clean(ti.Name)}
+			for _, p := range f.Path {
+				parts = append(parts, clean(p))
+			}
+			path = filepath.Join(parts...)
+		}
+		ti.Files = append(ti.Files, File{Path: path, Length: f.Length, PiecesRoot: f.PiecesRoot})
+		ti.Length += f.Length
+
+		if pad := (pieceLength - f.Length%pieceLength) % pieceLength; pad > 0 && i < len(files)-1 {
+			ti.Files = append(ti.Files, File{Path: filepath.Join(".pad", strconv.FormatInt(pad, 10)), Length: pad, Padding: true})
+			ti.Length += pad
+		}
+	}
+	ti.NumPieces = uint32((ti.Length + pieceLength - 1) / pieceLength)
+	if ti.NumPieces == 0 {
+		return errZeroPieces
+	}
+	return nil
+}
+
+// addPieceLayers checks the piece layers of a torrent file against the pieces roots of its files and keeps them
+func (ti *TorrentInfo) addPieceLayers(layers map[string][]byte) error {
+	ti.PieceLayers = map[[32]byte][]merkle.Hash{}
+	for _, f := range ti.Files {
+		raw, ok := layers[string(f.PiecesRoot[:])]
+		if !ok || f.Length <= int64(ti.BencodeInfo.PieceLength) {
+			continue
+		}
+
+		if len(raw) != ti.filePieces(f)*32 {
+			return fmt.Errorf("piece layer of %v has the wrong length", f.Path)
+		}
+		layer := make([]merkle.Hash, ti.filePieces(f))
+		for i := range layer {
+			copy(layer[i][:], raw[32*i:])
+		}
+		if merkle.Root(layer, merkle.Width(len(layer)), ti.padHash()) != f.PiecesRoot {
+			return fmt.Errorf("piece layer of %v does not match its pieces root", f.Path)
+		}
+		ti.PieceLayers[f.PiecesRoot] = layer
+	}
+	return nil
+}
+
+// pieceLayer is the layer of the file trees that has a hash for each piece, counted up from the blocks
+func (ti TorrentInfo) pieceLayer() int {
+	layer := 0
+	for n := ti.BencodeInfo.PieceLength / merkle.BlockSize; n > 1; n /= 2 {
+		layer++
+	}
+	return layer
+}
+
+// padHash is the hash of a piece made of nothing but padding
+func (ti TorrentInfo) padHash() merkle.Hash {
+	return merkle.PadHash(ti.pieceLayer())
+}
+
+// filePieces is the number of pieces of a file, every file starts at a new piece in v2
+func (ti TorrentInfo) filePieces(f File) int {
+	pieceLength := int64(ti.BencodeInfo.PieceLength)
+	return int((f.Length + pieceLength - 1) / pieceLength)
+}
+
+// CheckPieceV2 checks a piece of a file against the merkle tree of the file, piece is counted from the
+// start of the file and data has no padding
+func (ti TorrentInfo) CheckPieceV2(file, piece int, data []byte) error {
+	if file < 0 || file >= len(ti.Files) || ti.Files[file].Padding {
+		return fmt.Errorf("invalid file %v", file)
+	}
+	f := ti.Files[file]
+	blocks := merkle.BlockHashes(data)
+
+	// Files that fit in a piece have no piece layer, the piece is the whole tree
+	if f.Length <= int64(ti.BencodeInfo.PieceLength) {
+		if merkle.Root(blocks, merkle.Width(len(blocks)), merkle.Hash{}) != f.PiecesRoot {
+			return fmt.Errorf("piece %v of %v failed integrity check", piece, f.Path)
+		}
+		return nil
+	}
+
+	layer, ok := ti.PieceLayers[f.PiecesRoot]
+	if !ok || piece < 0 || piece >= len(layer) {
+		return errNoPieceLayer
+	}
+	if merkle.Root(blocks, int(ti.BencodeInfo.PieceLength/merkle.BlockSize), merkle.Hash{}) != layer[piece] {
+		return fmt.Errorf("piece %v of %v failed integrity check", piece, f.Path)
+	}
+	return nil
+}
+
+// checkPiece checks a piece of the whole torrent. v1 pieces are checked against their SHA-1 hash, v2 pieces
+// against the merkle tree of their file and hybrid pieces against both
+func (ti TorrentInfo) checkPiece(index int, data []byte) error {
+	if len(ti.BencodeInfo.Pieces) > 0 {
+		if hash := sha1.Sum(data); !bytes.Equal(hash[:], ti.PieceHash(uint32(index))) {
+			return fmt.Errorf("index %v failed integrity check", index)
+		}
+	}
+	return ti.checkMerkle(index, data)
+}
+
+// checkMerkle checks a piece of the whole torrent against the merkle tree of its file, v1 torrents have
+// nothing to check. Pieces of a hybrid torrent whose piece layer is not known are let through, the SHA-1
+// hash is still there for those
+func (ti TorrentInfo) checkMerkle(index int, data []byte) error {
+	if !ti.IsV2() {
+		return nil
+	}
+
+	// Files start at a piece so there is just one file in the piece, anything after it is padding
+	begin := int64(index) * int64(ti.BencodeInfo.PieceLength)
+	var offset int64
+	for i, f := range ti.Files {
+		if f.Padding || f.Length == 0 || begin < offset || begin >= offset+f.Length {
+			offset += f.Length
+			continue
+		}
+		if end := offset + f.Length - begin; end < int64(len(data)) {
+			data = data[:end]
+		}
+
+		err := ti.CheckPieceV2(i, int((begin-offset)/int64(ti.BencodeInfo.PieceLength)), data)
+		if err == errNoPieceLayer && ti.IsHybrid() {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("piece %v is not in any file", index)
+}
+
+// Hashes answers a hash request for hashes of the piece layer of a file, followed by the uncle hashes
+// of their proof. Hash exchange only goes this way, the piece layers we check with come from the torrent
+// file and are never asked from peers. So v2 only torrents can't be downloaded, and hybrids from magnet
+// links only have their SHA-1 hashes to check
+func (ti TorrentInfo) Hashes(r message.HashRequest) ([][32]byte, error) {
+	layer, ok := ti.PieceLayers[r.PiecesRoot]
+	if !ok {
+		return nil, errNoPieceLayer
+	}
+	width := merkle.Width(len(layer))
+	if r.BaseLayer != ti.pieceLayer() || r.Length <= 0 || merkle.Width(r.Length) != r.Length ||
+		r.Index < 0 || r.Index%r.Length != 0 || r.Index+r.Length > width {
+		return nil, errHashRequest
+	}
+
+	hashes := make([][32]byte, r.Length)
+	for i := range hashes {
+		hashes[i] = ti.padHash()
+		if r.Index+i < len(layer) {
+			hashes[i] = layer[r.Index+i]
+		}
+	}
+	proof := merkle.Proof(layer, width, ti.padHash(), r.Index, r.Length)
+	if len(proof) > r.ProofLayers {
+		proof = proof[:r.ProofLayers]
+	}
+	return append(hashes, proof...), nil
+}
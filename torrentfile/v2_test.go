@@ -0,0 +1,325 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Squwid/squidtorrent/client"
+	"github.com/Squwid/squidtorrent/merkle"
+	"github.com/Squwid/squidtorrent/message"
+	"github.com/Squwid/squidtorrent/mse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/bencode"
+)
+
+// v2Torrent writes a v2 torrent, or a hybrid one, of random files named a, b, c... to a temp dir. Returns the
+// torrent file path and the data of the torrent with padding between the files
+func v2Torrent(t *testing.T, pieceLength int, hybrid bool, lengths ...int) (string, []byte) {
+	tree := map[string]interface{}{}
+	layers := map[string]interface{}{}
+	var v1Files []interface{}
+	var data []byte
+
+	blocksPerPiece := pieceLength / merkle.BlockSize
+	pieceLayer := 0
+	for n := blocksPerPiece; n > 1; n /= 2 {
+		pieceLayer++
+	}
+	for i, length := range lengths {
+		name := string(rune('a' + i))
+		buf := make([]byte, length)
+		_, err := rand.Read(buf)
+		require.Nil(t, err)
+
+		blocks := merkle.BlockHashes(buf)
+		var root merkle.Hash
+		if length <= pieceLength {
+			root = merkle.Root(blocks, merkle.Width(len(blocks)), merkle.Hash{})
+		} else {
+			var layer []merkle.Hash
+			var raw []byte
+			for begin := 0; begin < len(blocks); begin += blocksPerPiece {
+				end := begin + blocksPerPiece
+				if end > len(blocks) {
+					end = len(blocks)
+				}
+				h := merkle.Root(blocks[begin:end], blocksPerPiece, merkle.Hash{})
+				layer = append(layer, h)
+				raw = append(raw, h[:]...)
+			}
+			root = merkle.Root(layer, merkle.Width(len(layer)), merkle.PadHash(pieceLayer))
+			layers[string(root[:])] = raw
+		}
+		tree[name] = map[string]interface{}{"": map[string]interface{}{"length": length, "pieces root": root[:]}}
+
+		data = append(data, buf...)
+		v1Files = append(v1Files, map[string]interface{}{"length": length, "path": []interface{}{name}})
+		if pad := (pieceLength - length%pieceLength) % pieceLength; pad > 0 && i < len(lengths)-1 {
+			data = append(data, make([]byte, pad)...)
+			v1Files = append(v1Files, map[string]interface{}{
+				"length": pad, "path": []interface{}{".pad", strconv.Itoa(pad)}, "attr": "p",
+			})
+		}
+	}
+
+	info := map[string]interface{}{
+		"name":         "squid",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for begin := 0; begin < len(data); begin += pieceLength {
+			end := begin + pieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			hash := sha1.Sum(data[begin:end])
+			pieces = append(pieces, hash[:]...)
+		}
+		info["pieces"] = pieces
+		info["files"] = v1Files
+	}
+
+	raw, err := bencode.EncodeBytes(map[string]interface{}{"info": info, "piece layers": layers})
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "squid.torrent")
+	require.Nil(t, os.WriteFile(path, raw, 0644))
+	return path, data
+}
+
+// infoDict is the raw info dictionary of a torrent file
+func infoDict(t *testing.T, path string) []byte {
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+	var mi struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	require.Nil(t, bencode.DecodeBytes(raw, &mi))
+	return mi.Info
+}
+
+func TestOpenV2(t *testing.T) {
+	path, data := v2Torrent(t, 32768, false, 100000, 10, 40000)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	info := infoDict(t, path)
+	assert.True(t, tf.Info.IsV2())
+	assert.False(t, tf.Info.IsHybrid())
+	assert.Equal(t, sha256.Sum256(info), tf.Info.InfoHashV2)
+	assert.Equal(t, tf.Info.InfoHashV2[:20], tf.Info.InfoHash[:])
+	assert.EqualValues(t, len(data), tf.Info.Length)
+	assert.EqualValues(t, 4+1+2, tf.Info.NumPieces)
+
+	var paths []string
+	for _, f := range tf.Info.Files {
+		if !f.Padding {
+			paths = append(paths, f.Path)
+		}
+	}
+	assert.Equal(t, []string{filepath.Join("squid", "a"), filepath.Join("squid", "b"), filepath.Join("squid", "c")}, paths)
+	assert.Len(t, tf.Info.PieceLayers, 2, "a and c are bigger than a piece")
+
+	ti, err := ParseInfo(info, tf.Info.InfoHash)
+	require.Nil(t, err)
+	assert.Equal(t, tf.Info.InfoHashV2, ti.InfoHashV2)
+
+	// Pieces are checked against the merkle trees
+	dir := t.TempDir()
+	bad := append([]byte(nil), data...)
+	bad[32768*4]++ // b
+	bad[len(bad)-1]++
+	writeFiles(t, tf, dir, bad)
+	res, err := tf.Info.Verify(dir)
+	require.Nil(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 5}, res.Good)
+	assert.Equal(t, []BadPiece{{4, []string{filepath.Join("squid", "b")}}, {6, []string{filepath.Join("squid", "c")}}}, res.Bad)
+
+	// Only hybrid torrents can be downloaded
+	assert.Equal(t, errV2Only, tf.DownloadToFile(context.Background(), t.TempDir()))
+}
+
+func TestV2Names(t *testing.T) {
+	file := map[string]interface{}{"": map[string]interface{}{"length": 10, "pieces root": make([]byte, 32)}}
+	tests := map[string]struct {
+		name  string
+		dir   string
+		fails bool
+	}{
+		"Fine":                 {name: "squid", dir: "dir"},
+		"Blank name":           {name: "", dir: "dir"},
+		"Name is ..":           {name: "..", dir: "dir", fails: true},
+		"Name is .":            {name: ".", dir: "dir", fails: true},
+		"Name has a separator": {name: "../squid", dir: "dir", fails: true},
+		"Dir is ..":            {name: "squid", dir: "..", fails: true},
+		"Dir has a separator":  {name: "squid", dir: `..\dir`, fails: true},
+	}
+
+	for name, test := range tests {
+		raw, err := bencode.EncodeBytes(map[string]interface{}{
+			"name":         test.name,
+			"piece length": 16384,
+			"meta version": 2,
+			"file tree":    map[string]interface{}{test.dir: map[string]interface{}{"a": file}},
+		})
+		require.Nil(t, err)
+
+		_, err = parseInfo(raw)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestOpenHybrid(t *testing.T) {
+	path, data := v2Torrent(t, 16384, true, 20000, 50000)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	info := infoDict(t, path)
+	assert.True(t, tf.Info.IsHybrid())
+	assert.Equal(t, sha1.Sum(info), tf.Info.InfoHash)
+	assert.Equal(t, sha256.Sum256(info), tf.Info.InfoHashV2)
+	require.Len(t, tf.Info.Files, 3)
+	assert.True(t, tf.Info.Files[1].Padding)
+	assert.NotEqual(t, [32]byte{}, tf.Info.Files[2].PiecesRoot)
+
+	for i := 0; i < int(tf.Info.NumPieces); i++ {
+		begin := i * 16384
+		end := begin + 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		assert.Nil(t, tf.Info.checkPiece(i, data[begin:end]), "piece %v", i)
+	}
+
+	// Download works off the v1 hashes, padding never hits the disk
+	seeder := fakeSeeder(t, tf.Info.InfoHash, 16384, data)
+	defer seeder.Close()
+	tracker := fakeTracker(seeder)
+	defer tracker.Close()
+	tf.AnnounceList = [][]string{{tracker.URL}}
+
+	outDir := t.TempDir()
+	require.Nil(t, tf.DownloadToFile(context.Background(), outDir))
+	got, err := os.ReadFile(filepath.Join(outDir, "squid", "b"))
+	require.Nil(t, err)
+	assert.Equal(t, data[32768:], got)
+	_, err = os.Stat(filepath.Join(outDir, tf.Info.Files[1].Path))
+	assert.True(t, os.IsNotExist(err))
+
+	// While seeding v2 peers can connect with the truncated v2 infohash
+	l, err := client.Listen("127.0.0.1:0", mse.Disable)
+	require.Nil(t, err)
+	defer l.Close()
+	tf.Listener = l
+	tf.Seed = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- tf.DownloadToFile(ctx, outDir) }()
+	var v2Hash [20]byte
+	copy(v2Hash[:], tf.Info.InfoHashV2[:])
+	assert.Equal(t, data[:100], leech(t, l.Addr().String(), v2Hash, 0, 0, 100))
+	cancel()
+	assert.Nil(t, <-errs)
+}
+
+func TestOpenV2Errors(t *testing.T) {
+	path, _ := v2Torrent(t, 16384, false, 50000)
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	tests := map[string]func(mi map[string]interface{}){
+		"Bad piece layer": func(mi map[string]interface{}) {
+			for root, layer := range mi["piece layers"].(map[string]interface{}) {
+				b := []byte(layer.(string))
+				b[0]++
+				mi["piece layers"].(map[string]interface{})[root] = b
+			}
+		},
+		"Piece length": func(mi map[string]interface{}) {
+			mi["info"].(map[string]interface{})["piece length"] = 16384 * 3
+		},
+		"Meta version": func(mi map[string]interface{}) {
+			mi["info"].(map[string]interface{})["meta version"] = 3
+		},
+	}
+
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mi map[string]interface{}
+			require.Nil(t, bencode.DecodeBytes(raw, &mi))
+			change(mi)
+			b, err := bencode.EncodeBytes(mi)
+			require.Nil(t, err)
+			path := filepath.Join(t.TempDir(), "bad.torrent")
+			require.Nil(t, os.WriteFile(path, b, 0644))
+
+			_, err = Open(path)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestHashes(t *testing.T) {
+	path, _ := v2Torrent(t, 16384, false, 16384*5+100)
+	tf, err := Open(path)
+	require.Nil(t, err)
+	root := tf.Info.Files[0].PiecesRoot
+	layer := tf.Info.PieceLayers[root]
+
+	// The hashes of the piece layer come first, the proof after them takes them up to the root. The layer
+	// has 6 pieces, so the tree is 8 wide
+	pad := tf.Info.padHash()
+	for _, test := range []struct {
+		r     message.HashRequest
+		proof []merkle.Hash
+	}{
+		{
+			r:     message.HashRequest{PiecesRoot: root, Index: 0, Length: 4, ProofLayers: 1},
+			proof: []merkle.Hash{merkle.Root(layer[4:], 4, pad)},
+		},
+		{
+			r:     message.HashRequest{PiecesRoot: root, Index: 4, Length: 2, ProofLayers: 2},
+			proof: []merkle.Hash{merkle.Root(nil, 2, pad), merkle.Root(layer[:4], 4, pad)},
+		},
+	} {
+		r := test.r
+		hashes, err := tf.Info.Hashes(r)
+		require.Nil(t, err)
+		got, gotHashes, err := message.FormatHashes(r, hashes).ParseHashes()
+		require.Nil(t, err)
+		assert.Equal(t, r, got)
+
+		for i, h := range gotHashes[:r.Length] {
+			if r.Index+i < len(layer) {
+				assert.Equal(t, layer[r.Index+i], h)
+			}
+		}
+		assert.Equal(t, test.proof, gotHashes[r.Length:])
+	}
+
+	// Fewer proof layers than asked for leave out the top of the proof
+	hashes, err := tf.Info.Hashes(message.HashRequest{PiecesRoot: root, Index: 4, Length: 2, ProofLayers: 1})
+	require.Nil(t, err)
+	assert.Len(t, hashes, 3)
+
+	_, err = tf.Info.Hashes(message.HashRequest{PiecesRoot: root, Index: 1, Length: 2})
+	assert.Equal(t, errHashRequest, err)
+	_, err = tf.Info.Hashes(message.HashRequest{PiecesRoot: root, BaseLayer: 1, Length: 2})
+	assert.Equal(t, errHashRequest, err)
+	_, err = tf.Info.Hashes(message.HashRequest{PiecesRoot: [32]byte{1}, Length: 1})
+	assert.Equal(t, errNoPieceLayer, err)
+}
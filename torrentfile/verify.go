@@ -0,0 +1,138 @@
+package torrentfile
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/Squwid/squidtorrent/storage"
+)
+
+// pieceState is what hashing a piece on disk turned up
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota // Could not be read, the file is not there or is too short
+	pieceGood
+	pieceBad
+)
+
+// VerifyResult is the state of every piece of a torrent on disk
+type VerifyResult struct {
+	Good    []int      `json:"good"`
+	Bad     []BadPiece `json:"bad"`
+	Missing []int      `json:"missing"`
+}
+
+// BadPiece is a piece that does not match its hash
+type BadPiece struct {
+	Index int      `json:"index"`
+	Files []string `json:"files"` // Every file the piece overlaps
+}
+
+// Complete tells if every piece is good
+func (vr VerifyResult) Complete() bool {
+	return len(vr.Bad) == 0 && len(vr.Missing) == 0
+}
+
+// Verify checks the files of the torrent in dir against the piece hashes without changing anything on disk.
+// Pieces are hashed in parallel on every CPU
+func (ti TorrentInfo) Verify(dir string) (*VerifyResult, error) {
+	store, err := storage.OpenFileStorage(dir, ti.storageFiles(), int64(ti.BencodeInfo.PieceLength))
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	vr := VerifyResult{Good: []int{}, Bad: []BadPiece{}, Missing: []int{}}
+	for i, state := range ti.hashPieces(store) {
+		switch state {
+		case pieceGood:
+			vr.Good = append(vr.Good, i)
+		case pieceBad:
+			vr.Bad = append(vr.Bad, BadPiece{Index: i, Files: ti.pieceFiles(i)})
+		default:
+			vr.Missing = append(vr.Missing, i)
+		}
+	}
+	return &vr, nil
+}
+
+// storageFiles are the files of the torrent for a storage
+func (ti TorrentInfo) storageFiles() []storage.File {
+	files := make([]storage.File, len(ti.Files))
+	for i, f := range ti.Files {
+		files[i] = storage.File{Path: f.Path, Length: f.Length, Padding: f.Padding}
+	}
+	return files
+}
+
+// pieceSize is the length of a piece, only the last one can be shorter than the piece length
+func (ti TorrentInfo) pieceSize(index int) int64 {
+	pieceLength := int64(ti.BencodeInfo.PieceLength)
+	size := ti.Length - int64(index)*pieceLength
+	if size > pieceLength {
+		size = pieceLength
+	}
+	return size
+}
+
+// pieceFiles are the paths of every file with data in a piece
+func (ti TorrentInfo) pieceFiles(index int) []string {
+	begin := int64(index) * int64(ti.BencodeInfo.PieceLength)
+	end := begin + ti.pieceSize(index)
+
+	var files []string
+	var offset int64
+	for _, f := range ti.Files {
+		if f.Length > 0 && !f.Padding && offset < end && offset+f.Length > begin {
+			files = append(files, f.Path)
+		}
+		offset += f.Length
+	}
+	return files
+}
+
+// hashPieces reads and hashes every piece of the storage
+func (ti TorrentInfo) hashPieces(store storage.Storage) []pieceState {
+	states := make([]pieceState, ti.NumPieces)
+	readPieces(store, int(ti.NumPieces), ti.pieceSize, func(i int, data []byte, err error) {
+		if err != nil {
+			return
+		}
+
+		states[i] = pieceBad
+		if ti.checkPiece(i, data) == nil {
+			states[i] = pieceGood
+		}
+	})
+	return states
+}
+
+// readPieces reads every piece of the storage, spread over a worker per CPU. fn gets called once for each
+// piece from several goroutines at once, data is only valid until it returns
+func readPieces(store storage.Storage, numPieces int, size func(index int) int64, fn func(index int, data []byte, err error)) {
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			for i := range indexes {
+				n := size(i)
+				if int64(len(buf)) < n {
+					buf = make([]byte, n)
+				}
+				_, err := store.Piece(i).ReadAt(buf[:n], 0)
+				fn(i, buf[:n], err)
+			}
+		}()
+	}
+
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
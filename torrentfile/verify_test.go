@@ -0,0 +1,78 @@
+package torrentfile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	// Pieces 0 and 1 are in a, 2 is in a, b and c, 3 and 4 are in c
+	tf, data := testTorrent(t, 16384, 40000, 5, 30000)
+	a, b, c := tf.Info.Files[0].Path, tf.Info.Files[1].Path, tf.Info.Files[2].Path
+
+	type testCase struct {
+		files   []int
+		corrupt []int64
+		result  VerifyResult
+	}
+
+	tcs := map[string]testCase{
+		"Everything is good": {
+			result: VerifyResult{Good: []int{0, 1, 2, 3, 4}, Bad: []BadPiece{}, Missing: []int{}},
+		},
+		"Nothing on disk": {
+			files:  []int{-1},
+			result: VerifyResult{Good: []int{}, Bad: []BadPiece{}, Missing: []int{0, 1, 2, 3, 4}},
+		},
+		"Missing file": {
+			files:  []int{0, 2},
+			result: VerifyResult{Good: []int{0, 1, 3, 4}, Bad: []BadPiece{}, Missing: []int{2}},
+		},
+		"Bad pieces": {
+			corrupt: []int64{0, 40002, 70000},
+			result: VerifyResult{
+				Good:    []int{1, 3},
+				Bad:     []BadPiece{{0, []string{a}}, {2, []string{a, b, c}}, {4, []string{c}}},
+				Missing: []int{},
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			buf := append([]byte(nil), data...)
+			for _, off := range tc.corrupt {
+				buf[off]++
+			}
+			dir := t.TempDir()
+			writeFiles(t, tf, dir, buf, tc.files...)
+
+			res, err := tf.Info.Verify(dir)
+			require.Nil(t, err)
+			assert.Equal(t, tc.result, *res)
+			assert.Equal(t, len(tc.corrupt) == 0 && len(tc.files) == 0, res.Complete())
+
+			// Nothing gets created while verifying
+			for i, f := range tf.Info.Files {
+				_, err := os.Stat(filepath.Join(dir, f.Path))
+				written := len(tc.files) == 0
+				for _, w := range tc.files {
+					written = written || w == i
+				}
+				assert.Equal(t, written, err == nil, f.Path)
+			}
+		})
+	}
+}
+
+func TestVerifyResultJSON(t *testing.T) {
+	vr := VerifyResult{Good: []int{0}, Bad: []BadPiece{{Index: 1, Files: []string{"a", "b"}}}, Missing: []int{}}
+	raw, err := json.Marshal(vr)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"good":[0],"bad":[{"index":1,"files":["a","b"]}],"missing":[]}`, string(raw))
+}
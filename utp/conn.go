@@ -0,0 +1,678 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payloadSize is the most data in a packet, small enough for pretty much any link including IPv6 ones
+	payloadSize = 1200
+
+	minWindow     = headerSize + payloadSize
+	maxWindow     = 1 << 20
+	initialWindow = 4 * minWindow
+
+	// LEDBAT aims for this much queueing delay, and grows the window by at most maxWindowIncrease bytes a
+	// round trip when the delay is below it
+	targetDelay       = 100 * time.Millisecond
+	maxWindowIncrease = 3000
+
+	sendBuffer = 1 << 20 // Bytes Write queues up before it blocks
+	recvBuffer = 1 << 20 // Bytes we take in before the application reads them
+
+	// maxTimeouts in a row and the connection is dead
+	maxTimeouts = 8
+
+	// reorderLimit is how far ahead of the next packet we keep packets that came early
+	reorderLimit = 1024
+
+	tickInterval = 50 * time.Millisecond
+)
+
+// minTimeout is the shortest the retransmit timeout gets, for sockets made after it's set. It's a var so
+// tests can lower it
+var minTimeout = 500 * time.Millisecond
+
+var (
+	errReset   = errors.New("utp connection reset by peer")
+	errTimeout = errors.New("utp connection timed out")
+)
+
+// outPacket is a packet we sent, or are about to send, that the peer has not acked
+type outPacket struct {
+	typ     uint8
+	seq     uint16
+	payload []byte
+
+	sent          time.Time
+	transmissions int
+	inflight      bool // Counted in the bytes in flight
+	acked         bool // Selectively acked, it waits for the packets before it
+	fastResent    bool
+}
+
+func (p *outPacket) size() int {
+	return headerSize + len(p.payload)
+}
+
+// Conn is a uTP connection
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16 // Connection id of the packets we get
+	sendID uint16 // Connection id of the packets we send
+
+	wmu       sync.Mutex // Held for a whole Write, so writes from different goroutines don't get mixed up
+	mu        sync.Mutex
+	changed   chan struct{} // Closed and replaced whenever something happens that a Read or Write waits for
+	connected bool
+	closed    bool  // Close was called
+	err       error // Set once the connection is broken
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Sending
+	seq        uint16 // Next sequence number
+	outgoing   []*outPacket
+	queued     int // Payload bytes in outgoing
+	inflight   int // Bytes sent that are not acked yet
+	cwnd       float64
+	peerWnd    int
+	lastAck    uint16
+	dupAcks    int
+	recovery   uint16 // The window doesn't get cut again for losses of packets before this one
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	baseDelay  [2]uint32 // Lowest delay this minute and the one before, 0 when there is none
+	baseMinute time.Time
+
+	// Receiving
+	ack       uint16 // Last packet we got in order
+	readBuf   []byte
+	early     map[uint16][]byte // Packets that came before the ones in front of them
+	earlySize int
+	finSeq    uint16
+	gotFin    bool
+	eof       bool
+	timeDiff  uint32 // How late the last packet of the peer was, sent back in our packets
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:       s,
+		raddr:   raddr,
+		recvID:  recvID,
+		sendID:  sendID,
+		changed: make(chan struct{}),
+		seq:     1,
+		cwnd:    initialWindow,
+		peerWnd: maxWindow,
+		rto:     time.Second,
+		early:   map[uint16][]byte{},
+	}
+}
+
+// connect sends the SYN and waits for the answer
+func (c *Conn) connect(timeout time.Duration) error {
+	c.mu.Lock()
+	c.queue(stSyn, nil)
+	c.flush()
+	c.mu.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		c.mu.Lock()
+		connected, err, changed := c.connected, c.err, c.changed
+		c.mu.Unlock()
+		switch {
+		case connected:
+			return nil
+		case err != nil:
+			return err
+		}
+		if err := wait(changed, deadline); err != nil {
+			return err
+		}
+	}
+}
+
+// accept sets up an incoming connection from its SYN
+func (c *Conn) accept(h *header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = true
+	c.ack = h.seq
+	c.seq = uint16(rand.Intn(1 << 16))
+	c.lastAck = c.seq - 1
+	c.recovery = c.seq
+	c.peerWnd = int(h.wnd)
+}
+
+// run resends packets that timed out until the connection is done with
+func (c *Conn) run() {
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+	for range t.C {
+		c.mu.Lock()
+		done := c.tick()
+		c.mu.Unlock()
+		if done {
+			c.s.remove(c)
+			return
+		}
+	}
+}
+
+// tick checks the oldest packet in flight for a timeout, it tells if the connection is done
+func (c *Conn) tick() bool {
+	if c.err != nil || (c.closed && len(c.outgoing) == 0) {
+		return true
+	}
+
+	var oldest *outPacket
+	for _, p := range c.outgoing {
+		if p.inflight && (oldest == nil || p.sent.Before(oldest.sent)) {
+			oldest = p
+		}
+	}
+	if oldest == nil || time.Since(oldest.sent) < c.rto {
+		return false
+	}
+
+	c.timeouts++
+	if c.timeouts > maxTimeouts {
+		c.fail(errTimeout)
+		return true
+	}
+	// Everything in flight is presumed lost, start over from the smallest window
+	for _, p := range c.outgoing {
+		if p.inflight {
+			p.inflight = false
+			c.inflight -= p.size()
+		}
+	}
+	c.cwnd = minWindow
+	c.recovery = c.seq
+	c.rto *= 2
+	if c.rto > time.Minute {
+		c.rto = time.Minute
+	}
+	c.flush()
+	return false
+}
+
+// handle takes a packet the peer sent
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.timeDiff = now() - h.timestamp
+
+	switch h.typ {
+	case stReset:
+		c.fail(errReset)
+		return
+	case stSyn:
+		// Our answer got lost, the peer sends the SYN again
+		if c.connected {
+			c.sendState()
+		}
+		return
+	}
+
+	if !c.connected {
+		if h.typ != stState {
+			return
+		}
+		// The answer to the SYN doesn't use up a sequence number, the first data packet has the same one
+		c.connected = true
+		c.ack = h.seq - 1
+		c.recovery = c.seq
+	}
+
+	c.acked(h)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	c.flush()
+	c.wake()
+}
+
+// acked goes through the acks of a packet. Packets that are acked are done with, packets that others were
+// acked around are lost and get resent
+func (c *Conn) acked(h *header) {
+	c.peerWnd = int(h.wnd)
+
+	ackedBytes, progress := 0, false
+	for len(c.outgoing) > 0 && !seqLess(h.ack, c.outgoing[0].seq) {
+		p := c.outgoing[0]
+		if p.transmissions == 0 {
+			break // The peer acks something we never sent
+		}
+		if p.transmissions == 1 && !p.acked {
+			c.measureRTT(time.Since(p.sent))
+		}
+		if !p.acked {
+			ackedBytes += p.size()
+		}
+		c.remove(p)
+		c.outgoing = c.outgoing[1:]
+		progress = true
+	}
+
+	if len(c.outgoing) > 0 && h.sack != nil {
+		first := c.outgoing[0].seq
+		for i := 0; i < len(h.sack)*8; i++ {
+			if h.sack[i/8]&(1<<uint(i%8)) == 0 {
+				continue
+			}
+			j := int(uint16(h.ack + 2 + uint16(i) - first))
+			if j >= len(c.outgoing) || c.outgoing[j].acked || c.outgoing[j].transmissions == 0 {
+				continue
+			}
+			p := c.outgoing[j]
+			ackedBytes += p.size()
+			if p.inflight {
+				p.inflight = false
+				c.inflight -= p.size()
+			}
+			p.acked = true
+			progress = true
+		}
+		c.resendSacked()
+	}
+
+	switch {
+	case progress:
+		c.lastAck, c.dupAcks, c.timeouts = h.ack, 0, 0
+	case h.typ == stState && h.ack == c.lastAck && len(c.outgoing) > 0:
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			c.resend(c.outgoing[0])
+		}
+	}
+
+	if ackedBytes > 0 {
+		c.grow(ackedBytes, h.timeDiff)
+	}
+}
+
+// resendSacked resends the packets that three packets after them were acked, they got lost
+func (c *Conn) resendSacked() {
+	after := 0
+	for i := len(c.outgoing) - 1; i >= 0; i-- {
+		p := c.outgoing[i]
+		if p.acked {
+			after++
+			continue
+		}
+		if after >= 3 && p.transmissions > 0 {
+			c.resend(p)
+		}
+	}
+}
+
+// resend sends a lost packet again straight away, it only happens once for each packet. Losing packets cuts
+// the window in half, once per window of packets
+func (c *Conn) resend(p *outPacket) {
+	if p.fastResent || p.acked {
+		return
+	}
+	p.fastResent = true
+	if !seqLess(p.seq, c.recovery) {
+		c.cwnd /= 2
+		if c.cwnd < minWindow {
+			c.cwnd = minWindow
+		}
+		c.recovery = c.seq
+	}
+	c.transmit(p)
+}
+
+// grow changes the window by how far the delay is from the target, LEDBAT. delay is how long our packets
+// take to get to the peer, less the lowest it has been is the time they spend in queues
+func (c *Conn) grow(ackedBytes int, delay uint32) {
+	if delay == 0 {
+		return
+	}
+	if time.Since(c.baseMinute) > time.Minute {
+		c.baseDelay[0], c.baseDelay[1] = c.baseDelay[1], 0
+		c.baseMinute = time.Now()
+	}
+	if c.baseDelay[1] == 0 || int32(delay-c.baseDelay[1]) < 0 {
+		c.baseDelay[1] = delay
+	}
+	base := c.baseDelay[1]
+	if c.baseDelay[0] != 0 && int32(c.baseDelay[0]-base) < 0 {
+		base = c.baseDelay[0]
+	}
+
+	queueing := time.Duration(delay-base) * time.Microsecond
+	offTarget := float64(targetDelay-queueing) / float64(targetDelay)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+	c.cwnd += maxWindowIncrease * offTarget * float64(ackedBytes) / c.cwnd
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+func (c *Conn) measureRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < c.s.minTimeout {
+		c.rto = c.s.minTimeout
+	}
+}
+
+// receive puts the data of a packet in order
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin {
+		c.gotFin, c.finSeq = true, h.seq
+	}
+	if c.eof || !seqLess(c.ack, h.seq) {
+		return // Already got it
+	}
+	if h.seq != c.ack+1 {
+		if _, ok := c.early[h.seq]; !ok && h.seq-c.ack < reorderLimit {
+			c.early[h.seq] = payload
+			c.earlySize += len(payload)
+		}
+		return
+	}
+
+	for {
+		c.readBuf = append(c.readBuf, payload...)
+		c.ack++
+		if c.gotFin && c.ack == c.finSeq {
+			c.eof = true
+			return
+		}
+		next, ok := c.early[c.ack+1]
+		if !ok {
+			return
+		}
+		delete(c.early, c.ack+1)
+		c.earlySize -= len(next)
+		payload = next
+	}
+}
+
+// queue adds a packet to send
+func (c *Conn) queue(typ uint8, payload []byte) {
+	c.outgoing = append(c.outgoing, &outPacket{typ: typ, seq: c.seq, payload: payload})
+	c.seq++
+	c.queued += len(payload)
+}
+
+// remove takes an acked packet out of the counts
+func (c *Conn) remove(p *outPacket) {
+	c.queued -= len(p.payload)
+	if p.inflight {
+		c.inflight -= p.size()
+	}
+}
+
+// flush sends what fits in the window. There is always room for one packet, so a window of 0 gets probed
+func (c *Conn) flush() {
+	window := int(c.cwnd)
+	if c.peerWnd < window {
+		window = c.peerWnd
+	}
+	for _, p := range c.outgoing {
+		if p.acked || p.inflight {
+			continue
+		}
+		if c.inflight > 0 && c.inflight+p.size() > window {
+			return
+		}
+		c.transmit(p)
+	}
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sent = time.Now()
+	p.transmissions++
+	if !p.inflight {
+		p.inflight = true
+		c.inflight += p.size()
+	}
+	c.s.send(c.raddr, c.header(p.typ, p.seq), p.payload)
+}
+
+// sendState acks what we got
+func (c *Conn) sendState() {
+	c.s.send(c.raddr, c.header(stState, c.seq), nil)
+}
+
+func (c *Conn) header(typ uint8, seq uint16) *header {
+	h := &header{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: now(),
+		timeDiff:  c.timeDiff,
+		wnd:       uint32(c.window()),
+		seq:       seq,
+		ack:       c.ack,
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	if len(c.early) > 0 {
+		h.sack = make([]byte, 4)
+		for seq := range c.early {
+			if i := int(seq - c.ack - 2); i < len(h.sack)*8 {
+				h.sack[i/8] |= 1 << uint(i%8)
+			}
+		}
+	}
+	return h
+}
+
+// window is how much more we can take in
+func (c *Conn) window() int {
+	if n := recvBuffer - len(c.readBuf) - c.earlySize; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// fail breaks the connection
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+		c.wake()
+	}
+}
+
+func (c *Conn) reset(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(err)
+}
+
+// wake lets every waiting Read and Write look again
+func (c *Conn) wake() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait waits for changed to be closed, or the deadline to pass
+func wait(changed <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.readBuf) > 0 {
+			full := c.window() < minWindow
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// The peer stopped sending when the buffer filled up, let it know there is room again
+			if full && c.window() >= minWindow && c.err == nil {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		var err error
+		switch {
+		case c.eof:
+			err = io.EOF
+		case c.err != nil:
+			err = c.err
+		}
+		changed, deadline := c.changed, c.readDeadline
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(changed, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues b to be sent, it blocks while the send buffer is full. Writes from different goroutines are fine
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	n := 0
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+
+		for n < len(b) && c.queued < sendBuffer {
+			size := len(b) - n
+			if size > payloadSize {
+				size = payloadSize
+			}
+			c.queue(stData, append([]byte(nil), b[n:n+size]...))
+			n += size
+		}
+		c.flush()
+		changed, deadline := c.changed, c.writeDeadline
+		c.mu.Unlock()
+
+		if n == len(b) {
+			return n, nil
+		}
+		if err := wait(changed, deadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close sends a FIN after the data that is still queued. The connection sticks around until the peer acks
+// it, reads and writes fail straight away
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err == nil && c.connected {
+		c.queue(stFin, nil)
+		c.flush()
+	} else {
+		c.fail(net.ErrClosed)
+	}
+	c.wake()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.wake()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.wake()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.wake()
+	return nil
+}
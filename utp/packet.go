@@ -0,0 +1,108 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2 // Ack without data
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+)
+
+// header is the start of every uTP packet
+type header struct {
+	typ       uint8
+	connID    uint16
+	timestamp uint32 // Microseconds, the clock of the sender
+	timeDiff  uint32 // How long the last packet took to get to the sender, as far as the clocks tell
+	wnd       uint32 // Bytes the sender can still take in
+	seq       uint16
+	ack       uint16 // Last packet the sender got in order
+
+	// sack has a bit for every packet after ack+1 that the sender got out of order, the lowest bit of the
+	// first byte is ack+2
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+	b := make([]byte, size)
+	b[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+
+	i := headerSize
+	if h.sack != nil {
+		b[1] = extSelectiveAck
+		b[i] = 0 // No more extensions
+		b[i+1] = uint8(len(h.sack))
+		i += 2 + copy(b[i+2:], h.sack)
+	}
+	copy(b[i:], payload)
+	return b
+}
+
+// isPacket tells if b looks like a uTP packet, anything else on the socket is for someone else
+func isPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+// parsePacket splits a packet into its header and payload
+func parsePacket(b []byte) (*header, []byte, error) {
+	if !isPacket(b) {
+		return nil, nil, fmt.Errorf("not a uTP packet")
+	}
+	h := &header{
+		typ:       b[0] >> 4,
+		connID:    binary.BigEndian.Uint16(b[2:]),
+		timestamp: binary.BigEndian.Uint32(b[4:]),
+		timeDiff:  binary.BigEndian.Uint32(b[8:]),
+		wnd:       binary.BigEndian.Uint32(b[12:]),
+		seq:       binary.BigEndian.Uint16(b[16:]),
+		ack:       binary.BigEndian.Uint16(b[18:]),
+	}
+
+	// Extensions are a chain, each one says what comes after it
+	ext, i := b[1], headerSize
+	for ext != 0 {
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return nil, nil, fmt.Errorf("extension %v is cut off", ext)
+		}
+		next, length := b[i], int(b[i+1])
+		if ext == extSelectiveAck {
+			h.sack = append([]byte(nil), b[i+2:i+2+length]...)
+		}
+		ext, i = next, i+2+length
+	}
+	return h, b[i:], nil
+}
+
+// now is the timestamp that goes in packets
+func now() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// seqLess tells if sequence number a comes before b, they wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
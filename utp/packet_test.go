@@ -0,0 +1,46 @@
+package utp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacket(t *testing.T) {
+	tests := map[string]struct {
+		h       header
+		payload []byte
+	}{
+		"State":         {h: header{typ: stState, connID: 7, timestamp: 1, timeDiff: 2, wnd: 3, seq: 4, ack: 5}},
+		"Data":          {h: header{typ: stData, connID: 0xffff, seq: 0xffff, ack: 1}, payload: []byte("hello")},
+		"Selective ack": {h: header{typ: stState, ack: 10, sack: []byte{0b101, 0, 0, 0x80}}},
+	}
+
+	for name, test := range tests {
+		b := test.h.marshal(test.payload)
+		assert.True(t, isPacket(b), name)
+
+		h, payload, err := parsePacket(b)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.h, *h, name)
+		assert.Equal(t, string(test.payload), string(payload), name)
+	}
+}
+
+func TestIsPacket(t *testing.T) {
+	// DHT messages are bencoded dictionaries, they share the socket
+	assert.False(t, isPacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")))
+	assert.False(t, isPacket([]byte{0x41, 0, 0}))
+	assert.False(t, isPacket(append([]byte{0x51}, make([]byte, 19)...)))
+
+	_, _, err := parsePacket(append([]byte{0x21, extSelectiveAck}, make([]byte, 18)...))
+	assert.NotNil(t, err)
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 2))
+	assert.True(t, seqLess(0xffff, 0))
+	assert.False(t, seqLess(0, 0xffff))
+}
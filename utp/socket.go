@@ -0,0 +1,303 @@
+// Package utp is the Micro Transport Protocol, BEP 29. It's a reliable stream over UDP that backs off when
+// it sees queueing delay, so it gets out of the way of other traffic on the same link
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxPacketSize = 2048
+	acceptBacklog = 32
+	otherBacklog  = 256 // Packets for the PacketConn that nobody read yet
+)
+
+var errClosed = errors.New("utp socket closed")
+
+// connKey finds the connection a packet is for, connection ids are only unique per address
+type connKey struct {
+	addr string
+	id   uint16 // The id the packets we get have
+}
+
+// A Socket runs uTP connections over a single UDP socket, both the ones we make and the ones that come in.
+// Packets that are not uTP can be read from PacketConn, so the DHT can share the port. It is the net.Listener
+// of the connections that come in
+type Socket struct {
+	pc         net.PacketConn
+	minTimeout time.Duration
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	closed  bool
+	accepts chan *Conn
+	other   chan packet
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// packet is a packet that came in for the PacketConn
+type packet struct {
+	b    []byte
+	addr net.Addr
+}
+
+// Listen opens a UDP socket on the address and starts running uTP on it
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP on a packet connection, it gets closed with the socket
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:         pc,
+		minTimeout: minTimeout,
+		conns:      map[connKey]*Conn{},
+		accepts:    make(chan *Conn, acceptBacklog),
+		other:      make(chan packet, otherBacklog),
+		done:       make(chan struct{}),
+	}
+	go s.serve()
+	return s
+}
+
+// Addr is the address of the UDP socket
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepts:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close resets every connection and closes the UDP socket
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.reset(errClosed)
+		}
+		close(s.done)
+		err = s.pc.Close()
+	})
+	return err
+}
+
+// Dial connects to a uTP peer at the address
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, 0)
+}
+
+// DialTimeout connects to a uTP peer, giving up after timeout. No timeout waits for as long as the SYN is
+// being resent
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	// Our id for packets coming in is random, the peer gets to use the next one
+	var id uint16
+	for {
+		id = uint16(rand.Intn(1 << 16))
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+	go c.run()
+
+	if err := c.connect(timeout); err != nil {
+		c.reset(err)
+		return nil, &net.OpError{Op: "dial", Net: "utp", Addr: raddr, Err: err}
+	}
+	return c, nil
+}
+
+// PacketConn reads the packets that are not uTP and writes straight to the socket. Closing it leaves the
+// socket open
+func (s *Socket) PacketConn() net.PacketConn {
+	return &packetConn{s: s, done: make(chan struct{})}
+}
+
+func (s *Socket) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithError(err).Debugf("Error reading from utp socket")
+			continue
+		}
+
+		if !isPacket(buf[:n]) {
+			select {
+			case s.other <- packet{append([]byte(nil), buf[:n]...), from}:
+			default:
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.handle(from, h, append([]byte(nil), payload...))
+	}
+}
+
+// handle passes a packet to its connection, SYNs start new ones
+func (s *Socket) handle(from net.Addr, h *header, payload []byte) {
+	s.mu.Lock()
+	c, ok := s.conns[connKey{from.String(), h.connID}]
+	if !ok && h.typ == stReset {
+		// Resets have the id the peer got our packets with
+		for _, id := range []uint16{h.connID - 1, h.connID + 1} {
+			if c, ok = s.conns[connKey{from.String(), id}]; ok && c.sendID == h.connID {
+				break
+			}
+			ok = false
+		}
+	}
+	if !ok && h.typ == stSyn {
+		// The peer sends with the id from the SYN, we send with it and get packets with the one after
+		if c, ok = s.conns[connKey{from.String(), h.connID + 1}]; !ok && !s.closed {
+			c = newConn(s, from, h.connID+1, h.connID)
+			c.accept(h)
+			select {
+			case s.accepts <- c:
+				s.conns[connKey{from.String(), h.connID + 1}] = c
+				ok = true
+				go c.run()
+			default:
+				// Nobody is accepting, the peer will find out below
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		if h.typ != stReset && h.typ != stState {
+			s.send(from, &header{typ: stReset, connID: h.connID, timestamp: now(), ack: h.seq}, nil)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+// remove forgets a connection that is done
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[connKey{c.raddr.String(), c.recvID}] == c {
+		delete(s.conns, connKey{c.raddr.String(), c.recvID})
+	}
+}
+
+func (s *Socket) send(addr net.Addr, h *header, payload []byte) error {
+	_, err := s.pc.WriteTo(h.marshal(payload), addr)
+	return err
+}
+
+// packetConn is the part of the socket that is not uTP
+type packetConn struct {
+	s *Socket
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	deadline := pc.deadline
+	pc.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p := <-pc.s.other:
+		return copy(b, p.b), p.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-pc.done:
+		return 0, nil, net.ErrClosed
+	case <-pc.s.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return pc.s.pc.WriteTo(b, addr)
+}
+
+func (pc *packetConn) Close() error {
+	pc.closeOnce.Do(func() { close(pc.done) })
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.s.pc.LocalAddr()
+}
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+// SetReadDeadline only applies to reads that start after it
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.deadline = t
+	return nil
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return pc.s.pc.SetWriteDeadline(t)
+}
@@ -0,0 +1,225 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lossyConn drops some of the packets written to it
+type lossyConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// socket runs uTP on a loopback socket that loses packets
+func socket(t *testing.T, loss float64, seed int64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := NewSocket(&lossyConn{PacketConn: pc, rand: rand.New(rand.NewSource(seed)), loss: loss})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect dials from a to b
+func connect(t *testing.T, a, b *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := b.Accept()
+		assert.Nil(t, err)
+		accepted <- c
+	}()
+	ca, err := a.DialTimeout(b.Addr().String(), 10*time.Second)
+	require.Nil(t, err)
+	cb := <-accepted
+	require.NotNil(t, cb)
+	return ca, cb
+}
+
+func TestTransfer(t *testing.T) {
+	defer func(d time.Duration) { minTimeout = d }(minTimeout)
+	minTimeout = 100 * time.Millisecond
+
+	tests := map[string]struct {
+		loss float64
+		size int
+	}{
+		"No loss":          {size: 1 << 20},
+		"Some loss":        {loss: 0.05, size: 256 << 10},
+		"Lots of loss":     {loss: 0.15, size: 64 << 10},
+		"Smaller than one": {size: 10},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ca, cb := connect(t, socket(t, test.loss, 1), socket(t, test.loss, 2))
+			data := make([]byte, test.size)
+			rand.New(rand.NewSource(3)).Read(data)
+
+			// Both ways at once, the dialer closes once it has everything
+			back := make(chan []byte, 1)
+			go func() {
+				got := make([]byte, len(data))
+				_, err := io.ReadFull(ca, got)
+				assert.Nil(t, err)
+				assert.Nil(t, ca.Close())
+				back <- got
+			}()
+			go func() {
+				_, err := ca.Write(data)
+				assert.Nil(t, err)
+			}()
+			_, err := cb.Write(data)
+			require.Nil(t, err)
+
+			got, err := io.ReadAll(cb)
+			require.Nil(t, err)
+			assert.True(t, bytes.Equal(data, got), "data sent by the dialer got mangled")
+			assert.True(t, bytes.Equal(data, <-back), "data sent to the dialer got mangled")
+
+			_, err = ca.Read(make([]byte, 1))
+			assert.Equal(t, net.ErrClosed, err)
+		})
+	}
+}
+
+func TestEcho(t *testing.T) {
+	defer func(d time.Duration) { minTimeout = d }(minTimeout)
+	minTimeout = 100 * time.Millisecond
+
+	ca, cb := connect(t, socket(t, 0.1, 4), socket(t, 0.1, 5))
+	go io.Copy(cb, cb)
+
+	for i := 0; i < 50; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 1+i*100)
+		_, err := ca.Write(msg)
+		require.Nil(t, err)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(ca, got)
+		require.Nil(t, err)
+		require.Equal(t, msg, got)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const writers, messages, size = 8, 4, 300 << 10
+
+	ca, cb := connect(t, socket(t, 0, 6), socket(t, 0, 7))
+
+	// Together the messages are bigger than the send buffer, so the writers have to wait for room
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for m := 0; m < messages; m++ {
+				_, err := ca.Write(bytes.Repeat([]byte{byte(w*messages + m)}, size))
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+
+	// Every message is one byte repeated, a message mixed with another shows up as a change halfway
+	seen := make(map[byte]bool)
+	msg := make([]byte, size)
+	for i := 0; i < writers*messages; i++ {
+		_, err := io.ReadFull(cb, msg)
+		require.Nil(t, err)
+		require.True(t, bytes.Equal(bytes.Repeat(msg[:1], size), msg), "message %d got mixed up", i)
+		require.False(t, seen[msg[0]], "message %d showed up twice", msg[0])
+		seen[msg[0]] = true
+	}
+	wg.Wait()
+}
+
+func TestDeadline(t *testing.T) {
+	ca, _ := connect(t, socket(t, 0, 1), socket(t, 0, 2))
+
+	require.Nil(t, ca.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := ca.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	ne, ok := err.(net.Error)
+	assert.True(t, ok && ne.Timeout())
+
+	// Nothing answers, the dial gives up
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+	_, err = socket(t, 0, 1).DialTimeout(pc.LocalAddr().String(), 200*time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestReset(t *testing.T) {
+	a, b := socket(t, 0, 1), socket(t, 0, 2)
+	ca, _ := connect(t, a, b)
+
+	// The other side went away without a FIN, the next packet gets a reset back
+	b.Close()
+	b2 := NewSocket(mustListen(t, b.Addr().String()))
+	defer b2.Close()
+	_, err := ca.Write([]byte("anyone there?"))
+	require.Nil(t, err)
+
+	ca.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = ca.Read(make([]byte, 1))
+	assert.Equal(t, errReset, err)
+}
+
+func mustListen(t *testing.T, addr string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", addr)
+	require.Nil(t, err)
+	return pc
+}
+
+func TestPacketConn(t *testing.T) {
+	s := socket(t, 0, 1)
+	pc := s.PacketConn()
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Packets that aren't uTP come out of the packet conn, like the DHT ones
+	_, err = other.WriteTo([]byte("d1:y1:qe"), s.Addr())
+	require.Nil(t, err)
+	buf := make([]byte, 100)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "d1:y1:qe", string(buf[:n]))
+	assert.Equal(t, other.LocalAddr().String(), from.String())
+
+	_, err = pc.WriteTo([]byte("d1:y1:re"), other.LocalAddr())
+	require.Nil(t, err)
+	n, _, err = other.ReadFrom(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "d1:y1:re", string(buf[:n]))
+
+	// Closing it leaves uTP running
+	require.Nil(t, pc.Close())
+	_, _, err = pc.ReadFrom(buf)
+	assert.Equal(t, net.ErrClosed, err)
+	connect(t, socket(t, 0, 2), s)
+}